@@ -0,0 +1,19 @@
+package auth
+
+import "context"
+
+// contextKey is the type of the keys this package stores in contexts
+type contextKey int
+
+const claimsKey contextKey = iota
+
+// NewContext returns a copy of ctx carrying an authenticated user's claims
+func NewContext(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey, claims)
+}
+
+// FromContext returns the claims stored by NewContext, or nil
+func FromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(claimsKey).(*Claims)
+	return claims
+}
@@ -2,60 +2,301 @@ package auth
 
 import (
 	"errors"
-	"os"
+	"fmt"
+	"log"
+	"strings"
 	"time"
 
+	"chatapp/config"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret []byte
+// defaultSecret is only suitable for local development
+const defaultSecret = "your-secret-key-change-in-production"
+
+// placeholderSecrets are well-known values that must never sign real tokens
+var placeholderSecrets = map[string]bool{
+	"":            true,
+	defaultSecret: true,
+	"your-super-secret-key-change-this-in-production": true,
+}
+
+var (
+	keyring         = NewKeyring(NewHMACKey([]byte(defaultSecret), ""))
+	accessTokenTTL  = 15 * time.Minute
+	mfaChallengeTTL = 5 * time.Minute
+	revocations     RevocationList
+)
+
+var (
+	// ErrTokenRevoked is returned for tokens whose session was logged out
+	ErrTokenRevoked = errors.New("token has been revoked")
+	// ErrNoSession is returned for access tokens that aren't tied to a
+	// session, such as those issued before sessions existed. They couldn't
+	// be revoked, so they aren't accepted.
+	ErrNoSession = errors.New("token has no session")
+	// ErrWrongPurpose is returned for tokens that are valid but not for the
+	// use they were presented for, e.g. an MFA challenge used as an access token
+	ErrWrongPurpose = errors.New("token is not valid for this use")
+)
+
+// Token purposes. MFAChallengePurpose marks the short-lived tokens that
+// stand in for a login until the second factor has been checked;
+// OIDCLoginPurpose marks the cookie carrying a single sign-on login from the
+// redirect to the identity provider back to the callback.
+const (
+	MFAChallengePurpose = "mfa_challenge"
+	OIDCLoginPurpose    = "oidc_login"
+)
+
+// RevocationList reports whether the access tokens of a session were revoked
+type RevocationList interface {
+	IsSessionRevoked(sessionID string) (bool, error)
+}
+
+// Configure builds the signing keyring and token lifetime from the loaded
+// configuration. Outside dev mode (DEBUG=true) it refuses to run with the
+// default or example secret.
+func Configure(cfg *config.Config) error {
+	ring, err := buildKeyring(cfg)
+	if err != nil {
+		return err
+	}
+
+	accessTokenTTL = cfg.AccessTokenTTL
+	mfaChallengeTTL = cfg.MFAChallengeTTL
+	keyring = ring
+	log.Printf("JWT signing key: %s (%s)", ring.active.ID, ring.active.Method.Alg())
+	return nil
+}
+
+// Rotate switches to the signing key described by cfg, e.g. after the key
+// file was replaced. Tokens signed by the previous key stay valid for
+// JWT_KEY_OVERLAP so clients can refresh without being logged out, and keys
+// newly listed in JWT_PREVIOUS_SECRETS or JWT_PREVIOUS_KEY_FILES are accepted.
+func Rotate(cfg *config.Config) error {
+	ring, err := buildKeyring(cfg)
+	if err != nil {
+		return err
+	}
+
+	previous := keyring.ActiveKeyID()
+	keyring.Rotate(ring, cfg.JWTKeyOverlap)
+	if previous != ring.active.ID {
+		log.Printf("JWT signing key rotated: %s -> %s (%s)", previous, ring.active.ID, ring.active.Method.Alg())
+	}
+	return nil
+}
+
+// JWKS returns the public verification keys, for /.well-known/jwks.json
+func JWKS() JWKSet {
+	return keyring.JWKS()
+}
+
+// buildKeyring loads the active key and any previous keys from configuration
+func buildKeyring(cfg *config.Config) (*Keyring, error) {
+	var active *Key
+	var previous []*Key
+
+	if cfg.JWTSigningKeyFile != "" {
+		key, err := LoadKeyFile(cfg.JWTSigningKeyFile, cfg.JWTSigningKeyID)
+		if err != nil {
+			return nil, fmt.Errorf("loading JWT_SIGNING_KEY_FILE: %w", err)
+		}
+		active = key
+
+		// A shared secret that is still configured keeps verifying the
+		// HS256 tokens issued before switching to an asymmetric key
+		if !placeholderSecrets[cfg.JWTSecret] {
+			previous = append(previous, NewHMACKey([]byte(cfg.JWTSecret), ""))
+		}
+	} else {
+		secret := cfg.JWTSecret
+		if placeholderSecrets[secret] {
+			if !cfg.Debug {
+				return nil, errors.New("JWT_SECRET is unset or still the example value: set a strong secret or JWT_SIGNING_KEY_FILE, or set DEBUG=true for local development")
+			}
+			log.Println("Warning: using the insecure default JWT secret (DEBUG mode)")
+			secret = defaultSecret
+		} else if len(secret) < 32 {
+			log.Println("Warning: JWT_SECRET is shorter than 32 characters")
+		}
+		active = NewHMACKey([]byte(secret), cfg.JWTSigningKeyID)
+	}
+
+	for _, secret := range cfg.JWTPreviousSecrets {
+		previous = append(previous, NewHMACKey([]byte(secret), ""))
+	}
+	for _, entry := range cfg.JWTPreviousKeyFiles {
+		// Entries are "path" or "kid=path" when the key had an explicit kid
+		kid, path, found := strings.Cut(entry, "=")
+		if !found {
+			kid, path = "", entry
+		}
+		key, err := LoadKeyFile(path, kid)
+		if err != nil {
+			return nil, fmt.Errorf("loading JWT_PREVIOUS_KEY_FILES: %w", err)
+		}
+		previous = append(previous, key)
+	}
 
-func init() {
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		secret = "your-secret-key-change-in-production"
+	ring := NewKeyring(active)
+	until := time.Now().Add(cfg.JWTKeyOverlap)
+	for _, key := range previous {
+		if key.ID != active.ID {
+			ring.Retire(key, until)
+		}
 	}
-	jwtSecret = []byte(secret)
+	return ring, nil
 }
 
-// Claims represents JWT claims
+// SetRevocationList makes ValidateToken reject tokens of revoked sessions
+func SetRevocationList(list RevocationList) {
+	revocations = list
+}
+
+// Claims represents JWT claims. Access tokens have no purpose.
 type Claims struct {
-	UserID   string `json:"user_id"`
-	Username string `json:"username"`
+	UserID    string `json:"user_id"`
+	Username  string `json:"username"`
+	SessionID string `json:"sid,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a new JWT token for a user
-func GenerateToken(userID, username string) (string, error) {
+// GenerateToken generates a new short-lived access token for a user. The
+// session ID ties it to the refresh token chain it was issued from.
+func GenerateToken(userID, username, sessionID string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(accessTokenTTL)
+	claims := Claims{
+		UserID:    userID,
+		Username:  username,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	signed, err := keyring.sign(claims)
+	return signed, expiresAt, err
+}
+
+// GenerateMFAChallenge generates a token proving that a user passed the
+// password check, to be exchanged for an access token with a second factor
+func GenerateMFAChallenge(userID, username string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(mfaChallengeTTL)
 	claims := Claims{
 		UserID:   userID,
 		Username: username,
+		Purpose:  MFAChallengePurpose,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	signed, err := keyring.sign(claims)
+	return signed, expiresAt, err
+}
+
+// ValidateMFAChallenge validates a token from GenerateMFAChallenge
+func ValidateMFAChallenge(tokenString string) (*Claims, error) {
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != MFAChallengePurpose {
+		return nil, ErrWrongPurpose
+	}
+	return claims, nil
 }
 
-// ValidateToken validates a JWT token and returns the claims
+// ValidateToken validates an access token and returns the claims
 func ValidateToken(tokenString string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("invalid signing method")
+	claims, err := parseToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Purpose != "" {
+		return nil, ErrWrongPurpose
+	}
+
+	if claims.SessionID == "" {
+		return nil, ErrNoSession
+	}
+	if revocations != nil {
+		revoked, err := revocations.IsSessionRevoked(claims.SessionID)
+		if err != nil {
+			return nil, err
 		}
-		return jwtSecret, nil
-	})
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	return claims, nil
+}
+
+// parseToken checks a token's signature and expiry and returns its claims
+func parseToken(tokenString string) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keyring.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}))
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return claims, nil
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
 	}
+	return claims, nil
+}
 
-	return nil, errors.New("invalid token")
+// OIDCLoginClaims carry the secrets of a single sign-on login that is in
+// progress. They never leave the browser that started the login.
+type OIDCLoginClaims struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Purpose  string `json:"purpose"`
+	jwt.RegisteredClaims
+}
+
+// GenerateOIDCLogin signs the state, nonce and PKCE verifier of a single
+// sign-on login for the callback to check
+func GenerateOIDCLogin(state, nonce, verifier string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return keyring.sign(OIDCLoginClaims{
+		State:    state,
+		Nonce:    nonce,
+		Verifier: verifier,
+		Purpose:  OIDCLoginPurpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+}
+
+// ValidateOIDCLogin validates a token from GenerateOIDCLogin
+func ValidateOIDCLogin(tokenString string) (*OIDCLoginClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &OIDCLoginClaims{}, keyring.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}))
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*OIDCLoginClaims)
+	if !ok || !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if claims.Purpose != OIDCLoginPurpose {
+		return nil, ErrWrongPurpose
+	}
+	return claims, nil
 }
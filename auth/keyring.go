@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a JWT signing key identified by its kid header
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+
+	signKey   interface{}
+	verifyKey interface{}
+}
+
+// NewHMACKey wraps a shared secret as an HS256 key. When kid is empty it is
+// derived from the secret, so the same secret always gets the same kid.
+func NewHMACKey(secret []byte, kid string) *Key {
+	if kid == "" {
+		sum := sha256.Sum256(append([]byte("chatapp-kid:"), secret...))
+		kid = "hs-" + hex.EncodeToString(sum[:8])
+	}
+	return &Key{ID: kid, Method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}
+}
+
+// LoadKeyFile reads a PEM encoded RSA (RS256) or Ed25519 (EdDSA) private key.
+// When kid is empty the RFC 7638 thumbprint of the public key is used.
+func LoadKeyFile(path, kid string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var private interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var key *Key
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		if private.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("%s: RSA keys must be at least 2048 bits", path)
+		}
+		key = &Key{Method: jwt.SigningMethodRS256, signKey: private, verifyKey: &private.PublicKey}
+	case ed25519.PrivateKey:
+		key = &Key{Method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: private.Public()}
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T (expected RSA or Ed25519)", path, private)
+	}
+
+	key.ID = kid
+	if key.ID == "" {
+		key.ID = key.thumbprint()
+	}
+	return key, nil
+}
+
+// JWK is the public JSON Web Key form of an asymmetric key
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+// JWKSet is the document served at /.well-known/jwks.json
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// jwk returns the public JWK for the key; HMAC secrets are never published
+func (k *Key) jwk() (JWK, bool) {
+	switch public := k.verifyKey.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			KeyType:   "RSA",
+			KeyID:     k.ID,
+			Algorithm: k.Method.Alg(),
+			Use:       "sig",
+			N:         base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			KeyType:   "OKP",
+			KeyID:     k.ID,
+			Algorithm: k.Method.Alg(),
+			Use:       "sig",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(public),
+		}, true
+	default:
+		return JWK{}, false
+	}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint of the public key
+func (k *Key) thumbprint() string {
+	jwk, ok := k.jwk()
+	if !ok {
+		return ""
+	}
+
+	// Required members only, in lexicographic order
+	var members interface{}
+	if jwk.KeyType == "RSA" {
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.KeyType, jwk.N}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Curve, jwk.KeyType, jwk.X}
+	}
+
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// retiredKey is a previous signing key still accepted for verification
+type retiredKey struct {
+	key   *Key
+	until time.Time
+}
+
+// expired reports whether the key's window has ended at now. The key is
+// accepted before until, and neither accepted nor published from then on.
+func (r retiredKey) expired(now time.Time) bool {
+	return !now.Before(r.until)
+}
+
+// Keyring holds the active signing key plus previous keys that are still
+// accepted until their overlap window ends
+type Keyring struct {
+	mu      sync.RWMutex
+	active  *Key
+	retired []retiredKey
+}
+
+// NewKeyring creates a keyring that signs with active
+func NewKeyring(active *Key) *Keyring {
+	return &Keyring{active: active}
+}
+
+// Retire accepts tokens signed by key until the given time
+func (k *Keyring) Retire(key *Key, until time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.retired = append(k.retired, retiredKey{key: key, until: until})
+}
+
+// Rotate switches to the keys of next, a keyring freshly built from
+// configuration. The previous active key keeps verifying tokens for overlap,
+// long enough for its tokens to expire. The retired keys of next are added,
+// and retired keys whose window has ended are dropped.
+func (k *Keyring) Rotate(next *Keyring, overlap time.Duration) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	retired := make([]retiredKey, 0, len(k.retired)+len(next.retired)+1)
+	add := func(candidate retiredKey) {
+		if candidate.key.ID == next.active.ID || candidate.expired(now) {
+			return
+		}
+		for i := range retired {
+			if retired[i].key.ID == candidate.key.ID {
+				if candidate.until.After(retired[i].until) {
+					retired[i].until = candidate.until
+				}
+				return
+			}
+		}
+		retired = append(retired, candidate)
+	}
+
+	for _, key := range k.retired {
+		add(key)
+	}
+	if k.active != nil {
+		add(retiredKey{key: k.active, until: now.Add(overlap)})
+	}
+	for _, key := range next.retired {
+		add(key)
+	}
+
+	k.active = next.active
+	k.retired = retired
+}
+
+// ActiveKeyID returns the kid new tokens are signed with
+func (k *Keyring) ActiveKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.active.ID
+}
+
+// sign signs claims with the active key and sets the kid header
+func (k *Keyring) sign(claims jwt.Claims) (string, error) {
+	k.mu.RLock()
+	active := k.active
+	k.mu.RUnlock()
+
+	token := jwt.NewWithClaims(active.Method, claims)
+	token.Header["kid"] = active.ID
+	return token.SignedString(active.signKey)
+}
+
+// keyFunc resolves the verification key for a token by its kid header. The
+// token's alg must match the key's, which rules out algorithm confusion.
+func (k *Keyring) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := k.lookup(kid)
+	if key == nil {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, errors.New("invalid signing method")
+	}
+	return key.verifyKey, nil
+}
+
+// lookup finds a usable key by kid. Tokens issued before kid headers were
+// introduced carry none; those are checked against the active key.
+func (k *Keyring) lookup(kid string) *Key {
+	return k.lookupAt(kid, time.Now())
+}
+
+// lookupAt is lookup at the given time
+func (k *Keyring) lookupAt(kid string, now time.Time) *Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" || kid == k.active.ID {
+		return k.active
+	}
+
+	for _, retired := range k.retired {
+		if retired.key.ID == kid && !retired.expired(now) {
+			return retired.key
+		}
+	}
+	return nil
+}
+
+// JWKS returns the public keys other services need to verify tokens
+func (k *Keyring) JWKS() JWKSet {
+	return k.jwksAt(time.Now())
+}
+
+// jwksAt is JWKS at the given time
+func (k *Keyring) jwksAt(now time.Time) JWKSet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	if jwk, ok := k.active.jwk(); ok {
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	for _, retired := range k.retired {
+		if retired.expired(now) {
+			continue
+		}
+		if jwk, ok := retired.key.jwk(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
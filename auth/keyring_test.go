@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newEd25519Key returns a fresh EdDSA key, which unlike HMAC keys is published
+func newEd25519Key(t *testing.T, kid string) *Key {
+	t.Helper()
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	return &Key{ID: kid, Method: jwt.SigningMethodEdDSA, signKey: private, verifyKey: public}
+}
+
+func TestKeyringRotateMergesAndPrunesRetiredKeys(t *testing.T) {
+	old := NewHMACKey([]byte("old-secret"), "")
+	expired := NewHMACKey([]byte("expired-secret"), "")
+	current := NewHMACKey([]byte("current-secret"), "")
+	next := NewHMACKey([]byte("next-secret"), "")
+	listed := NewHMACKey([]byte("listed-secret"), "")
+
+	ring := NewKeyring(current)
+	ring.Retire(old, time.Now().Add(time.Hour))
+	ring.Retire(expired, time.Now().Add(-time.Second))
+
+	// The reloaded configuration signs with next and lists another old key
+	reloaded := NewKeyring(next)
+	reloaded.Retire(listed, time.Now().Add(time.Hour))
+	ring.Rotate(reloaded, time.Hour)
+
+	if ring.ActiveKeyID() != next.ID {
+		t.Errorf("active key = %s, want %s", ring.ActiveKeyID(), next.ID)
+	}
+	for _, key := range []*Key{old, current, listed} {
+		if ring.lookup(key.ID) != key {
+			t.Errorf("key %s is no longer accepted", key.ID)
+		}
+	}
+	if ring.lookup(expired.ID) != nil {
+		t.Errorf("expired key %s is still accepted", expired.ID)
+	}
+	if len(ring.retired) != 3 {
+		t.Errorf("%d retired keys kept, want 3", len(ring.retired))
+	}
+}
+
+func TestKeyringRotateToSameKeyKeepsNoDuplicate(t *testing.T) {
+	current := NewHMACKey([]byte("current-secret"), "")
+
+	ring := NewKeyring(current)
+	ring.Rotate(NewKeyring(current), time.Hour)
+
+	if ring.ActiveKeyID() != current.ID || len(ring.retired) != 0 {
+		t.Errorf("rotating to the active key retired %d keys, want none", len(ring.retired))
+	}
+}
+
+func TestRetiredKeyExpiresEverywhereAtOnce(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	old := newEd25519Key(t, "old")
+	ring := NewKeyring(newEd25519Key(t, "current"))
+	ring.Retire(old, until)
+
+	for _, tt := range []struct {
+		now  time.Time
+		want bool
+	}{
+		{until.Add(-time.Nanosecond), true},
+		{until, false},
+		{until.Add(time.Nanosecond), false},
+	} {
+		accepted := ring.lookupAt(old.ID, tt.now) != nil
+		published := false
+		for _, jwk := range ring.jwksAt(tt.now).Keys {
+			published = published || jwk.KeyID == old.ID
+		}
+		if accepted != tt.want || published != tt.want {
+			t.Errorf("%v after until: accepted %v, published %v; want both %v", tt.now.Sub(until), accepted, published, tt.want)
+		}
+	}
+}
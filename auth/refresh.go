@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// NewRefreshToken returns a random opaque refresh token and the hash that
+// should be stored for it. The plain token is only ever given to the client.
+func NewRefreshToken() (token, hash string, err error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	token = base64.RawURLEncoding.EncodeToString(buf)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the hex SHA-256 of a refresh token
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,486 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Config holds the typed server configuration. Values are resolved from, in
+// order of precedence: command-line flags, environment variables, the .env
+// file and finally the defaults below.
+type Config struct {
+	// Server
+	Host            string
+	Port            int
+	ShutdownTimeout time.Duration
+
+	// Database
+	DatabaseURL string
+
+	// Authentication
+	JWTSecret           string
+	JWTPreviousSecrets  []string
+	JWTSigningKeyFile   string
+	JWTSigningKeyID     string
+	JWTPreviousKeyFiles []string
+	JWTKeyOverlap       time.Duration
+	AccessTokenTTL      time.Duration
+	RefreshTokenTTL     time.Duration
+	MFAIssuer           string
+	MFAChallengeTTL     time.Duration
+	PasswordLogin       bool
+
+	// Single sign-on
+	OIDCIssuerURL    string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+
+	// Chat
+	MaxMessageLength    int
+	MaxUsernameLength   int
+	MessageHistorySize  int
+	RecentMessagesCount int
+	ResumeMaxMessages   int
+
+	// WebSocket
+	WebSocketReadTimeout    time.Duration
+	WebSocketWriteTimeout   time.Duration
+	WebSocketPingPeriod     time.Duration
+	WebSocketMaxMessageSize int64
+
+	// Moderation
+	AdminUserIDs            []string
+	DeletedMessageRetention time.Duration
+
+	// Rate limiting
+	TrustProxyHeaders       bool
+	TrustedProxyHops        int
+	AuthRateLimitIP         Rate
+	LoginRateLimitUser      Rate
+	RegisterRateLimitIP     Rate
+	MessageRateLimit        Rate
+	MessageRateLimitStrikes int
+
+	// Account lockout
+	LoginLockoutThreshold   int
+	LoginIPLockoutThreshold int
+	LoginLockoutDuration    time.Duration
+	LoginLockoutMax         time.Duration
+	LoginFailureWindow      time.Duration
+
+	// Development
+	Debug    bool
+	LogLevel string
+}
+
+// Rate is a token bucket limit of Limit requests per Per. The zero Rate
+// disables the limit.
+type Rate struct {
+	Limit int
+	Per   time.Duration
+}
+
+// String formats the rate the way it is configured, e.g. 10/1m0s or off
+func (r Rate) String() string {
+	if r.Limit <= 0 {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", r.Limit, r.Per)
+}
+
+// parseRate parses a rate such as 10/1m, or off
+func parseRate(value string) (Rate, bool) {
+	if value == "off" || value == "0" {
+		return Rate{}, true
+	}
+
+	limit, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return Rate{}, false
+	}
+	parsedLimit, err := strconv.Atoi(strings.TrimSpace(limit))
+	if err != nil || parsedLimit <= 0 {
+		return Rate{}, false
+	}
+	parsedPer, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || parsedPer <= 0 {
+		return Rate{}, false
+	}
+	return Rate{Limit: parsedLimit, Per: parsedPer}, true
+}
+
+// frameOverhead is the room a WebSocket send frame needs besides the message
+// content: the envelope, the request ID and the other payload fields
+const frameOverhead = 512
+
+// Log levels accepted by LOG_LEVEL
+const (
+	LogLevelDebug = "debug"
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// Default returns the configuration used when nothing is overridden
+func Default() *Config {
+	return &Config{
+		Host:                    "",
+		Port:                    8080,
+		ShutdownTimeout:         15 * time.Second,
+		DatabaseURL:             "sqlite://chatapp.db",
+		JWTKeyOverlap:           time.Hour,
+		AccessTokenTTL:          15 * time.Minute,
+		RefreshTokenTTL:         30 * 24 * time.Hour,
+		MFAIssuer:               "Chatapp",
+		MFAChallengeTTL:         5 * time.Minute,
+		PasswordLogin:           true,
+		OIDCScopes:              []string{"openid", "profile", "email"},
+		MaxMessageLength:        500,
+		MaxUsernameLength:       20,
+		MessageHistorySize:      100,
+		RecentMessagesCount:     50,
+		ResumeMaxMessages:       200,
+		WebSocketReadTimeout:    60 * time.Second,
+		WebSocketWriteTimeout:   10 * time.Second,
+		WebSocketPingPeriod:     54 * time.Second,
+		WebSocketMaxMessageSize: 4096,
+		DeletedMessageRetention: 30 * 24 * time.Hour,
+		TrustedProxyHops:        1,
+		AuthRateLimitIP:         Rate{Limit: 30, Per: time.Minute},
+		LoginRateLimitUser:      Rate{Limit: 10, Per: time.Minute},
+		RegisterRateLimitIP:     Rate{Limit: 5, Per: time.Hour},
+		MessageRateLimit:        Rate{Limit: 20, Per: 10 * time.Second},
+		MessageRateLimitStrikes: 10,
+		LoginLockoutThreshold:   5,
+		LoginIPLockoutThreshold: 20,
+		LoginLockoutDuration:    time.Minute,
+		LoginLockoutMax:         time.Hour,
+		LoginFailureWindow:      24 * time.Hour,
+		Debug:                   false,
+		LogLevel:                LogLevelInfo,
+	}
+}
+
+// Addr returns the host:port address the HTTP server listens on
+func (c *Config) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
+
+// OIDCEnabled reports whether single sign-on through an OpenID Connect
+// provider is configured
+func (c *Config) OIDCEnabled() bool {
+	return c.OIDCIssuerURL != ""
+}
+
+// IsAdmin reports whether the user with userID is listed in ADMIN_USER_IDS
+func (c *Config) IsAdmin(userID string) bool {
+	for _, admin := range c.AdminUserIDs {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Load builds the configuration from command-line arguments (without the
+// program name), the environment and an optional .env file. It returns the
+// remaining non-flag arguments, e.g. a "migrate" subcommand.
+func Load(args []string) (*Config, []string, error) {
+	fs := flag.NewFlagSet("chatapp", flag.ContinueOnError)
+	envFile := fs.String("env-file", ".env", "path to an optional .env file")
+	// flag name -> environment key it overrides
+	flagKeys := map[string]string{
+		"host":         "HOST",
+		"port":         "PORT",
+		"database-url": "DATABASE_URL",
+		"log-level":    "LOG_LEVEL",
+		"debug":        "DEBUG",
+	}
+	fs.String("host", "", "interface to listen on (HOST)")
+	fs.String("port", "", "port to listen on (PORT)")
+	fs.String("database-url", "", "sqlite://, postgres:// or mysql:// URL (DATABASE_URL)")
+	fs.String("log-level", "", "debug, info, warn or error (LOG_LEVEL)")
+	fs.String("debug", "", "enable development mode, true or false (DEBUG)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Only flags given explicitly take precedence over the environment
+	flagsSet := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if key, ok := flagKeys[f.Name]; ok {
+			flagsSet[key] = f.Value.String()
+		}
+	})
+
+	dotenv, err := readDotEnv(*envFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading %s: %w", *envFile, err)
+	}
+
+	src := source{flags: flagsSet, dotenv: dotenv}
+	cfg, err := src.build()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cfg, fs.Args(), nil
+}
+
+// source resolves raw string values for configuration keys
+type source struct {
+	flags  map[string]string
+	dotenv map[string]string
+}
+
+// lookup returns the raw value for key and whether it was set anywhere
+func (s source) lookup(key string) (string, bool) {
+	if value, ok := s.flags[key]; ok {
+		return value, true
+	}
+	if value, ok := os.LookupEnv(key); ok {
+		return value, true
+	}
+	value, ok := s.dotenv[key]
+	return value, ok
+}
+
+// build parses and validates every setting, reporting all problems at once
+func (s source) build() (*Config, error) {
+	cfg := Default()
+	var errs []error
+
+	str := func(key string, target *string) {
+		if value, ok := s.lookup(key); ok {
+			*target = strings.TrimSpace(value)
+		}
+	}
+	integer := func(key string, target *int, min, max int) {
+		value, ok := s.lookup(key)
+		if !ok {
+			return
+		}
+		parsed, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || parsed < min || parsed > max {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be an integer between %d and %d", key, value, min, max))
+			return
+		}
+		*target = parsed
+	}
+	duration := func(key string, target *time.Duration) {
+		value, ok := s.lookup(key)
+		if !ok {
+			return
+		}
+		parsed, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || parsed <= 0 {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be a positive duration such as 10s or 1m", key, value))
+			return
+		}
+		*target = parsed
+	}
+	list := func(key string, target *[]string) {
+		value, ok := s.lookup(key)
+		if !ok {
+			return
+		}
+		*target = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*target = append(*target, item)
+			}
+		}
+	}
+	rate := func(key string, target *Rate) {
+		value, ok := s.lookup(key)
+		if !ok {
+			return
+		}
+		parsed, ok := parseRate(strings.ToLower(strings.TrimSpace(value)))
+		if !ok {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be a rate such as 10/1m, or off", key, value))
+			return
+		}
+		*target = parsed
+	}
+	boolean := func(key string, target *bool) {
+		value, ok := s.lookup(key)
+		if !ok {
+			return
+		}
+		parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s %q: must be true or false", key, value))
+			return
+		}
+		*target = parsed
+	}
+
+	str("HOST", &cfg.Host)
+	integer("PORT", &cfg.Port, 1, 65535)
+	duration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout)
+	str("DATABASE_URL", &cfg.DatabaseURL)
+	str("JWT_SECRET", &cfg.JWTSecret)
+	list("JWT_PREVIOUS_SECRETS", &cfg.JWTPreviousSecrets)
+	str("JWT_SIGNING_KEY_FILE", &cfg.JWTSigningKeyFile)
+	str("JWT_SIGNING_KEY_ID", &cfg.JWTSigningKeyID)
+	list("JWT_PREVIOUS_KEY_FILES", &cfg.JWTPreviousKeyFiles)
+	duration("JWT_KEY_OVERLAP", &cfg.JWTKeyOverlap)
+	duration("ACCESS_TOKEN_TTL", &cfg.AccessTokenTTL)
+	duration("REFRESH_TOKEN_TTL", &cfg.RefreshTokenTTL)
+	str("MFA_ISSUER", &cfg.MFAIssuer)
+	duration("MFA_CHALLENGE_TTL", &cfg.MFAChallengeTTL)
+	boolean("PASSWORD_LOGIN", &cfg.PasswordLogin)
+
+	str("OIDC_ISSUER_URL", &cfg.OIDCIssuerURL)
+	str("OIDC_CLIENT_ID", &cfg.OIDCClientID)
+	str("OIDC_CLIENT_SECRET", &cfg.OIDCClientSecret)
+	str("OIDC_REDIRECT_URL", &cfg.OIDCRedirectURL)
+	list("OIDC_SCOPES", &cfg.OIDCScopes)
+
+	integer("MAX_MESSAGE_LENGTH", &cfg.MaxMessageLength, 1, 1<<20)
+	integer("MAX_USERNAME_LENGTH", &cfg.MaxUsernameLength, 1, 100)
+	integer("MESSAGE_HISTORY_SIZE", &cfg.MessageHistorySize, 1, 10000)
+	integer("RECENT_MESSAGES_COUNT", &cfg.RecentMessagesCount, 0, 10000)
+	integer("RESUME_MAX_MESSAGES", &cfg.ResumeMaxMessages, 0, 10000)
+
+	duration("WEBSOCKET_READ_TIMEOUT", &cfg.WebSocketReadTimeout)
+	duration("WEBSOCKET_WRITE_TIMEOUT", &cfg.WebSocketWriteTimeout)
+	duration("WEBSOCKET_PING_PERIOD", &cfg.WebSocketPingPeriod)
+	maxMessageSize := int(cfg.WebSocketMaxMessageSize)
+	integer("WEBSOCKET_MAX_MESSAGE_SIZE", &maxMessageSize, 64, 1<<23)
+	cfg.WebSocketMaxMessageSize = int64(maxMessageSize)
+
+	list("ADMIN_USER_IDS", &cfg.AdminUserIDs)
+	// Anyone can register or sign in with an unclaimed username, so admins
+	// listed by name are refused rather than silently ignored
+	if value, ok := s.lookup("ADMIN_USERNAMES"); ok && strings.TrimSpace(value) != "" {
+		errs = append(errs, errors.New("ADMIN_USERNAMES is no longer supported: list the admins' user IDs in ADMIN_USER_IDS"))
+	}
+	duration("DELETED_MESSAGE_RETENTION", &cfg.DeletedMessageRetention)
+
+	boolean("TRUST_PROXY_HEADERS", &cfg.TrustProxyHeaders)
+	integer("TRUSTED_PROXY_HOPS", &cfg.TrustedProxyHops, 1, 10)
+	rate("AUTH_RATE_LIMIT_IP", &cfg.AuthRateLimitIP)
+	rate("LOGIN_RATE_LIMIT_USER", &cfg.LoginRateLimitUser)
+	rate("REGISTER_RATE_LIMIT_IP", &cfg.RegisterRateLimitIP)
+	rate("MESSAGE_RATE_LIMIT", &cfg.MessageRateLimit)
+	integer("MESSAGE_RATE_LIMIT_STRIKES", &cfg.MessageRateLimitStrikes, 0, 10000)
+
+	integer("LOGIN_LOCKOUT_THRESHOLD", &cfg.LoginLockoutThreshold, 0, 1000)
+	integer("LOGIN_IP_LOCKOUT_THRESHOLD", &cfg.LoginIPLockoutThreshold, 0, 100000)
+	duration("LOGIN_LOCKOUT_DURATION", &cfg.LoginLockoutDuration)
+	duration("LOGIN_LOCKOUT_MAX", &cfg.LoginLockoutMax)
+	duration("LOGIN_FAILURE_WINDOW", &cfg.LoginFailureWindow)
+
+	boolean("DEBUG", &cfg.Debug)
+	str("LOG_LEVEL", &cfg.LogLevel)
+	cfg.LogLevel = strings.ToLower(cfg.LogLevel)
+
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+// validate checks constraints that span more than one setting
+func (c *Config) validate() []error {
+	var errs []error
+
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("DATABASE_URL must not be empty"))
+	}
+
+	if c.AccessTokenTTL >= c.RefreshTokenTTL {
+		errs = append(errs, fmt.Errorf("ACCESS_TOKEN_TTL (%s) must be shorter than REFRESH_TOKEN_TTL (%s)",
+			c.AccessTokenTTL, c.RefreshTokenTTL))
+	}
+
+	if c.MFAIssuer == "" {
+		errs = append(errs, errors.New("MFA_ISSUER must not be empty"))
+	}
+
+	if c.OIDCEnabled() {
+		errs = append(errs, c.validateOIDC()...)
+	} else if !c.PasswordLogin {
+		errs = append(errs, errors.New("PASSWORD_LOGIN=false requires single sign-on: set OIDC_ISSUER_URL"))
+	}
+
+	if c.JWTKeyOverlap < c.AccessTokenTTL {
+		errs = append(errs, fmt.Errorf("JWT_KEY_OVERLAP (%s) must be at least ACCESS_TOKEN_TTL (%s) so tokens signed by a previous key can expire naturally",
+			c.JWTKeyOverlap, c.AccessTokenTTL))
+	}
+
+	if c.WebSocketPingPeriod >= c.WebSocketReadTimeout {
+		errs = append(errs, fmt.Errorf("WEBSOCKET_PING_PERIOD (%s) must be shorter than WEBSOCKET_READ_TIMEOUT (%s)",
+			c.WebSocketPingPeriod, c.WebSocketReadTimeout))
+	}
+
+	// A message of MAX_MESSAGE_LENGTH characters of up to 4 UTF-8 bytes each
+	// must fit in a frame, or sending it closes the connection
+	if need := int64(c.MaxMessageLength)*4 + frameOverhead; c.WebSocketMaxMessageSize < need {
+		errs = append(errs, fmt.Errorf("WEBSOCKET_MAX_MESSAGE_SIZE (%d) must be at least %d bytes to fit a MAX_MESSAGE_LENGTH (%d) message of 4-byte characters plus %d bytes of framing",
+			c.WebSocketMaxMessageSize, need, c.MaxMessageLength, frameOverhead))
+	}
+
+	if c.LoginLockoutMax < c.LoginLockoutDuration {
+		errs = append(errs, fmt.Errorf("LOGIN_LOCKOUT_MAX (%s) must be at least LOGIN_LOCKOUT_DURATION (%s)",
+			c.LoginLockoutMax, c.LoginLockoutDuration))
+	}
+
+	if c.LoginFailureWindow <= c.LoginLockoutMax {
+		errs = append(errs, fmt.Errorf("LOGIN_FAILURE_WINDOW (%s) must be longer than LOGIN_LOCKOUT_MAX (%s) so lockouts keep growing",
+			c.LoginFailureWindow, c.LoginLockoutMax))
+	}
+
+	for _, id := range c.AdminUserIDs {
+		if uuid.Validate(id) != nil {
+			errs = append(errs, fmt.Errorf("invalid ADMIN_USER_IDS entry %q: must be a user ID, as returned by /api/login", id))
+		}
+	}
+
+	switch c.LogLevel {
+	case LogLevelDebug, LogLevelInfo, LogLevelWarn, LogLevelError:
+	default:
+		errs = append(errs, fmt.Errorf("invalid LOG_LEVEL %q: must be debug, info, warn or error", c.LogLevel))
+	}
+
+	return errs
+}
+
+// validateOIDC checks the single sign-on settings
+func (c *Config) validateOIDC() []error {
+	var errs []error
+
+	if issuer, err := url.Parse(c.OIDCIssuerURL); err != nil || issuer.Host == "" ||
+		(issuer.Scheme != "https" && !(c.Debug && issuer.Scheme == "http")) {
+		errs = append(errs, fmt.Errorf("invalid OIDC_ISSUER_URL %q: must be an https:// URL (http:// is allowed with DEBUG=true)", c.OIDCIssuerURL))
+	}
+	if c.OIDCClientID == "" {
+		errs = append(errs, errors.New("OIDC_CLIENT_ID is required with OIDC_ISSUER_URL"))
+	}
+	if redirect, err := url.Parse(c.OIDCRedirectURL); err != nil || !redirect.IsAbs() {
+		errs = append(errs, fmt.Errorf("invalid OIDC_REDIRECT_URL %q: must be the absolute URL of /api/auth/oidc/callback", c.OIDCRedirectURL))
+	}
+
+	hasOpenID := false
+	for _, scope := range c.OIDCScopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		errs = append(errs, errors.New("OIDC_SCOPES must include openid"))
+	}
+
+	return errs
+}
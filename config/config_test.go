@@ -0,0 +1,28 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if errs := Default().validate(); len(errs) > 0 {
+		t.Fatalf("default configuration is invalid: %v", errs)
+	}
+}
+
+func TestValidateFrameFitsLongestMessage(t *testing.T) {
+	cfg := Default()
+	cfg.MaxMessageLength = 500
+	cfg.WebSocketMaxMessageSize = 512
+
+	errs := cfg.validate()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "WEBSOCKET_MAX_MESSAGE_SIZE") {
+		t.Fatalf("validate() = %v, want a WEBSOCKET_MAX_MESSAGE_SIZE error", errs)
+	}
+
+	cfg.WebSocketMaxMessageSize = 500*4 + frameOverhead
+	if errs := cfg.validate(); len(errs) > 0 {
+		t.Errorf("validate() with a frame that fits = %v, want no errors", errs)
+	}
+}
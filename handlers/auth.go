@@ -2,27 +2,68 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"time"
+	"unicode/utf8"
 
 	"chatapp/auth"
+	"chatapp/config"
 	"chatapp/models"
+	"chatapp/oidc"
+	"chatapp/ratelimit"
 	"chatapp/store"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
 // AuthHandler handles authentication-related requests
 type AuthHandler struct {
-	userStore *store.UserStore
+	config            *config.Config
+	userStore         store.UserStore
+	tokenStore        store.TokenStore
+	attemptStore      store.LoginAttemptStore
+	notificationStore store.NotificationStore
+	hub               *Hub
+	sso               *oidc.Provider // nil unless single sign-on is configured
+
+	// Rate limits: logins and refreshes per IP, logins per username and
+	// registrations per IP
+	ipLimiter       *ratelimit.Limiter
+	usernameLimiter *ratelimit.Limiter
+	registerLimiter *ratelimit.Limiter
 }
 
 // NewAuthHandler creates a new authentication handler
-func NewAuthHandler(userStore *store.UserStore) *AuthHandler {
+func NewAuthHandler(cfg *config.Config, userStore store.UserStore, tokenStore store.TokenStore,
+	attemptStore store.LoginAttemptStore, notificationStore store.NotificationStore, hub *Hub,
+	sso *oidc.Provider) *AuthHandler {
 	return &AuthHandler{
-		userStore: userStore,
+		config:            cfg,
+		userStore:         userStore,
+		tokenStore:        tokenStore,
+		attemptStore:      attemptStore,
+		notificationStore: notificationStore,
+		hub:               hub,
+		sso:               sso,
+		ipLimiter:         ratelimit.New(cfg.AuthRateLimitIP.Limit, cfg.AuthRateLimitIP.Per),
+		usernameLimiter:   ratelimit.New(cfg.LoginRateLimitUser.Limit, cfg.LoginRateLimitUser.Per),
+		registerLimiter:   ratelimit.New(cfg.RegisterRateLimitIP.Limit, cfg.RegisterRateLimitIP.Per),
 	}
 }
 
 // Register handles user registration
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
+	if h.passwordLoginDisabled(w) {
+		return
+	}
+	if rateLimited(w, h.registerLimiter, clientIP(r, h.config)) {
+		return
+	}
+
 	var req models.RegisterRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -35,6 +76,11 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if utf8.RuneCountInString(req.Username) > h.config.MaxUsernameLength {
+		http.Error(w, fmt.Sprintf("Username must be at most %d characters", h.config.MaxUsernameLength), http.StatusBadRequest)
+		return
+	}
+
 	if len(req.Password) < 6 {
 		http.Error(w, "Password must be at least 6 characters", http.StatusBadRequest)
 		return
@@ -54,24 +100,21 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Username already exists", http.StatusConflict)
 			return
 		}
+		if err == store.ErrEmailExists {
+			http.Error(w, "Email already registered", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
 
-	// Generate token
-	token, err := auth.GenerateToken(user.ID, user.Username)
+	// Start a new session
+	response, err := h.issueTokens(user, uuid.New().String())
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	// Send response
-	response := models.AuthResponse{
-		Token:    token,
-		Username: user.Username,
-		UserID:   user.ID,
-	}
-
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
@@ -79,6 +122,14 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 
 // Login handles user login
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if h.passwordLoginDisabled(w) {
+		return
+	}
+	ip := clientIP(r, h.config)
+	if rateLimited(w, h.ipLimiter, ip) {
+		return
+	}
+
 	var req models.LoginRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -91,33 +142,279 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user
+	// Guessing one account's password from many addresses is limited too
+	if rateLimited(w, h.usernameLimiter, req.Username) {
+		return
+	}
+
+	// Refuse locked out usernames and addresses before checking the password
+	if h.loginLocked(w, userLoginKey(req.Username), ipLoginKey(ip)) {
+		return
+	}
+
+	// Get user. Unknown usernames count as failures too, so lockouts don't
+	// reveal which accounts exist.
 	user, err := h.userStore.GetUser(req.Username)
 	if err != nil {
+		h.loginFailed(nil, req.Username, ip)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
 	// Check password
 	if !auth.CheckPassword(req.Password, user.PasswordHash) {
+		h.loginFailed(user, req.Username, ip)
 		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
 		return
 	}
 
-	// Generate token
-	token, err := auth.GenerateToken(user.ID, user.Username)
+	// With two-factor authentication the password only earns a challenge;
+	// tokens are issued by LoginMFA once a code has been checked
+	if user.TOTPEnabled() {
+		mfaToken, expiresAt, err := auth.GenerateMFAChallenge(user.ID, user.Username)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(models.MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiresAt:   expiresAt,
+		})
+		return
+	}
+
+	h.completeLogin(w, user)
+}
+
+// completeLogin starts a new session for a user who passed every login check
+func (h *AuthHandler) completeLogin(w http.ResponseWriter, user *models.User) {
+	// A successful login starts the account's failure count over
+	if err := h.attemptStore.ClearLoginAttempts(userLoginKey(user.Username)); err != nil {
+		log.Printf("Error clearing failed logins for %s: %v", user.Username, err)
+	}
+
+	response, err := h.issueTokens(user, uuid.New().String())
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	// Send response
-	response := models.AuthResponse{
-		Token:    token,
-		Username: user.Username,
-		UserID:   user.ID,
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// passwordLoginDisabled replies 403 when PASSWORD_LOGIN is off and everyone
+// has to sign in through single sign-on
+func (h *AuthHandler) passwordLoginDisabled(w http.ResponseWriter) bool {
+	if h.config.PasswordLogin {
+		return false
+	}
+	http.Error(w, "Password login is disabled, please sign in with single sign-on", http.StatusForbidden)
+	return true
+}
+
+// Refresh handles POST /api/token/refresh - exchanges a refresh token for a
+// new access token and a new refresh token. Each refresh token works once;
+// presenting one that was already used revokes the whole session.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, h.ipLimiter, clientIP(r, h.config)) {
+		return
+	}
+
+	var req models.RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Refresh token is required", http.StatusBadRequest)
+		return
+	}
+
+	refreshToken, err := h.tokenStore.GetRefreshToken(auth.HashRefreshToken(req.RefreshToken))
+	if err != nil {
+		if err == store.ErrTokenNotFound {
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+
+	if time.Now().After(refreshToken.ExpiresAt) {
+		http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+		return
+	}
+
+	// Rotate: mark the presented token as used. Finding it already used, or
+	// losing the race to use it, means the token leaked, so end the session.
+	err = store.ErrTokenRevoked
+	if refreshToken.RevokedAt == nil {
+		err = h.tokenStore.RevokeRefreshToken(refreshToken.ID)
+	}
+	if err != nil && err != store.ErrTokenRevoked {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if err == store.ErrTokenRevoked {
+		log.Printf("Refresh token reuse detected for user %s, revoking session", refreshToken.UserID)
+		h.revokeSession(refreshToken.SessionID)
+		http.Error(w, "Refresh token already used", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(refreshToken.UserID)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	response, err := h.issueTokens(user, refreshToken.SessionID)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	// A logout or reuse detection may have revoked the session since the
+	// token was rotated. The check comes after the new refresh token is
+	// stored, so a revocation committing any later revokes that one too.
+	revoked, err := h.tokenStore.IsSessionRevoked(refreshToken.SessionID)
+	if err != nil {
+		http.Error(w, "Failed to refresh token", http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		h.revokeSession(refreshToken.SessionID)
+		http.Error(w, "Session has been revoked", http.StatusUnauthorized)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// Logout handles POST /api/logout - revokes the session of the presented
+// access token and/or refresh token and disconnects its WebSocket clients
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	var req models.LogoutRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sessions := make(map[string]bool)
+
+	if token := tokenFromRequest(r); token != "" {
+		claims, err := auth.ValidateToken(token)
+		if err != nil && !errors.Is(err, auth.ErrTokenRevoked) && !errors.Is(err, auth.ErrNoSession) {
+			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			return
+		}
+		if claims != nil {
+			sessions[claims.SessionID] = true
+		}
+	}
+
+	if req.RefreshToken != "" {
+		refreshToken, err := h.tokenStore.GetRefreshToken(auth.HashRefreshToken(req.RefreshToken))
+		if err == nil {
+			sessions[refreshToken.SessionID] = true
+		}
+	}
+
+	if len(sessions) == 0 {
+		http.Error(w, "A valid access or refresh token is required", http.StatusUnauthorized)
+		return
+	}
+
+	for sessionID := range sessions {
+		if err := h.revokeSession(sessionID); err != nil {
+			http.Error(w, "Failed to log out", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueTokens creates an access token and a stored refresh token for a session
+func (h *AuthHandler) issueTokens(user *models.User, sessionID string) (*models.AuthResponse, error) {
+	accessToken, expiresAt, err := auth.GenerateToken(user.ID, user.Username, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.tokenStore.CreateRefreshToken(&models.RefreshToken{
+		ID:        uuid.New().String(),
+		UserID:    user.ID,
+		SessionID: sessionID,
+		TokenHash: refreshHash,
+		ExpiresAt: time.Now().Add(h.config.RefreshTokenTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.AuthResponse{
+		Token:        accessToken,
+		ExpiresAt:    expiresAt,
+		RefreshToken: refreshToken,
+		Username:     user.Username,
+		UserID:       user.ID,
+	}, nil
+}
+
+// revokeSession revokes a session's tokens and drops its WebSocket clients
+func (h *AuthHandler) revokeSession(sessionID string) error {
+	// Access tokens issued now expire within AccessTokenTTL, so the
+	// revocation entry only has to outlive that window
+	if err := h.tokenStore.RevokeSession(sessionID, time.Now().Add(h.config.AccessTokenTTL)); err != nil {
+		log.Printf("Error revoking session %s: %v", sessionID, err)
+		return err
+	}
+
+	h.hub.DisconnectSession(sessionID)
+	return nil
+}
+
+// UnlockAccount handles POST /api/admin/users/{username}/unlock - lifts a
+// lockout from failed logins and starts the account's failure count over
+func (h *AuthHandler) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+	if !h.config.IsAdmin(claims.UserID) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	username := mux.Vars(r)["username"]
+	if _, err := h.userStore.GetUser(username); err != nil {
+		if err == store.ErrUserNotFound {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.attemptStore.ClearLoginAttempts(userLoginKey(username)); err != nil {
+		http.Error(w, "Failed to unlock account", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Account %s unlocked by %s", username, claims.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JWKSHandler serves the public signing keys so other services can verify
+// chat tokens. Shared HS256 secrets are never included.
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(auth.JWKS())
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"chatapp/auth"
+	"chatapp/models"
+	"chatapp/store"
+)
+
+// decodeAuth decodes an AuthResponse, failing unless the status is want
+func decodeAuth(t *testing.T, rec *httptest.ResponseRecorder, want int) models.AuthResponse {
+	t.Helper()
+
+	if rec.Code != want {
+		t.Fatalf("status = %d (%s), want %d", rec.Code, rec.Body, want)
+	}
+	var response models.AuthResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return response
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	env := newTestEnv(t)
+	h := env.authHandler()
+
+	rec := httptest.NewRecorder()
+	h.Register(rec, postJSON(t, "/api/register", models.RegisterRequest{Username: "alice", Email: "alice@example.com", Password: "secret1"}))
+	registered := decodeAuth(t, rec, http.StatusCreated)
+	if _, err := auth.ValidateToken(registered.Token); err != nil {
+		t.Fatalf("registration token is invalid: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Register(rec, postJSON(t, "/api/register", models.RegisterRequest{Username: "alice", Email: "other@example.com", Password: "secret1"}))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("duplicate username: status = %d, want 409", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Login(rec, postJSON(t, "/api/login", models.LoginRequest{Username: "alice", Password: "wrong"}))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password: status = %d, want 401", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.Login(rec, postJSON(t, "/api/login", models.LoginRequest{Username: "alice", Password: "secret1"}))
+	loggedIn := decodeAuth(t, rec, http.StatusOK)
+	if loggedIn.UserID != registered.UserID || loggedIn.RefreshToken == "" {
+		t.Errorf("login response = %+v, want alice's tokens", loggedIn)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	env := newTestEnv(t)
+	h := env.authHandler()
+	env.createUser(t, "alice")
+
+	rec := httptest.NewRecorder()
+	h.Login(rec, postJSON(t, "/api/login", models.LoginRequest{Username: "alice", Password: "password"}))
+	login := decodeAuth(t, rec, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	h.Refresh(rec, postJSON(t, "/api/token/refresh", models.RefreshRequest{RefreshToken: login.RefreshToken}))
+	refreshed := decodeAuth(t, rec, http.StatusOK)
+
+	// Presenting the first refresh token again ends the whole session
+	rec = httptest.NewRecorder()
+	h.Refresh(rec, postJSON(t, "/api/token/refresh", models.RefreshRequest{RefreshToken: login.RefreshToken}))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: status = %d, want 401", rec.Code)
+	}
+
+	if _, err := auth.ValidateToken(refreshed.Token); err == nil {
+		t.Error("access token of the revoked session is still valid")
+	}
+	rec = httptest.NewRecorder()
+	h.Refresh(rec, postJSON(t, "/api/token/refresh", models.RefreshRequest{RefreshToken: refreshed.RefreshToken}))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("refresh token of the revoked session: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	h := env.authHandler()
+	alice := env.createUser(t, "alice")
+
+	for i := 0; i < env.cfg.LoginLockoutThreshold; i++ {
+		rec := httptest.NewRecorder()
+		h.Login(rec, postJSON(t, "/api/login", models.LoginRequest{Username: "alice", Password: "wrong"}))
+	}
+
+	// Locked out even with the right password
+	rec := httptest.NewRecorder()
+	h.Login(rec, postJSON(t, "/api/login", models.LoginRequest{Username: "alice", Password: "password"}))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("locked login: status = %d, Retry-After %q; want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	notifications, err := env.notifications.GetNotifications(alice.ID, true, 10)
+	if err != nil {
+		t.Fatalf("loading notifications: %v", err)
+	}
+	if len(notifications) != 1 || notifications[0].Type != models.AccountLockedNotification {
+		t.Errorf("notifications = %+v, want one account_locked", notifications)
+	}
+}
+
+// revokingTokenStore revokes the session right after a refresh token is
+// rotated, as a concurrent logout would
+type revokingTokenStore struct {
+	*store.MemoryTokenStore
+	sessionID string
+}
+
+func (s *revokingTokenStore) RevokeRefreshToken(id string) error {
+	if err := s.MemoryTokenStore.RevokeRefreshToken(id); err != nil {
+		return err
+	}
+	return s.RevokeSession(s.sessionID, time.Now().Add(time.Hour))
+}
+
+func TestRefreshRacingLogoutIssuesNoTokens(t *testing.T) {
+	env := newTestEnv(t)
+	env.createUser(t, "alice")
+
+	rec := httptest.NewRecorder()
+	env.authHandler().Login(rec, postJSON(t, "/api/login", models.LoginRequest{Username: "alice", Password: "password"}))
+	login := decodeAuth(t, rec, http.StatusOK)
+	claims, err := auth.ValidateToken(login.Token)
+	if err != nil {
+		t.Fatalf("validating access token: %v", err)
+	}
+
+	tokens := &revokingTokenStore{MemoryTokenStore: env.tokens, sessionID: claims.SessionID}
+	h := NewAuthHandler(env.cfg, env.users, tokens, env.attempts, env.notifications, env.hub, nil)
+
+	rec = httptest.NewRecorder()
+	h.Refresh(rec, postJSON(t, "/api/token/refresh", models.RefreshRequest{RefreshToken: login.RefreshToken}))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("refresh of a session revoked meanwhile: status = %d (%s), want 401", rec.Code, rec.Body)
+	}
+}
+
+func TestAccessTokenWithoutSessionIsRejected(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createUser(t, "alice")
+
+	// As issued before access tokens carried a session, so logout can't end it
+	signed, _, err := auth.GenerateToken(alice.ID, alice.Username, "")
+	if err != nil {
+		t.Fatalf("generating token: %v", err)
+	}
+	if _, err := auth.ValidateToken(signed); !errors.Is(err, auth.ErrNoSession) {
+		t.Errorf("validating token without a session: got %v, want ErrNoSession", err)
+	}
+
+	handler := RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request without a session reached the handler")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/rooms", nil)
+	req.Header.Set("Authorization", "Bearer "+signed)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rec.Code)
+	}
+}
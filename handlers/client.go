@@ -2,46 +2,69 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"chatapp/models"
+	"chatapp/ratelimit"
+	"chatapp/store"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer
-	maxMessageSize = 512
-)
-
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{ProtocolV1},
 	CheckOrigin: func(r *http.Request) bool {
 		// Allow connections from any origin
 		return true
 	},
 }
 
-// Client represents a websocket client
+// Client represents a websocket client. One connection can be subscribed to
+// many rooms.
 type Client struct {
 	hub      *Hub
 	conn     *websocket.Conn
-	send     chan []byte
 	username string
 	userID   string
-	roomID   uint
+
+	// Frames for writePump. Only close closes send, so other goroutines can
+	// queue replies while Run is closing the client.
+	sendMu     sync.Mutex
+	send       chan outbound
+	sendClosed bool
+
+	// Envelope version negotiated at upgrade, or legacyProtocol
+	protocol int
+
+	// Room from the upgrade request, used by frames that don't name a room
+	defaultRoomID uint
+
+	// Last message seen in the default room when reconnecting, or nil
+	resumeFrom *uint
+
+	// Rooms the client is subscribed to. Only Run changes them; readPump
+	// reads them to check where the client may post.
+	roomsMu sync.RWMutex
+	rooms   map[uint]bool
+
+	// Session of the access token used to connect, for revocation
+	sessionID string
+
+	// Frames the client may send (MESSAGE_RATE_LIMIT) and frames over that
+	// limit it gets away with before being disconnected. Only readPump uses
+	// them.
+	limiter *ratelimit.Bucket
+	strikes *ratelimit.Bucket
+
+	// Close frame payload sent once send is closed; empty by default
+	closeMessage []byte
 }
 
 // clientID returns a unique identifier for the client
@@ -49,22 +72,114 @@ func (c *Client) clientID() string {
 	return c.userID + "-" + c.username
 }
 
+// queue hands a frame to writePump without blocking. It reports false when
+// the client's buffer is full; frames for a closed client are dropped.
+func (c *Client) queue(frame outbound) bool {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.sendClosed {
+		return true
+	}
+	select {
+	case c.send <- frame:
+		return true
+	default:
+		return false
+	}
+}
+
+// available returns how many more frames fit in the client's buffer
+func (c *Client) available() int {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	return cap(c.send) - len(c.send)
+}
+
+// close makes writePump send closeMessage and stop. Later calls do nothing.
+func (c *Client) close(closeMessage []byte) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+
+	if c.sendClosed {
+		return
+	}
+	c.sendClosed = true
+	c.closeMessage = closeMessage
+	close(c.send)
+}
+
+// inRoom reports whether the client is subscribed to a room
+func (c *Client) inRoom(roomID uint) bool {
+	c.roomsMu.RLock()
+	defer c.roomsMu.RUnlock()
+
+	return c.rooms[roomID]
+}
+
+// roomIDs returns the rooms the client is subscribed to
+func (c *Client) roomIDs() []uint {
+	c.roomsMu.RLock()
+	defer c.roomsMu.RUnlock()
+
+	roomIDs := make([]uint, 0, len(c.rooms))
+	for roomID := range c.rooms {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs
+}
+
+// setRoom subscribes or unsubscribes the client. Only Run calls it.
+func (c *Client) setRoom(roomID uint, subscribed bool) {
+	c.roomsMu.Lock()
+	defer c.roomsMu.Unlock()
+
+	if subscribed {
+		c.rooms[roomID] = true
+	} else {
+		delete(c.rooms, roomID)
+	}
+}
+
+// frameRoom returns the room a request is for: its room_id, or the default
+// room when it doesn't name one. It fails when the client isn't subscribed
+// to that room.
+func (c *Client) frameRoom(payload models.RequestPayload) (uint, error) {
+	roomID := c.defaultRoomID
+	if payload.RoomID != nil {
+		roomID = *payload.RoomID
+	}
+
+	if !c.inRoom(roomID) {
+		return 0, fmt.Errorf("%w %d", errNotSubscribed, roomID)
+	}
+	return roomID, nil
+}
+
 // readPump pumps messages from the websocket connection to the hub
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.quit:
+		}
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	// Time allowed to read the next pong message from the peer
+	pongWait := c.hub.config.WebSocketReadTimeout
+
+	c.conn.SetReadLimit(c.hub.config.WebSocketMaxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
+	throttled := false
 	for {
-		_, messageBytes, err := c.conn.ReadMessage()
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Error: %v", err)
@@ -72,97 +187,260 @@ func (c *Client) readPump() {
 			break
 		}
 
-		var rawMessage map[string]interface{}
-		if err := json.Unmarshal(messageBytes, &rawMessage); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+		// Wait for writePump to send the close frame and close the connection
+		if throttled {
 			continue
 		}
 
-		// Check message type
-		msgType, ok := rawMessage["type"].(string)
-		if !ok {
-			msgType = "text"
+		// Every frame is taken from the rate limit before it is looked at,
+		// so malformed frames can't be sent unthrottled. It is still
+		// decoded for the ID the error reply names.
+		throttleErr := c.throttle()
+		req, err := c.decode(data)
+		if throttleErr != nil {
+			err = throttleErr
 		}
-
-		// Handle typing indicators
-		if msgType == "typing" {
-			isTyping := false
-			if isTypingVal, ok := rawMessage["is_typing"].(bool); ok {
-				isTyping = isTypingVal
-			}
-
-			indicator := &models.TypingIndicator{
-				Type:     models.TypingMessage,
-				UserID:   c.userID,
-				Username: c.username,
-				RoomID:   c.roomID,
-				IsTyping: isTyping,
-			}
-
-			select {
-			case c.hub.typingIndicator <- indicator:
-			default:
-				// Channel full, skip
-			}
+		if err == errRateLimitAbuse {
+			log.Printf("Client disconnected (rate limit exceeded): %s", c.username)
+			c.close(websocket.FormatCloseMessage(CloseRateLimited, "rate limit exceeded"))
+			throttled = true
 			continue
 		}
-
-		// Handle regular text messages
-		var message models.Message
-		if err := json.Unmarshal(messageBytes, &message); err != nil {
-			log.Printf("Error unmarshaling message: %v", err)
+		if err != nil {
+			c.respond(req, nil, err)
 			continue
 		}
+		if !c.handle(req) {
+			return
+		}
+	}
+}
+
+// throttle takes a frame from the client's rate limit. Frames over the
+// limit are refused with a retry-after; once the client has run out of
+// strikes it returns errRateLimitAbuse.
+func (c *Client) throttle() error {
+	now := time.Now()
+	allowed, retryAfter := c.limiter.Take(now)
+	if allowed {
+		return nil
+	}
+	if allowed, _ := c.strikes.Take(now); !allowed {
+		return errRateLimitAbuse
+	}
+	return &rateLimitError{retryAfter: retryAfter}
+}
+
+// handle carries out one request and replies to it. It returns false when
+// the hub is shutting down.
+func (c *Client) handle(req request) bool {
+	var result interface{}
+	var err error
+
+	switch req.op {
+	case models.SubscribeOp, models.UnsubscribeOp:
+		// Run replies once it has applied the subscription
+		return c.requestSubscription(req)
+
+	case models.TypingOp:
+		err = c.sendTyping(req.payload)
+
+	case models.EditOp:
+		// Only the author can edit their message
+		result, err = c.hub.EditMessage(c.userID, req.payload.ID, req.payload.Content)
 
-		// Set message properties from the client
-		message.UserID = c.userID
-		message.Username = c.username
-		message.RoomID = c.roomID
-		message.Type = models.TextMessage
-		message.Timestamp = time.Now()
+	case models.DeleteOp:
+		// Deletes are by the author or a moderator
+		err = c.hub.DeleteMessage(c.userID, req.payload.ID)
 
-		broadcastMsg := &BroadcastMessage{
-			Message: message,
-			RoomID:  c.roomID,
+	case models.PinOp, models.UnpinOp:
+		// Pins need the pin permission in the room
+		result, err = c.hub.PinMessage(c.userID, req.payload.ID, req.op == models.PinOp)
+
+	case models.ReactOp, models.UnreactOp:
+		err = c.hub.React(c.userID, req.payload.ID, req.payload.Emoji, req.op == models.ReactOp)
+
+	case models.SendOp:
+		result, err = c.sendText(req.payload)
+		if errors.Is(err, errHubClosed) {
+			return false
 		}
 
-		select {
-		case c.hub.broadcast <- broadcastMsg:
-		default:
-			close(c.send)
-			return
+	default:
+		err = errUnknownOp
+	}
+
+	c.respond(req, result, err)
+	return true
+}
+
+// requestSubscription hands a subscribe or unsubscribe request to Run. It
+// returns false when the hub is shutting down.
+func (c *Client) requestSubscription(req request) bool {
+	roomID := c.defaultRoomID
+	if req.payload.RoomID != nil {
+		roomID = *req.payload.RoomID
+	}
+
+	subscribe := req.op == models.SubscribeOp
+	if subscribe && !c.hub.canAccess(roomID, c.userID) {
+		c.respond(req, nil, store.ErrRoomNotFound)
+		return true
+	}
+
+	select {
+	case c.hub.subscriptions <- subscription{client: c, request: req, roomID: roomID, subscribe: subscribe, since: req.payload.Since}:
+		return true
+	case <-c.hub.quit:
+		return false
+	}
+}
+
+// sendTyping passes a typing indicator on to the room
+func (c *Client) sendTyping(payload models.RequestPayload) error {
+	roomID, err := c.frameRoom(payload)
+	if err != nil {
+		return err
+	}
+
+	indicator := &models.TypingIndicator{
+		Type:     models.TypingMessage,
+		UserID:   c.userID,
+		Username: c.username,
+		RoomID:   roomID,
+		IsTyping: payload.IsTyping,
+	}
+
+	select {
+	case c.hub.typingIndicator <- indicator:
+	default:
+		// Channel full, skip
+	}
+	return nil
+}
+
+// sendText saves a text message and broadcasts it to its room
+func (c *Client) sendText(payload models.RequestPayload) (*models.Message, error) {
+	roomID, err := c.frameRoom(payload)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.hub.validateContent(payload.Content); err != nil {
+		return nil, err
+	}
+	if err := c.hub.checkWritable(roomID); err != nil {
+		return nil, err
+	}
+
+	// Only the content and thread are taken from the client
+	message := models.Message{
+		Type:      models.TextMessage,
+		UserID:    c.userID,
+		Username:  c.username,
+		RoomID:    roomID,
+		Content:   payload.Content,
+		Timestamp: time.Now(),
+	}
+	if payload.ParentMessageID != nil {
+		parentID, err := c.hub.threadRoot(roomID, *payload.ParentMessageID)
+		if err != nil {
+			return nil, err
 		}
+		message.ParentMessageID = &parentID
+	}
+
+	// Persist before broadcasting so every client receives the message ID
+	// it needs to edit or reference the message. Shutdown waits for saves.
+	if !c.hub.trackSave() {
+		return nil, errHubClosed
+	}
+	err = c.hub.messageStore.Save(&message)
+	c.hub.saves.Done()
+	if err != nil {
+		return nil, err
+	}
+
+	broadcastMsg := &BroadcastMessage{
+		Message: message,
+		RoomID:  roomID,
+	}
+
+	select {
+	case c.hub.broadcast <- broadcastMsg:
+	case <-c.hub.quit:
+		return nil, errHubClosed
+	}
+
+	if message.ParentMessageID != nil {
+		c.hub.publishThreadUpdate(*message.ParentMessageID)
 	}
+	return &message, nil
+}
+
+// sendSystemMessage sends a system notice to this client only. Notices
+// aren't about one room, so they carry room_id 0.
+func (c *Client) sendSystemMessage(content string) {
+	messageBytes, err := json.Marshal(models.Message{
+		Type:      models.SystemMessage,
+		Content:   content,
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error marshaling system message: %v", err)
+		return
+	}
+
+	c.queue(outbound{data: messageBytes})
 }
 
 // writePump pumps messages from the hub to the websocket connection
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	// Time allowed to write a message to the peer
+	writeWait := c.hub.config.WebSocketWriteTimeout
+
+	ticker := time.NewTicker(c.hub.config.WebSocketPingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.writers.Done()
 	}()
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case frame, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				closeMessage := c.closeMessage
+				if closeMessage == nil {
+					closeMessage = []byte{}
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMessage)
 				return
 			}
 
+			// Versioned clients get exactly one envelope per websocket message
+			if c.protocol != legacyProtocol {
+				data := c.wrap(frame)
+				if data == nil {
+					continue
+				}
+				if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+					return
+				}
+				continue
+			}
+
 			w, err := c.conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
 			}
-			w.Write(message)
+			w.Write(frame.data)
 
 			// Add queued chat messages to the current websocket message
 			n := len(c.send)
 			for i := 0; i < n; i++ {
 				w.Write([]byte{'\n'})
-				w.Write(<-c.send)
+				w.Write((<-c.send).data)
 			}
 
 			if err := w.Close(); err != nil {
@@ -177,3 +455,18 @@ func (c *Client) writePump() {
 		}
 	}
 }
+
+// wrap returns what writePump sends a versioned client for a frame: replies
+// as they are and events inside an event envelope
+func (c *Client) wrap(frame outbound) []byte {
+	if frame.reply {
+		return frame.data
+	}
+
+	data, err := json.Marshal(models.Envelope{Version: c.protocol, Op: models.EventOp, Payload: frame.data})
+	if err != nil {
+		log.Printf("Error marshaling event: %v", err)
+		return nil
+	}
+	return data
+}
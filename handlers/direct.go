@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"chatapp/auth"
+	"chatapp/models"
+	"chatapp/store"
+)
+
+// DirectRoomHandler handles direct message conversations between two users
+type DirectRoomHandler struct {
+	roomStore store.RoomStore
+	userStore store.UserStore
+}
+
+// NewDirectRoomHandler creates a new direct message handler
+func NewDirectRoomHandler(roomStore store.RoomStore, userStore store.UserStore) *DirectRoomHandler {
+	return &DirectRoomHandler{
+		roomStore: roomStore,
+		userStore: userStore,
+	}
+}
+
+// ListDirectRooms handles GET /api/dms - lists the caller's direct message conversations
+func (h *DirectRoomHandler) ListDirectRooms(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	rooms, err := h.roomStore.GetUserRooms(claims.UserID, models.DirectRoom)
+	if err != nil {
+		http.Error(w, "Failed to retrieve conversations", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]models.DirectRoomResponse, 0, len(rooms))
+	for _, room := range rooms {
+		directRoom, err := h.directRoomResponse(&room, claims.UserID)
+		if err != nil {
+			log.Printf("Error loading participants of room %d: %v", room.ID, err)
+			continue
+		}
+		response = append(response, directRoom)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CreateDirectRoom handles POST /api/dms - opens the direct message
+// conversation with another user, or returns it if it already exists.
+// Connect to it like any room, with /ws?room_id={id}.
+func (h *DirectRoomHandler) CreateDirectRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	var req models.CreateDirectRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.UserID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == claims.UserID {
+		http.Error(w, "Cannot start a conversation with yourself", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.userStore.GetUserByID(req.UserID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	room, err := h.roomStore.CreateDirectRoom(claims.UserID, req.UserID)
+	if err != nil {
+		http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := h.directRoomResponse(room, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to create conversation", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// directRoomResponse describes a direct message room by its other participant
+func (h *DirectRoomHandler) directRoomResponse(room *models.Room, userID string) (models.DirectRoomResponse, error) {
+	response := models.DirectRoomResponse{ID: room.ID, CreatedAt: room.CreatedAt}
+
+	members, err := h.roomStore.GetRoomMembers(room.ID)
+	if err != nil {
+		return response, err
+	}
+
+	for _, member := range members {
+		if member.UserID == userID {
+			continue
+		}
+		user, err := h.userStore.GetUserByID(member.UserID)
+		if err != nil {
+			return response, err
+		}
+		response.Participant = models.UserSummary{UserID: user.ID, Username: user.Username}
+	}
+	return response, nil
+}
@@ -7,9 +7,16 @@ import (
 	"strings"
 
 	"chatapp/auth"
+	"chatapp/ratelimit"
 	"chatapp/store"
+
+	"github.com/gorilla/websocket"
 )
 
+// DefaultRoomID is the room a WebSocket connection joins when it names none.
+// main creates it on first start, and it can't be deleted.
+const DefaultRoomID uint = 1
+
 // HomeHandler serves the main chat page
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	// Serve the static HTML file. This keeps handlers lightweight and lets the
@@ -17,33 +24,61 @@ func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "static/index.html")
 }
 
-// WSHandler handles websocket requests from the peer
-func WSHandler(hub *Hub, roomStore *store.RoomStore) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get token from query parameter or Authorization header
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			authHeader := r.Header.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				token = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
+// tokenFromRequest returns the bearer token from the Authorization header or,
+// for WebSocket upgrades where browsers can't set headers, the token query parameter
+func tokenFromRequest(r *http.Request) string {
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
 
-		if token == "" {
-			http.Error(w, "Authentication token is required", http.StatusUnauthorized)
+// RequireAuth rejects requests without a valid access token with 401 and
+// hands the token's claims to next in the request context
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := authenticate(w, r)
+		if !ok {
 			return
 		}
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), claims)))
+	})
+}
 
-		// Validate token
-		claims, err := auth.ValidateToken(token)
-		if err != nil {
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+// authenticate validates the request's token, replying 401 when it is missing or invalid
+func authenticate(w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
+	token := tokenFromRequest(r)
+	if token == "" {
+		http.Error(w, "Authentication token is required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	claims, err := auth.ValidateToken(token)
+	if err != nil {
+		http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// WSHandler handles websocket requests from the peer. It is served behind
+// RequireAuth, which accepts the token as a query parameter for upgrades.
+func WSHandler(hub *Hub, roomStore store.RoomStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Refuse new connections while the server is shutting down
+		if hub.closing() {
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
 			return
 		}
 
-		// Get room_id from query parameter (default to 1)
+		claims := auth.FromContext(r.Context())
+
+		// The connection starts out subscribed to room_id (default
+		// DefaultRoomID); more rooms are added with subscribe frames
 		roomIDStr := r.URL.Query().Get("room_id")
-		roomID := uint(1)
+		roomID := DefaultRoomID
 		if roomIDStr != "" {
 			parsed, err := strconv.ParseUint(roomIDStr, 10, 32)
 			if err != nil {
@@ -53,13 +88,32 @@ func WSHandler(hub *Hub, roomStore *store.RoomStore) http.HandlerFunc {
 			roomID = uint(parsed)
 		}
 
-		// Validate room exists
-		_, err = roomStore.GetRoom(roomID)
-		if err != nil {
+		// A reconnecting client passes the last message it saw in the room
+		// with since and is only sent the messages it missed
+		var resumeFrom *uint
+		if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+			parsed, err := strconv.ParseUint(sinceStr, 10, 32)
+			if err != nil {
+				http.Error(w, "Invalid since", http.StatusBadRequest)
+				return
+			}
+			since := uint(parsed)
+			resumeFrom = &since
+		}
+
+		// Validate room exists and the user may join it
+		room, err := roomStore.GetRoom(roomID)
+		if err != nil || !canAccessRoom(roomStore, room, claims.UserID) {
 			http.Error(w, "Room not found", http.StatusNotFound)
 			return
 		}
 
+		// Clients that ask for subprotocols must be offered one we speak
+		if offered := websocket.Subprotocols(r); len(offered) > 0 && !supportsProtocol(offered) {
+			http.Error(w, "Unsupported protocol, supported: "+ProtocolV1, http.StatusBadRequest)
+			return
+		}
+
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println(err)
@@ -67,15 +121,36 @@ func WSHandler(hub *Hub, roomStore *store.RoomStore) http.HandlerFunc {
 		}
 
 		client := &Client{
-			hub:      hub,
-			conn:     conn,
-			send:     make(chan []byte, 256),
-			username: claims.Username,
-			userID:   claims.UserID,
-			roomID:   roomID,
+			hub:           hub,
+			conn:          conn,
+			send:          make(chan outbound, 256),
+			protocol:      subprotocols[conn.Subprotocol()],
+			username:      claims.Username,
+			userID:        claims.UserID,
+			sessionID:     claims.SessionID,
+			defaultRoomID: roomID,
+			resumeFrom:    resumeFrom,
+			rooms:         make(map[uint]bool),
+			limiter:       ratelimit.NewBucket(hub.config.MessageRateLimit.Limit, hub.config.MessageRateLimit.Per),
+			strikes:       ratelimit.NewBucket(hub.config.MessageRateLimitStrikes, hub.config.MessageRateLimit.Per),
 		}
 
-		client.hub.register <- client
+		// Count the write pump before registering so Shutdown can't miss it
+		if !hub.trackWriter() {
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+			conn.Close()
+			return
+		}
+		select {
+		case client.hub.register <- client:
+		case <-client.hub.quit:
+			hub.writers.Done()
+			conn.WriteMessage(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+			conn.Close()
+			return
+		}
 
 		// Allow collection of memory referenced by the caller by doing all work in new goroutines
 		go client.writePump()
@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"chatapp/auth"
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/store"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// testEnv is a hub and handlers wired to in-memory stores
+type testEnv struct {
+	cfg           *config.Config
+	users         *store.MemoryUserStore
+	rooms         *store.MemoryRoomStore
+	messages      *store.MemoryMessageStore
+	tokens        *store.MemoryTokenStore
+	attempts      *store.MemoryLoginAttemptStore
+	notifications *store.MemoryNotificationStore
+	hub           *Hub
+	general       *models.Room
+}
+
+// testConfig returns the default configuration with a usable JWT secret
+func testConfig() *config.Config {
+	cfg := config.Default()
+	cfg.JWTSecret = "test-secret-long-enough-for-hs256-signing"
+	return cfg
+}
+
+// newTestEnv starts a hub on fresh in-memory stores with the default room.
+// configure may adjust the configuration first.
+func newTestEnv(t *testing.T, configure ...func(*config.Config)) *testEnv {
+	t.Helper()
+
+	cfg := testConfig()
+	for _, fn := range configure {
+		fn(cfg)
+	}
+	if err := auth.Configure(cfg); err != nil {
+		t.Fatalf("configuring auth: %v", err)
+	}
+
+	env := &testEnv{
+		cfg:           cfg,
+		users:         store.NewMemoryUserStore(),
+		rooms:         store.NewMemoryRoomStore(),
+		messages:      store.NewMemoryMessageStore(),
+		tokens:        store.NewMemoryTokenStore(),
+		attempts:      store.NewMemoryLoginAttemptStore(),
+		notifications: store.NewMemoryNotificationStore(),
+	}
+	auth.SetRevocationList(env.tokens)
+	t.Cleanup(func() { auth.SetRevocationList(nil) })
+
+	general, err := env.rooms.CreateRoom("General", models.PublicRoom, "")
+	if err != nil {
+		t.Fatalf("creating default room: %v", err)
+	}
+	env.general = general
+
+	env.hub = NewHub(cfg, env.rooms, env.messages)
+	go env.hub.Run()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := env.hub.Shutdown(ctx); err != nil {
+			t.Errorf("shutting down hub: %v", err)
+		}
+	})
+
+	return env
+}
+
+// authHandler returns an AuthHandler on the environment's stores
+func (e *testEnv) authHandler() *AuthHandler {
+	return NewAuthHandler(e.cfg, e.users, e.tokens, e.attempts, e.notifications, e.hub, nil)
+}
+
+// createUser adds a user with the password "password"
+func (e *testEnv) createUser(t *testing.T, username string) *models.User {
+	t.Helper()
+
+	hash, err := auth.HashPassword("password")
+	if err != nil {
+		t.Fatalf("hashing password: %v", err)
+	}
+	user, err := e.users.CreateUser(username, username+"@example.com", hash)
+	if err != nil {
+		t.Fatalf("creating user %s: %v", username, err)
+	}
+	return user
+}
+
+// saveMessage stores a text message by user in a room
+func (e *testEnv) saveMessage(t *testing.T, user *models.User, roomID uint, content string) *models.Message {
+	t.Helper()
+
+	message := &models.Message{
+		Type:      models.TextMessage,
+		UserID:    user.ID,
+		Username:  user.Username,
+		RoomID:    roomID,
+		Content:   content,
+		Timestamp: time.Now(),
+	}
+	if err := e.messages.Save(message); err != nil {
+		t.Fatalf("saving message: %v", err)
+	}
+	return message
+}
+
+// token returns an access token for user in a new session
+func token(t *testing.T, user *models.User) string {
+	t.Helper()
+
+	signed, _, err := auth.GenerateToken(user.ID, user.Username, uuid.New().String())
+	if err != nil {
+		t.Fatalf("generating token: %v", err)
+	}
+	return signed
+}
+
+// withClaims returns a request carrying the claims RequireAuth would set
+func withClaims(r *http.Request, user *models.User) *http.Request {
+	claims := &auth.Claims{UserID: user.ID, Username: user.Username}
+	return r.WithContext(auth.NewContext(r.Context(), claims))
+}
+
+// postJSON builds a POST request with body encoded as JSON
+func postJSON(t *testing.T, target string, body interface{}) *http.Request {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("encoding request: %v", err)
+	}
+	return httptest.NewRequest(http.MethodPost, target, bytes.NewReader(data))
+}
+
+// wsServer serves WSHandler behind RequireAuth, as main does
+func (e *testEnv) wsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(RequireAuth(WSHandler(e.hub, e.rooms)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// dial connects a chat.v1 client to server with user's token
+func dial(t *testing.T, server *httptest.Server, user *models.User) *websocket.Conn {
+	t.Helper()
+
+	return dialQuery(t, server, user, "")
+}
+
+// dialQuery connects like dial, adding query to the URL, e.g. "&since=12"
+func dialQuery(t *testing.T, server *httptest.Server, user *models.User, query string) *websocket.Conn {
+	t.Helper()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/?token=" + token(t, user) + query
+	dialer := websocket.Dialer{Subprotocols: []string{ProtocolV1}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dialing WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// sendRequest writes a chat.v1 request envelope
+func sendRequest(t *testing.T, conn *websocket.Conn, op models.Op, id string, payload models.RequestPayload) {
+	t.Helper()
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("encoding payload: %v", err)
+	}
+	envelope := models.Envelope{Version: models.ProtocolVersion, Op: op, ID: id, Payload: data}
+	if err := conn.WriteJSON(envelope); err != nil {
+		t.Fatalf("writing request: %v", err)
+	}
+}
+
+// readUntil reads envelopes until match accepts one, and returns it
+func readUntil(t *testing.T, conn *websocket.Conn, match func(models.Envelope) bool) models.Envelope {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var envelope models.Envelope
+		if err := conn.ReadJSON(&envelope); err != nil {
+			t.Fatalf("reading from WebSocket: %v", err)
+		}
+		if match(envelope) {
+			return envelope
+		}
+	}
+}
+
+// reply matches the ack or error for the request with the given ID
+func reply(id string) func(models.Envelope) bool {
+	return func(envelope models.Envelope) bool {
+		return envelope.ID == id && (envelope.Op == models.AckOp || envelope.Op == models.ErrorOp)
+	}
+}
+
+// event matches events of the given message type
+func event(eventType models.MessageType) func(models.Envelope) bool {
+	return func(envelope models.Envelope) bool {
+		if envelope.Op != models.EventOp {
+			return false
+		}
+		var message models.Message
+		return json.Unmarshal(envelope.Payload, &message) == nil && message.Type == eventType
+	}
+}
@@ -1,29 +1,40 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"chatapp/config"
 	"chatapp/models"
 	"chatapp/store"
-)
 
-const (
-	// how many recent messages to send to a newly connected client
-	recentMessagesToSend = 50
+	"github.com/gorilla/websocket"
 )
 
 // Hub maintains the set of active clients and broadcasts messages to the clients
 type Hub struct {
+	// Server configuration (timeouts, limits, history size)
+	config *config.Config
+
 	// Registered clients (keyed by client pointer)
 	clients map[*Client]bool
 
+	// Subscribed clients per room, for routing broadcasts. Only Run uses it.
+	rooms map[uint]map[*Client]bool
+
 	// Rooms store for managing room subscriptions
-	roomStore *store.RoomStore
+	roomStore store.RoomStore
 
 	// Message store for persistence
-	messageStore *store.MessageStore
+	messageStore store.MessageStore
 
 	// Inbound messages from the clients
 	broadcast chan *BroadcastMessage
@@ -36,6 +47,76 @@ type Hub struct {
 
 	// Typing indicator channel
 	typingIndicator chan *models.TypingIndicator
+
+	// Revoked sessions whose clients must be disconnected
+	revokedSessions chan string
+
+	// Clients subscribing to or unsubscribing from rooms
+	subscriptions chan subscription
+
+	// Users whose clients must leave a room they are no longer a member of
+	removals chan roomRemoval
+
+	// Notifications for the clients of one user
+	notifications chan *models.Notification
+
+	// Closed by Shutdown to stop Run and refuse new clients. quitMu orders
+	// closing quit against writers.Add so no write pump starts after Shutdown.
+	quit   chan struct{}
+	quitMu sync.Mutex
+
+	// Closed when Run has disconnected every client and returned
+	stopped chan struct{}
+
+	// In-flight message saves and client write pumps
+	saves   sync.WaitGroup
+	writers sync.WaitGroup
+}
+
+var (
+	ErrEmptyMessage     = errors.New("message content is required")
+	ErrMessageTooLong   = errors.New("message exceeds the maximum length")
+	ErrNotMessageAuthor = errors.New("only the author can change this message")
+	ErrCannotDelete     = errors.New("only the author or a moderator can delete this message")
+	ErrPermissionDenied = errors.New("your role in this room doesn't allow that")
+	ErrRoomArchived     = errors.New("this room is archived and read-only")
+	ErrInvalidEmoji     = errors.New("reaction must be a single emoji")
+	ErrInvalidParent    = errors.New("replies must be to a message in the same room")
+)
+
+// maxEmojiLength bounds a reaction in runes; long enough for ZWJ sequences
+// such as family emoji, short enough to stop reactions being used as text
+const maxEmojiLength = 16
+
+// WebSocket close codes for clients that must not reconnect
+const (
+	// CloseRemovedFromRoom is sent to clients of a room the user left or was
+	// removed from
+	CloseRemovedFromRoom = 4003
+	// CloseRoomDeleted is sent to every client of a room that was deleted
+	CloseRoomDeleted = 4004
+	// CloseRateLimited is sent to clients that kept sending frames faster
+	// than MESSAGE_RATE_LIMIT allows
+	CloseRateLimited = 4029
+)
+
+// roomRemoval identifies the clients to unsubscribe from one room: one
+// user's, or everyone's when userID is empty. Clients left without rooms are
+// closed with code and reason.
+type roomRemoval struct {
+	roomID uint
+	userID string
+	code   int
+	reason string
+}
+
+// subscription asks Run to subscribe a client to a room or unsubscribe it
+type subscription struct {
+	client    *Client
+	request   request
+	roomID    uint
+	subscribe bool
+	since     *uint
 }
 
 // BroadcastMessage wraps a message with room information
@@ -45,15 +126,417 @@ type BroadcastMessage struct {
 }
 
 // NewHub creates a new Hub instance
-func NewHub(roomStore *store.RoomStore, messageStore *store.MessageStore) *Hub {
+func NewHub(cfg *config.Config, roomStore store.RoomStore, messageStore store.MessageStore) *Hub {
 	return &Hub{
+		config:          cfg,
 		broadcast:       make(chan *BroadcastMessage),
 		register:        make(chan *Client),
 		unregister:      make(chan *Client),
 		typingIndicator: make(chan *models.TypingIndicator),
+		revokedSessions: make(chan string),
+		subscriptions:   make(chan subscription),
+		removals:        make(chan roomRemoval),
+		notifications:   make(chan *models.Notification),
 		clients:         make(map[*Client]bool),
+		rooms:           make(map[uint]map[*Client]bool),
 		roomStore:       roomStore,
 		messageStore:    messageStore,
+		quit:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}
+}
+
+// Shutdown stops the hub: new clients are refused, every connected client is
+// sent a "server restarting" close frame, and pending message saves are
+// flushed. It returns once all of that is done or ctx expires.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.quitMu.Lock()
+	if !h.closing() {
+		close(h.quit)
+	}
+	h.quitMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		<-h.stopped
+		h.writers.Wait()
+		h.saves.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackWriter counts a new client write pump, unless the hub is shutting down
+func (h *Hub) trackWriter() bool {
+	return h.track(&h.writers)
+}
+
+// trackSave counts a message save in flight, unless the hub is shutting down
+func (h *Hub) trackSave() bool {
+	return h.track(&h.saves)
+}
+
+func (h *Hub) track(wg *sync.WaitGroup) bool {
+	h.quitMu.Lock()
+	defer h.quitMu.Unlock()
+
+	if h.closing() {
+		return false
+	}
+	wg.Add(1)
+	return true
+}
+
+// publish hands a message to Run for broadcasting; safe from any goroutine
+func (h *Hub) publish(broadcastMsg *BroadcastMessage) {
+	select {
+	case h.broadcast <- broadcastMsg:
+	case <-h.quit:
+	}
+}
+
+// validateContent checks user supplied message content against the limits
+func (h *Hub) validateContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return ErrEmptyMessage
+	}
+	if utf8.RuneCountInString(content) > h.config.MaxMessageLength {
+		return fmt.Errorf("%w of %d characters", ErrMessageTooLong, h.config.MaxMessageLength)
+	}
+	return nil
+}
+
+// EditMessage replaces the content of a message on behalf of its author and
+// broadcasts a message_edited event to the message's room
+func (h *Hub) EditMessage(userID string, messageID uint, content string) (*models.Message, error) {
+	if err := h.validateContent(content); err != nil {
+		return nil, err
+	}
+
+	message, err := h.messageStore.GetByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+	// Authors who lost access to the room, e.g. by leaving a private room,
+	// can't edit there any more
+	if !h.canAccess(message.RoomID, userID) {
+		return nil, store.ErrMessageNotFound
+	}
+	if message.UserID != userID {
+		return nil, ErrNotMessageAuthor
+	}
+	if err := h.checkWritable(message.RoomID); err != nil {
+		return nil, err
+	}
+
+	edited, err := h.messageStore.Edit(messageID, content)
+	if err != nil {
+		return nil, err
+	}
+
+	event := *edited
+	event.Type = models.MessageEditedEvent
+	h.publish(&BroadcastMessage{Message: event, RoomID: edited.RoomID})
+
+	return edited, nil
+}
+
+// DeleteMessage soft-deletes a message on behalf of its author or a
+// moderator and broadcasts a message_deleted tombstone to the message's room
+func (h *Hub) DeleteMessage(userID string, messageID uint) error {
+	message, err := h.messageStore.GetByID(messageID)
+	if err != nil {
+		return err
+	}
+	// Authors who lost access to the room can't delete there any more, and
+	// outsiders can't tell its messages exist. Moderators and server admins
+	// keep their say.
+	moderator := h.can(userID, message.RoomID, models.DeleteAnyMessagePermission)
+	if !moderator && !h.canAccess(message.RoomID, userID) {
+		return store.ErrMessageNotFound
+	}
+	if message.UserID != userID && !moderator {
+		return ErrCannotDelete
+	}
+	if err := h.checkWritable(message.RoomID); err != nil {
+		return err
+	}
+
+	if _, err := h.messageStore.Delete(messageID); err != nil {
+		return err
+	}
+
+	h.publish(&BroadcastMessage{Message: tombstone(message), RoomID: message.RoomID})
+
+	if message.ParentMessageID != nil {
+		h.publishThreadUpdate(*message.ParentMessageID)
+	}
+
+	return nil
+}
+
+// React adds or removes a user's emoji reaction to a message and broadcasts
+// the message's updated reaction counts to its room
+func (h *Hub) React(userID string, messageID uint, emoji string, add bool) error {
+	if err := validateEmoji(emoji); err != nil {
+		return err
+	}
+
+	message, err := h.messageStore.GetByID(messageID)
+	if err != nil {
+		return err
+	}
+	if !h.canAccess(message.RoomID, userID) {
+		return store.ErrMessageNotFound
+	}
+	if err := h.checkWritable(message.RoomID); err != nil {
+		return err
+	}
+
+	if add {
+		err = h.messageStore.AddReaction(messageID, userID, emoji)
+	} else {
+		err = h.messageStore.RemoveReaction(messageID, userID, emoji)
+	}
+	if err != nil {
+		return err
+	}
+
+	reactions, err := h.messageStore.GetReactions(messageID)
+	if err != nil {
+		return err
+	}
+	h.publish(&BroadcastMessage{Message: reactionsEvent(message, reactions), RoomID: message.RoomID})
+
+	return nil
+}
+
+// tombstone returns the message_deleted event for a message, which
+// identifies it but carries none of its content
+func tombstone(message *models.Message) models.Message {
+	return models.Message{
+		ID:              message.ID,
+		Type:            models.MessageDeletedEvent,
+		UserID:          message.UserID,
+		Username:        message.Username,
+		RoomID:          message.RoomID,
+		Timestamp:       time.Now(),
+		ParentMessageID: message.ParentMessageID,
+	}
+}
+
+// reactionsEvent returns the message_reactions event carrying a message's
+// reaction counts
+func reactionsEvent(message *models.Message, reactions []models.ReactionCount) models.Message {
+	if reactions == nil {
+		reactions = []models.ReactionCount{}
+	}
+	return models.Message{
+		ID:        message.ID,
+		Type:      models.ReactionsEvent,
+		RoomID:    message.RoomID,
+		Timestamp: time.Now(),
+		Reactions: reactions,
+	}
+}
+
+// changeEvents returns the events that bring a copy of a message up to date
+// with its current state: its tombstone when deleted, otherwise its edit,
+// reactions, pin and thread summary. Each is safe to apply twice.
+func changeEvents(message models.Message) []models.Message {
+	if message.DeletedAt.Valid {
+		return []models.Message{tombstone(&message)}
+	}
+
+	var events []models.Message
+	if message.EditedAt != nil {
+		edited := message
+		edited.Type = models.MessageEditedEvent
+		events = append(events, edited)
+	}
+	events = append(events, reactionsEvent(&message, message.Reactions))
+
+	pin := message
+	pin.Type = models.MessageUnpinnedEvent
+	if message.PinnedAt != nil {
+		pin.Type = models.MessagePinnedEvent
+	}
+	events = append(events, pin)
+
+	if message.ParentMessageID == nil && message.LastReplyAt != nil {
+		thread := message
+		thread.Type = models.ThreadUpdatedEvent
+		events = append(events, thread)
+	}
+	return events
+}
+
+// threadRoot returns the message a reply to parentID belongs under. Threads
+// are one level deep, so replying to a reply joins the original thread.
+func (h *Hub) threadRoot(roomID, parentID uint) (uint, error) {
+	parent, err := h.messageStore.GetByID(parentID)
+	if err != nil {
+		return 0, err
+	}
+	if parent.RoomID != roomID {
+		return 0, ErrInvalidParent
+	}
+	if parent.ParentMessageID != nil {
+		return *parent.ParentMessageID, nil
+	}
+	return parent.ID, nil
+}
+
+// publishThreadUpdate broadcasts a thread_updated event carrying the parent
+// message's current reply count and last reply time
+func (h *Hub) publishThreadUpdate(parentID uint) {
+	parent, err := h.messageStore.GetByID(parentID)
+	if err != nil {
+		log.Printf("Error loading thread parent %d: %v", parentID, err)
+		return
+	}
+
+	event := *parent
+	event.Type = models.ThreadUpdatedEvent
+	h.publish(&BroadcastMessage{Message: event, RoomID: parent.RoomID})
+}
+
+// PinMessage pins or unpins a message in its room and broadcasts the change.
+// It requires the pin permission in the room.
+func (h *Hub) PinMessage(userID string, messageID uint, pin bool) (*models.Message, error) {
+	message, err := h.messageStore.GetByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if !h.canAccess(message.RoomID, userID) && !h.config.IsAdmin(userID) {
+		return nil, store.ErrMessageNotFound
+	}
+	if !h.can(userID, message.RoomID, models.PinMessagePermission) {
+		return nil, ErrPermissionDenied
+	}
+	if err := h.checkWritable(message.RoomID); err != nil {
+		return nil, err
+	}
+
+	eventType := models.MessagePinnedEvent
+	if pin {
+		message, err = h.messageStore.Pin(messageID, userID)
+	} else {
+		eventType = models.MessageUnpinnedEvent
+		message, err = h.messageStore.Unpin(messageID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	event := *message
+	event.Type = eventType
+	h.publish(&BroadcastMessage{Message: event, RoomID: message.RoomID})
+
+	return message, nil
+}
+
+// validateEmoji rejects empty, overlong and textual reactions
+func validateEmoji(emoji string) error {
+	if emoji == "" || utf8.RuneCountInString(emoji) > maxEmojiLength {
+		return ErrInvalidEmoji
+	}
+	// ASCII digits, '#' and '*' only appear as part of keycaps, so at least
+	// one rune must be a non-ASCII symbol or the keycap's enclosing mark
+	hasSymbol := false
+	for _, r := range emoji {
+		if r < 0x80 && r != '#' && r != '*' && (r < '0' || r > '9') {
+			return ErrInvalidEmoji
+		}
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) {
+			return ErrInvalidEmoji
+		}
+		if r >= 0x80 && (unicode.IsSymbol(r) || unicode.Is(unicode.Me, r)) {
+			hasSymbol = true
+		}
+	}
+	if !hasSymbol {
+		return ErrInvalidEmoji
+	}
+	return nil
+}
+
+// checkWritable returns ErrRoomArchived when a room is archived
+func (h *Hub) checkWritable(roomID uint) error {
+	room, err := h.roomStore.GetRoom(roomID)
+	if err != nil {
+		return err
+	}
+	if room.Archived {
+		return ErrRoomArchived
+	}
+	return nil
+}
+
+// PublishRoomUpdate tells a room's clients about its new details
+func (h *Hub) PublishRoomUpdate(room *models.Room) {
+	details := newRoomResponse(room)
+	event := models.Message{
+		Type:      models.RoomUpdatedEvent,
+		RoomID:    room.ID,
+		Timestamp: time.Now(),
+		Room:      &details,
+	}
+	h.publish(&BroadcastMessage{Message: event, RoomID: room.ID})
+}
+
+// canAccess reports whether a user may see the messages of a room
+func (h *Hub) canAccess(roomID uint, userID string) bool {
+	room, err := h.roomStore.GetRoom(roomID)
+	if err != nil {
+		return false
+	}
+	return canAccessRoom(h.roomStore, room, userID)
+}
+
+// can reports whether a user's role in a room grants a permission. Server
+// admins hold every permission in every room.
+func (h *Hub) can(userID string, roomID uint, permission models.RoomPermission) bool {
+	if h.config.IsAdmin(userID) {
+		return true
+	}
+	return h.roomRole(roomID, userID).Can(permission)
+}
+
+// outranks reports whether a user may act against another member of a room,
+// which takes a strictly higher role. Server admins outrank everyone.
+func (h *Hub) outranks(userID string, roomID uint, targetID string) bool {
+	if h.config.IsAdmin(userID) {
+		return true
+	}
+	return h.roomRole(roomID, userID).Outranks(h.roomRole(roomID, targetID))
+}
+
+// roomRole returns a user's role in a room, or "" when they aren't a member
+func (h *Hub) roomRole(roomID uint, userID string) models.RoomRole {
+	role, err := h.roomStore.GetRoomRole(roomID, userID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotRoomMember) {
+			log.Printf("Error loading role in room %d: %v", roomID, err)
+		}
+		return ""
+	}
+	return role
+}
+
+// closing reports whether Shutdown has been called
+func (h *Hub) closing() bool {
+	select {
+	case <-h.quit:
+		return true
+	default:
+		return false
 	}
 }
 
@@ -63,61 +546,259 @@ func (h *Hub) Run() {
 		select {
 		case client := <-h.register:
 			h.clients[client] = true
-			h.roomStore.AddClientToRoom(client.roomID, client.clientID())
-			log.Printf("Client connected: %s to room %d", client.username, client.roomID)
-
-			// Send recent messages to newly connected client
-			h.sendRecentMessages(client)
-
-			// Broadcast user join message
-			joinMessage := models.Message{
-				Type:      models.UserJoinMessage,
-				UserID:    client.userID,
-				Username:  client.username,
-				RoomID:    client.roomID,
-				Content:   client.username + " joined the chat",
-				Timestamp: time.Now(),
-			}
-			h.broadcastToRoom(&BroadcastMessage{Message: joinMessage, RoomID: client.roomID})
+			log.Printf("Client connected: %s", client.username)
+			h.subscribe(client, client.defaultRoomID, client.resumeFrom)
 
 		case client := <-h.unregister:
 			if _, ok := h.clients[client]; ok {
+				client.close(nil)
+				h.unsubscribeAll(client, true)
 				delete(h.clients, client)
-				h.roomStore.RemoveClientFromRoom(client.roomID, client.clientID())
-				close(client.send)
-				log.Printf("Client disconnected: %s from room %d", client.username, client.roomID)
-
-				// Broadcast user left message
-				leftMessage := models.Message{
-					Type:      models.UserLeftMessage,
-					UserID:    client.userID,
-					Username:  client.username,
-					RoomID:    client.roomID,
-					Content:   client.username + " left the chat",
-					Timestamp: time.Now(),
-				}
-				h.broadcastToRoom(&BroadcastMessage{Message: leftMessage, RoomID: client.roomID})
+				log.Printf("Client disconnected: %s", client.username)
 			}
 
-		case broadcastMsg := <-h.broadcast:
-			// Save text messages to database asynchronously
-			if broadcastMsg.Message.Type == models.TextMessage {
-				go func(msg models.Message) {
-					if err := h.messageStore.Save(&msg); err != nil {
-						log.Printf("Error saving message to database: %v", err)
-					}
-				}(broadcastMsg.Message)
-			}
+		case sub := <-h.subscriptions:
+			h.handleSubscription(sub)
 
+		case broadcastMsg := <-h.broadcast:
+			// Messages arrive here already persisted by the sender
 			h.broadcastToRoom(broadcastMsg)
 
 		case typingIndicator := <-h.typingIndicator:
 			h.broadcastTypingIndicator(typingIndicator)
+
+		case sessionID := <-h.revokedSessions:
+			h.disconnectSession(sessionID)
+
+		case removal := <-h.removals:
+			h.removeFromRoom(removal)
+
+		case notification := <-h.notifications:
+			h.notifyUser(notification)
+
+		case <-h.quit:
+			h.disconnectAll()
+			close(h.stopped)
+			return
 		}
 	}
 }
 
-// broadcastToRoom sends a message to all clients in a specific room
+// handleSubscription applies a subscribe or unsubscribe request from a
+// client and replies to it
+func (h *Hub) handleSubscription(sub subscription) {
+	client := sub.client
+	if !h.clients[client] {
+		return
+	}
+
+	var err error
+	switch {
+	case sub.subscribe && client.inRoom(sub.roomID):
+		err = fmt.Errorf("%w %d", errAlreadySubscribed, sub.roomID)
+	case sub.subscribe:
+		h.subscribe(client, sub.roomID, sub.since)
+	case !client.inRoom(sub.roomID):
+		err = fmt.Errorf("%w %d", errNotSubscribed, sub.roomID)
+	default:
+		h.unsubscribe(client, sub.roomID, "", true)
+	}
+	client.respond(sub.request, nil, err)
+}
+
+// subscribe adds a client to a room: it receives the room's history and a
+// subscribed event, and the room is told the user joined. A client resuming
+// after since only gets the messages it missed.
+func (h *Hub) subscribe(client *Client, roomID uint, since *uint) {
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[*Client]bool)
+	}
+	h.rooms[roomID][client] = true
+	client.setRoom(roomID, true)
+	h.roomStore.AddClientToRoom(roomID, client.clientID())
+	log.Printf("Client subscribed: %s to room %d", client.username, roomID)
+
+	if since != nil {
+		h.sendMissedMessages(client, roomID, *since)
+	} else {
+		h.sendRecentMessages(client, roomID)
+	}
+	h.sendTo(client, models.Message{Type: models.SubscribedEvent, RoomID: roomID, Timestamp: time.Now()})
+
+	joinMessage := models.Message{
+		Type:      models.UserJoinMessage,
+		UserID:    client.userID,
+		Username:  client.username,
+		RoomID:    roomID,
+		Content:   client.username + " joined the chat",
+		Timestamp: time.Now(),
+	}
+	h.broadcastToRoom(&BroadcastMessage{Message: joinMessage, RoomID: roomID})
+}
+
+// unsubscribe removes a client from a room and tells the room the user
+// left. When notify is set the client first receives an unsubscribed event
+// carrying reason.
+func (h *Hub) unsubscribe(client *Client, roomID uint, reason string, notify bool) {
+	if notify {
+		h.sendTo(client, models.Message{Type: models.UnsubscribedEvent, RoomID: roomID, Content: reason, Timestamp: time.Now()})
+	}
+
+	delete(h.rooms[roomID], client)
+	if len(h.rooms[roomID]) == 0 {
+		delete(h.rooms, roomID)
+	}
+	client.setRoom(roomID, false)
+	h.roomStore.RemoveClientFromRoom(roomID, client.clientID())
+
+	leftMessage := models.Message{
+		Type:      models.UserLeftMessage,
+		UserID:    client.userID,
+		Username:  client.username,
+		RoomID:    roomID,
+		Content:   client.username + " left the chat",
+		Timestamp: time.Now(),
+	}
+	h.broadcastToRoom(&BroadcastMessage{Message: leftMessage, RoomID: roomID})
+}
+
+// unsubscribeAll removes a client from every room it is in. With announce
+// set each room is told the user left.
+func (h *Hub) unsubscribeAll(client *Client, announce bool) {
+	for _, roomID := range client.roomIDs() {
+		if announce {
+			h.unsubscribe(client, roomID, "", false)
+			continue
+		}
+		delete(h.rooms[roomID], client)
+		if len(h.rooms[roomID]) == 0 {
+			delete(h.rooms, roomID)
+		}
+		client.setRoom(roomID, false)
+		h.roomStore.RemoveClientFromRoom(roomID, client.clientID())
+	}
+}
+
+// sendTo queues a message for one client, skipping it if the client's buffer is full
+func (h *Hub) sendTo(client *Client, message models.Message) {
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling message: %v", err)
+		return
+	}
+
+	client.queue(outbound{data: messageBytes})
+}
+
+// DisconnectSession closes every client connected with a token from the
+// given session. It is safe to call from any goroutine.
+func (h *Hub) DisconnectSession(sessionID string) {
+	if sessionID == "" {
+		return
+	}
+
+	select {
+	case h.revokedSessions <- sessionID:
+	case <-h.quit:
+	}
+}
+
+// disconnectSession closes a revoked session's clients with a policy violation close frame
+func (h *Hub) disconnectSession(sessionID string) {
+	closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "token revoked")
+	for client := range h.clients {
+		if client.sessionID == sessionID {
+			h.disconnect(client, closeMessage)
+			log.Printf("Client disconnected (token revoked): %s", client.username)
+		}
+	}
+}
+
+// Notify sends a notification to its user's connected clients. It is safe
+// to call from any goroutine.
+func (h *Hub) Notify(notification *models.Notification) {
+	select {
+	case h.notifications <- notification:
+	case <-h.quit:
+	}
+}
+
+// notifyUser sends a notification event to every client of its user.
+// Notifications aren't about one room, so they carry room_id 0.
+func (h *Hub) notifyUser(notification *models.Notification) {
+	messageBytes, err := json.Marshal(models.Message{
+		Type:         models.NotificationEvent,
+		Content:      notification.Content,
+		Timestamp:    notification.CreatedAt,
+		Notification: notification,
+	})
+	if err != nil {
+		log.Printf("Error marshaling notification: %v", err)
+		return
+	}
+
+	for client := range h.clients {
+		if client.userID == notification.UserID {
+			client.queue(outbound{data: messageBytes})
+		}
+	}
+}
+
+// RemoveFromRoom unsubscribes a user's clients from a room after they left
+// or were removed from it. It is safe to call from any goroutine.
+func (h *Hub) RemoveFromRoom(roomID uint, userID string) {
+	h.remove(roomRemoval{roomID: roomID, userID: userID, code: CloseRemovedFromRoom, reason: "removed from room"})
+}
+
+// CloseRoom unsubscribes every client from a deleted room
+func (h *Hub) CloseRoom(roomID uint) {
+	h.remove(roomRemoval{roomID: roomID, code: CloseRoomDeleted, reason: "room deleted"})
+}
+
+// remove hands a removal to Run. It is safe to call from any goroutine.
+func (h *Hub) remove(removal roomRemoval) {
+	select {
+	case h.removals <- removal:
+	case <-h.quit:
+	}
+}
+
+// removeFromRoom unsubscribes the clients selected by a removal. Clients that
+// aren't subscribed to any other room are closed with the removal's close code.
+func (h *Hub) removeFromRoom(removal roomRemoval) {
+	for client := range h.rooms[removal.roomID] {
+		if removal.userID != "" && client.userID != removal.userID {
+			continue
+		}
+
+		h.unsubscribe(client, removal.roomID, removal.reason, true)
+		log.Printf("Client unsubscribed (%s): %s from room %d", removal.reason, client.username, removal.roomID)
+
+		if len(client.roomIDs()) == 0 {
+			h.disconnect(client, websocket.FormatCloseMessage(removal.code, removal.reason))
+		}
+	}
+}
+
+// disconnect closes a client with the given close frame and tells its rooms it left
+func (h *Hub) disconnect(client *Client, closeMessage []byte) {
+	client.close(closeMessage)
+	delete(h.clients, client)
+	h.unsubscribeAll(client, true)
+}
+
+// disconnectAll closes every client with a "server restarting" close frame
+func (h *Hub) disconnectAll() {
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting")
+	for client := range h.clients {
+		client.close(closeMessage)
+		delete(h.clients, client)
+		h.unsubscribeAll(client, false)
+	}
+	log.Println("Hub stopped, all clients disconnected")
+}
+
+// broadcastToRoom sends a message to all clients subscribed to a room
 func (h *Hub) broadcastToRoom(broadcastMsg *BroadcastMessage) {
 	messageBytes, err := json.Marshal(broadcastMsg.Message)
 	if err != nil {
@@ -125,15 +806,12 @@ func (h *Hub) broadcastToRoom(broadcastMsg *BroadcastMessage) {
 		return
 	}
 
-	for client := range h.clients {
-		if client.roomID == broadcastMsg.RoomID {
-			select {
-			case client.send <- messageBytes:
-			default:
-				close(client.send)
-				delete(h.clients, client)
-				h.roomStore.RemoveClientFromRoom(client.roomID, client.clientID())
-			}
+	for client := range h.rooms[broadcastMsg.RoomID] {
+		if !client.queue(outbound{data: messageBytes}) {
+			// Drop clients that can't keep up
+			client.close(nil)
+			delete(h.clients, client)
+			h.unsubscribeAll(client, false)
 		}
 	}
 }
@@ -146,21 +824,22 @@ func (h *Hub) broadcastTypingIndicator(indicator *models.TypingIndicator) {
 		return
 	}
 
-	for client := range h.clients {
+	for client := range h.rooms[indicator.RoomID] {
 		// Don't send typing indicator to the user who is typing
-		if client.roomID == indicator.RoomID && client.userID != indicator.UserID {
-			select {
-			case client.send <- indicatorBytes:
-			default:
-				// Client buffer full, skip
-			}
+		if client.userID != indicator.UserID {
+			client.queue(outbound{data: indicatorBytes})
 		}
 	}
 }
 
-// sendRecentMessages sends the last 50 messages to a newly connected client
-func (h *Hub) sendRecentMessages(client *Client) {
-	messages, err := h.messageStore.GetByRoom(client.roomID, recentMessagesToSend)
+// sendRecentMessages sends a room's last RecentMessagesCount messages to a
+// client that just subscribed to it
+func (h *Hub) sendRecentMessages(client *Client, roomID uint) {
+	if h.config.RecentMessagesCount == 0 {
+		return
+	}
+
+	messages, err := h.messageStore.GetByRoom(roomID, store.MessageQuery{Limit: h.config.RecentMessagesCount})
 	if err != nil {
 		log.Printf("Error retrieving recent messages: %v", err)
 		return
@@ -173,10 +852,58 @@ func (h *Hub) sendRecentMessages(client *Client) {
 			continue
 		}
 
-		select {
-		case client.send <- messageBytes:
-		default:
+		if !client.queue(outbound{data: messageBytes}) {
 			return
 		}
 	}
 }
+
+// sendMissedMessages replays what a resuming client missed after since:
+// first the current state of the earlier messages that changed after since
+// was sent (edits, deletions, reactions, pins and thread summaries), then
+// the new messages, thread replies included. When more than
+// ResumeMaxMessages messages changed or are new, or their events don't fit
+// in the client's buffer, it sends a history_gap event instead and the
+// client refetches the room's history over REST.
+func (h *Hub) sendMissedMessages(client *Client, roomID, since uint) {
+	limit := h.config.ResumeMaxMessages
+	var changed, messages []models.Message
+	var err error
+	if since > 0 {
+		changed, err = h.messageStore.GetChangedSince(roomID, since, limit+1)
+	}
+	if err == nil {
+		messages, err = h.messageStore.GetByRoom(roomID, store.MessageQuery{AfterID: since, Limit: limit + 1, WithReplies: true})
+	}
+	if err != nil && !errors.Is(err, store.ErrMessageNotFound) {
+		log.Printf("Error retrieving missed messages: %v", err)
+	}
+
+	var events []models.Message
+	for _, message := range changed {
+		events = append(events, changeEvents(message)...)
+	}
+	events = append(events, messages...)
+
+	// Keep room for the subscribed event and join message that follow
+	if err != nil || len(changed)+len(messages) > limit || len(events)+2 > client.available() {
+		h.sendTo(client, models.Message{
+			ID:        since,
+			Type:      models.HistoryGapEvent,
+			RoomID:    roomID,
+			Content:   "too many missed messages, fetch the history over REST",
+			Timestamp: time.Now(),
+		})
+		log.Printf("Client %s missed too many messages in room %d to replay", client.username, roomID)
+		return
+	}
+
+	for _, event := range events {
+		eventBytes, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error marshaling missed message: %v", err)
+			continue
+		}
+		client.queue(outbound{data: eventBytes})
+	}
+}
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/store"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEditMessageOnlyByAuthor(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createUser(t, "alice")
+	bob := env.createUser(t, "bob")
+	message := env.saveMessage(t, alice, env.general.ID, "hello")
+
+	if _, err := env.hub.EditMessage(bob.ID, message.ID, "hijacked"); !errors.Is(err, ErrNotMessageAuthor) {
+		t.Fatalf("edit by another user: got %v, want ErrNotMessageAuthor", err)
+	}
+
+	edited, err := env.hub.EditMessage(alice.ID, message.ID, "hello again")
+	if err != nil {
+		t.Fatalf("edit by author: %v", err)
+	}
+	if edited.Content != "hello again" || edited.EditedAt == nil {
+		t.Errorf("edited message = %q (edited at %v), want new content and an edit time", edited.Content, edited.EditedAt)
+	}
+}
+
+func TestEditMessageRejectsArchivedRoom(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createUser(t, "alice")
+	message := env.saveMessage(t, alice, env.general.ID, "hello")
+
+	env.general.Archived = true
+	if err := env.rooms.UpdateRoom(env.general); err != nil {
+		t.Fatalf("archiving room: %v", err)
+	}
+
+	if _, err := env.hub.EditMessage(alice.ID, message.ID, "too late"); !errors.Is(err, ErrRoomArchived) {
+		t.Fatalf("edit in archived room: got %v, want ErrRoomArchived", err)
+	}
+}
+
+func TestEditMessageRequiresRoomAccess(t *testing.T) {
+	env := newTestEnv(t)
+	owner := env.createUser(t, "owner")
+	alice := env.createUser(t, "alice")
+	mallory := env.createUser(t, "mallory")
+	secret, err := env.rooms.CreateRoom("Secret", models.PrivateRoom, owner.ID)
+	if err != nil {
+		t.Fatalf("creating private room: %v", err)
+	}
+	if err := env.rooms.AddRoomMember(secret.ID, alice.ID); err != nil {
+		t.Fatalf("adding member: %v", err)
+	}
+	message := env.saveMessage(t, alice, secret.ID, "for members only")
+
+	if _, err := env.hub.EditMessage(mallory.ID, message.ID, "hello"); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Fatalf("edit by non-member: got %v, want ErrMessageNotFound", err)
+	}
+
+	if err := env.rooms.RemoveRoomMember(secret.ID, alice.ID); err != nil {
+		t.Fatalf("removing member: %v", err)
+	}
+	if _, err := env.hub.EditMessage(alice.ID, message.ID, "still here?"); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Fatalf("edit by author who left: got %v, want ErrMessageNotFound", err)
+	}
+}
+
+func TestReactHidesPrivateRooms(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createUser(t, "alice")
+	mallory := env.createUser(t, "mallory")
+	secret, err := env.rooms.CreateRoom("Secret", models.PrivateRoom, alice.ID)
+	if err != nil {
+		t.Fatalf("creating private room: %v", err)
+	}
+	message := env.saveMessage(t, alice, secret.ID, "for members only")
+
+	if err := env.hub.React(mallory.ID, message.ID, "👍", true); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Fatalf("reaction by non-member: got %v, want ErrMessageNotFound", err)
+	}
+	if err := env.hub.React(alice.ID, message.ID, "👍", true); err != nil {
+		t.Fatalf("reaction by member: %v", err)
+	}
+
+	reactions, err := env.messages.GetReactions(message.ID)
+	if err != nil {
+		t.Fatalf("loading reactions: %v", err)
+	}
+	if len(reactions) != 1 || reactions[0].Count != 1 {
+		t.Errorf("reactions = %+v, want a single 👍", reactions)
+	}
+}
+
+func TestDeleteMessageByModerator(t *testing.T) {
+	env := newTestEnv(t)
+	owner := env.createUser(t, "owner")
+	member := env.createUser(t, "member")
+	room, err := env.rooms.CreateRoom("Team", models.PublicRoom, owner.ID)
+	if err != nil {
+		t.Fatalf("creating room: %v", err)
+	}
+	if err := env.rooms.AddRoomMember(room.ID, member.ID); err != nil {
+		t.Fatalf("adding member: %v", err)
+	}
+	ownMessage := env.saveMessage(t, owner, room.ID, "from the owner")
+	memberMessage := env.saveMessage(t, member, room.ID, "from a member")
+
+	if err := env.hub.DeleteMessage(member.ID, ownMessage.ID); !errors.Is(err, ErrCannotDelete) {
+		t.Fatalf("member deleting the owner's message: got %v, want ErrCannotDelete", err)
+	}
+	if err := env.hub.DeleteMessage(owner.ID, memberMessage.ID); err != nil {
+		t.Fatalf("owner deleting a member's message: %v", err)
+	}
+}
+
+func TestDeleteMessageRequiresRoomAccess(t *testing.T) {
+	env := newTestEnv(t)
+	owner := env.createUser(t, "owner")
+	alice := env.createUser(t, "alice")
+	mallory := env.createUser(t, "mallory")
+	secret, err := env.rooms.CreateRoom("Secret", models.PrivateRoom, owner.ID)
+	if err != nil {
+		t.Fatalf("creating private room: %v", err)
+	}
+	if err := env.rooms.AddRoomMember(secret.ID, alice.ID); err != nil {
+		t.Fatalf("adding member: %v", err)
+	}
+	first := env.saveMessage(t, alice, secret.ID, "first")
+	second := env.saveMessage(t, alice, secret.ID, "second")
+
+	if err := env.hub.DeleteMessage(mallory.ID, first.ID); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Fatalf("delete by non-member: got %v, want ErrMessageNotFound", err)
+	}
+
+	if err := env.rooms.RemoveRoomMember(secret.ID, alice.ID); err != nil {
+		t.Fatalf("removing member: %v", err)
+	}
+	if err := env.hub.DeleteMessage(alice.ID, first.ID); !errors.Is(err, store.ErrMessageNotFound) {
+		t.Fatalf("delete by author who left: got %v, want ErrMessageNotFound", err)
+	}
+
+	// The room's owner still moderates what was left behind
+	if err := env.hub.DeleteMessage(owner.ID, second.ID); err != nil {
+		t.Fatalf("owner deleting a former member's message: %v", err)
+	}
+}
+
+func TestAdminsAreIdentifiedByUserID(t *testing.T) {
+	env := newTestEnv(t)
+	author := env.createUser(t, "author")
+	admin := env.createUser(t, "root")
+	impostor := env.createUser(t, "admin")
+	env.cfg.AdminUserIDs = []string{admin.ID}
+	first := env.saveMessage(t, author, env.general.ID, "first")
+	second := env.saveMessage(t, author, env.general.ID, "second")
+
+	if err := env.hub.DeleteMessage(impostor.ID, first.ID); !errors.Is(err, ErrCannotDelete) {
+		t.Fatalf("user named admin deleting a message: got %v, want ErrCannotDelete", err)
+	}
+	if err := env.hub.DeleteMessage(admin.ID, second.ID); err != nil {
+		t.Fatalf("admin deleting a message: %v", err)
+	}
+}
+
+func TestWebSocketMessageIsBroadcastToRoom(t *testing.T) {
+	env := newTestEnv(t)
+	server := env.wsServer(t)
+	alice := env.createUser(t, "alice")
+	bob := env.createUser(t, "bob")
+
+	aliceConn := dial(t, server, alice)
+	readUntil(t, aliceConn, event(models.SubscribedEvent))
+	bobConn := dial(t, server, bob)
+	readUntil(t, bobConn, event(models.SubscribedEvent))
+
+	sendRequest(t, aliceConn, models.SendOp, "1", models.RequestPayload{Content: "hi bob"})
+	ack := readUntil(t, aliceConn, reply("1"))
+	if ack.Op != models.AckOp {
+		t.Fatalf("send reply = %s %s, want ack", ack.Op, ack.Payload)
+	}
+
+	received := readUntil(t, bobConn, event(models.TextMessage))
+	var message models.Message
+	if err := json.Unmarshal(received.Payload, &message); err != nil {
+		t.Fatalf("decoding message: %v", err)
+	}
+	if message.Content != "hi bob" || message.Username != "alice" || message.ID == 0 {
+		t.Errorf("bob received %+v, want alice's saved message", message)
+	}
+}
+
+func TestWebSocketAcceptsLongestMessage(t *testing.T) {
+	env := newTestEnv(t)
+	server := env.wsServer(t)
+	alice := env.createUser(t, "alice")
+
+	conn := dial(t, server, alice)
+	readUntil(t, conn, event(models.SubscribedEvent))
+
+	// Four bytes per character is the most UTF-8 needs
+	content := strings.Repeat("😀", env.cfg.MaxMessageLength)
+	sendRequest(t, conn, models.SendOp, "long", models.RequestPayload{Content: content})
+	if ack := readUntil(t, conn, reply("long")); ack.Op != models.AckOp {
+		t.Fatalf("send reply = %s %s, want ack", ack.Op, ack.Payload)
+	}
+}
+
+// readReplay returns the events a client is sent before its subscribed event
+func readReplay(t *testing.T, conn *websocket.Conn) []models.Message {
+	t.Helper()
+
+	var replay []models.Message
+	for {
+		envelope := readUntil(t, conn, func(envelope models.Envelope) bool { return envelope.Op == models.EventOp })
+		var message models.Message
+		if err := json.Unmarshal(envelope.Payload, &message); err != nil {
+			t.Fatalf("decoding event: %v", err)
+		}
+		if message.Type == models.SubscribedEvent {
+			return replay
+		}
+		replay = append(replay, message)
+	}
+}
+
+func TestResumeReplaysChangesToSeenMessages(t *testing.T) {
+	env := newTestEnv(t)
+	server := env.wsServer(t)
+	alice := env.createUser(t, "alice")
+
+	// Edited before the client last saw the room, so it knows already
+	old := env.saveMessage(t, alice, env.general.ID, "old")
+	if _, err := env.hub.EditMessage(alice.ID, old.ID, "old, edited"); err != nil {
+		t.Fatalf("editing message: %v", err)
+	}
+	edited := env.saveMessage(t, alice, env.general.ID, "to edit")
+	deleted := env.saveMessage(t, alice, env.general.ID, "to delete")
+	lastSeen := env.saveMessage(t, alice, env.general.ID, "last seen")
+
+	// While the client is away
+	if _, err := env.hub.EditMessage(alice.ID, edited.ID, "edited"); err != nil {
+		t.Fatalf("editing message: %v", err)
+	}
+	if err := env.hub.DeleteMessage(alice.ID, deleted.ID); err != nil {
+		t.Fatalf("deleting message: %v", err)
+	}
+	if err := env.hub.React(alice.ID, lastSeen.ID, "👍", true); err != nil {
+		t.Fatalf("reacting: %v", err)
+	}
+	missed := env.saveMessage(t, alice, env.general.ID, "missed")
+
+	conn := dialQuery(t, server, alice, fmt.Sprintf("&since=%d", lastSeen.ID))
+	replay := readReplay(t, conn)
+
+	seen := make(map[string]models.Message)
+	for _, message := range replay {
+		if message.ID == old.ID {
+			t.Errorf("replayed %s for a message that changed before the client left", message.Type)
+		}
+		seen[fmt.Sprintf("%s %d", message.Type, message.ID)] = message
+	}
+	if message, ok := seen[fmt.Sprintf("%s %d", models.MessageEditedEvent, edited.ID)]; !ok || message.Content != "edited" {
+		t.Errorf("edit not replayed: %+v", replay)
+	}
+	if message, ok := seen[fmt.Sprintf("%s %d", models.MessageDeletedEvent, deleted.ID)]; !ok || message.Content != "" {
+		t.Errorf("deletion not replayed as a tombstone: %+v", replay)
+	}
+	if message, ok := seen[fmt.Sprintf("%s %d", models.ReactionsEvent, lastSeen.ID)]; !ok || len(message.Reactions) != 1 {
+		t.Errorf("reaction not replayed: %+v", replay)
+	}
+	if _, ok := seen[fmt.Sprintf("%s %d", models.TextMessage, missed.ID)]; !ok {
+		t.Errorf("new message not replayed: %+v", replay)
+	}
+}
+
+func TestResumeSendsGapWhenTooMuchChanged(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) { cfg.ResumeMaxMessages = 2 })
+	server := env.wsServer(t)
+	alice := env.createUser(t, "alice")
+
+	var messages []*models.Message
+	for _, content := range []string{"one", "two", "three"} {
+		messages = append(messages, env.saveMessage(t, alice, env.general.ID, content))
+	}
+	lastSeen := messages[len(messages)-1]
+	for _, message := range messages {
+		if err := env.hub.React(alice.ID, message.ID, "👍", true); err != nil {
+			t.Fatalf("reacting: %v", err)
+		}
+	}
+
+	conn := dialQuery(t, server, alice, fmt.Sprintf("&since=%d", lastSeen.ID))
+	replay := readReplay(t, conn)
+	if len(replay) != 1 || replay[0].Type != models.HistoryGapEvent || replay[0].ID != lastSeen.ID {
+		t.Errorf("replay = %+v, want only a history_gap from %d", replay, lastSeen.ID)
+	}
+}
+
+func TestWebSocketRejectsInvalidRequest(t *testing.T) {
+	env := newTestEnv(t)
+	server := env.wsServer(t)
+	alice := env.createUser(t, "alice")
+
+	conn := dial(t, server, alice)
+	readUntil(t, conn, event(models.SubscribedEvent))
+
+	sendRequest(t, conn, models.SendOp, "empty", models.RequestPayload{Content: "   "})
+	errorReply := readUntil(t, conn, reply("empty"))
+
+	var payload models.ErrorPayload
+	if err := json.Unmarshal(errorReply.Payload, &payload); err != nil {
+		t.Fatalf("decoding error: %v", err)
+	}
+	if errorReply.Op != models.ErrorOp || payload.Code != models.InvalidError {
+		t.Errorf("reply = %s %+v, want an invalid error", errorReply.Op, payload)
+	}
+}
+
+func TestValidateEmoji(t *testing.T) {
+	valid := []string{"👍", "❤️", "1️⃣", "#️⃣", "🇳🇱", "👩‍👩‍👧", "👍🏽", "©️"}
+	for _, emoji := range valid {
+		if err := validateEmoji(emoji); err != nil {
+			t.Errorf("validateEmoji(%q) = %v, want nil", emoji, err)
+		}
+	}
+
+	invalid := []string{"", "123", "#", "*#1", "a", "ok", "👍 ", "١٢٣", "‍", "️", strings.Repeat("👍", maxEmojiLength+1)}
+	for _, emoji := range invalid {
+		if err := validateEmoji(emoji); !errors.Is(err, ErrInvalidEmoji) {
+			t.Errorf("validateEmoji(%q) = %v, want ErrInvalidEmoji", emoji, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatapp/models"
+	"chatapp/store"
+)
+
+// userLoginKey and ipLoginKey name the login attempt records of a username
+// and a client IP
+func userLoginKey(username string) string { return "user:" + username }
+func ipLoginKey(ip string) string         { return "ip:" + ip }
+
+// lockoutFor returns how long a key is locked after its latest failed login.
+// The first threshold-1 failures are free; the threshold-th locks for
+// LOGIN_LOCKOUT_DURATION and every further failure doubles the lockout, up
+// to LOGIN_LOCKOUT_MAX. A zero threshold never locks.
+func (h *AuthHandler) lockoutFor(failures, threshold int) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+
+	lockout := h.config.LoginLockoutDuration
+	for i := threshold; i < failures && lockout < h.config.LoginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > h.config.LoginLockoutMax {
+		lockout = h.config.LoginLockoutMax
+	}
+	return lockout
+}
+
+// loginLocked replies 429 with a Retry-After header when any of the keys is
+// locked out. Passwords aren't checked while locked, so guessing gains
+// nothing.
+func (h *AuthHandler) loginLocked(w http.ResponseWriter, keys ...string) bool {
+	now := time.Now()
+	lockedUntil := now
+	for _, key := range keys {
+		attempt, err := h.attemptStore.GetLoginAttempt(key)
+		if err != nil {
+			if err != store.ErrLoginAttemptNotFound {
+				log.Printf("Error loading failed logins for %s: %v", key, err)
+			}
+			continue
+		}
+		if attempt.LockedUntil != nil && attempt.LockedUntil.After(lockedUntil) {
+			lockedUntil = *attempt.LockedUntil
+		}
+	}
+
+	if !lockedUntil.After(now) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(lockedUntil.Sub(now))))
+	http.Error(w, "Too many failed login attempts, please try again later", http.StatusTooManyRequests)
+	return true
+}
+
+// loginFailed counts a failed login against the username and the client IP
+// and locks them once they pass their thresholds. The owner of the account,
+// if there is one, is notified when a run of failures first locks it.
+func (h *AuthHandler) loginFailed(user *models.User, username, ip string) {
+	failures, lockout := h.countFailure(userLoginKey(username), h.config.LoginLockoutThreshold)
+	if user != nil && lockout > 0 && failures == h.config.LoginLockoutThreshold {
+		h.notifyLockout(user, failures, lockout)
+	}
+
+	h.countFailure(ipLoginKey(ip), h.config.LoginIPLockoutThreshold)
+}
+
+// countFailure records a failed login for key and locks the key when the
+// failure count calls for it. It returns the count and the lockout applied.
+func (h *AuthHandler) countFailure(key string, threshold int) (int, time.Duration) {
+	since := time.Now().Add(-h.config.LoginFailureWindow)
+	attempt, err := h.attemptStore.RecordLoginFailure(key, since)
+	if err != nil {
+		log.Printf("Error recording failed login for %s: %v", key, err)
+		return 0, 0
+	}
+
+	lockout := h.lockoutFor(attempt.Failures, threshold)
+	if lockout == 0 {
+		return attempt.Failures, 0
+	}
+
+	if err := h.attemptStore.LockLogin(key, time.Now().Add(lockout)); err != nil {
+		log.Printf("Error locking logins for %s: %v", key, err)
+		return attempt.Failures, 0
+	}
+	log.Printf("Logins for %s locked for %s after %d failed attempts", key, lockout, attempt.Failures)
+	return attempt.Failures, lockout
+}
+
+// notifyLockout tells a user in-app that failed logins locked their account
+func (h *AuthHandler) notifyLockout(user *models.User, failures int, lockout time.Duration) {
+	notification := &models.Notification{
+		UserID: user.ID,
+		Type:   models.AccountLockedNotification,
+		Content: fmt.Sprintf("Your account was locked for %s after %d failed login attempts. "+
+			"If this wasn't you, change your password.", lockout, failures),
+	}
+	if err := h.notificationStore.CreateNotification(notification); err != nil {
+		log.Printf("Error saving lockout notification for %s: %v", user.Username, err)
+		return
+	}
+
+	h.hub.Notify(notification)
+}
@@ -0,0 +1,521 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"chatapp/auth"
+	"chatapp/models"
+	"chatapp/store"
+
+	"github.com/gorilla/mux"
+)
+
+// MembershipHandler handles room membership: joining, leaving, roles, kicks,
+// bans and invitations
+type MembershipHandler struct {
+	hub       *Hub
+	roomStore store.RoomStore
+	userStore store.UserStore
+}
+
+// NewMembershipHandler creates a new membership handler
+func NewMembershipHandler(hub *Hub, roomStore store.RoomStore, userStore store.UserStore) *MembershipHandler {
+	return &MembershipHandler{
+		hub:       hub,
+		roomStore: roomStore,
+		userStore: userStore,
+	}
+}
+
+// ListMembers handles GET /api/rooms/{id}/members - lists a room's members
+func (h *MembershipHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+
+	members, err := h.roomStore.GetRoomMembers(room.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve members", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]models.MemberResponse, 0, len(members))
+	for _, member := range members {
+		member, err := h.memberResponse(member)
+		if err != nil {
+			continue
+		}
+		response = append(response, member)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// JoinRoom handles POST /api/rooms/{id}/join - joins a public room. Private
+// rooms can only be joined by accepting an invitation.
+func (h *MembershipHandler) JoinRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if room.Visibility != models.PublicRoom {
+		http.Error(w, "This room is invite-only", http.StatusForbidden)
+		return
+	}
+
+	if err := h.roomStore.AddRoomMember(room.ID, claims.UserID); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newRoomResponse(room))
+}
+
+// LeaveRoom handles POST /api/rooms/{id}/leave - gives up membership of a
+// room and closes the caller's connections to it
+func (h *MembershipHandler) LeaveRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if room.Type == models.DirectRoom {
+		http.Error(w, "Direct message conversations can't be left", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.roomStore.RemoveRoomMember(room.ID, claims.UserID); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+	h.hub.RemoveFromRoom(room.ID, claims.UserID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// KickMember handles DELETE /api/rooms/{id}/members/{userID} - removes
+// another user from a room. Kicking needs the kick permission and a higher
+// role than the member being removed.
+func (h *MembershipHandler) KickMember(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if room.Type == models.DirectRoom {
+		http.Error(w, "Nobody can be removed from a direct message conversation", http.StatusBadRequest)
+		return
+	}
+	if !h.hub.can(claims.UserID, room.ID, models.KickMemberPermission) {
+		http.Error(w, "Only moderators can remove members", http.StatusForbidden)
+		return
+	}
+
+	userID := mux.Vars(r)["userID"]
+	if userID == claims.UserID {
+		http.Error(w, "Use leave to remove yourself", http.StatusBadRequest)
+		return
+	}
+	if !h.hub.outranks(claims.UserID, room.ID, userID) {
+		http.Error(w, "You can only remove members with a lower role than yours", http.StatusForbidden)
+		return
+	}
+
+	if err := h.roomStore.RemoveRoomMember(room.ID, userID); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+	h.hub.RemoveFromRoom(room.ID, userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetMemberRole handles PUT /api/rooms/{id}/members/{userID}/role - makes a
+// member a moderator or demotes them again. Only owners manage roles.
+func (h *MembershipHandler) SetMemberRole(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if room.Type == models.DirectRoom {
+		http.Error(w, "Direct message conversations don't have roles", http.StatusBadRequest)
+		return
+	}
+	if !h.hub.can(claims.UserID, room.ID, models.ManageRolesPermission) {
+		http.Error(w, "Only the room owner can change roles", http.StatusForbidden)
+		return
+	}
+
+	var req models.SetRoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Role != models.ModeratorRole && req.Role != models.MemberRole {
+		http.Error(w, "Role must be moderator or member", http.StatusBadRequest)
+		return
+	}
+
+	// The owner's own role can't be changed, so every owned room keeps its owner
+	userID := mux.Vars(r)["userID"]
+	role, err := h.roomStore.GetRoomRole(room.ID, userID)
+	if err == nil && role == models.OwnerRole {
+		http.Error(w, "The owner's role can't be changed", http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = h.roomStore.SetRoomRole(room.ID, userID, req.Role)
+	}
+	if err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	members, err := h.roomStore.GetRoomMembers(room.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve members", http.StatusInternalServerError)
+		return
+	}
+	for _, member := range members {
+		if member.UserID != userID {
+			continue
+		}
+		response, err := h.memberResponse(member)
+		if err != nil {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	writeMembershipError(w, store.ErrNotRoomMember)
+}
+
+// BanMember handles POST /api/rooms/{id}/bans - removes a user from a room
+// and keeps them from joining, being invited or connecting again. Banning
+// needs the ban permission and a higher role than the user being banned.
+func (h *MembershipHandler) BanMember(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if room.Type == models.DirectRoom {
+		http.Error(w, "Nobody can be banned from a direct message conversation", http.StatusBadRequest)
+		return
+	}
+	if !h.hub.can(claims.UserID, room.ID, models.BanMemberPermission) {
+		http.Error(w, "Only moderators can ban users", http.StatusForbidden)
+		return
+	}
+
+	var req models.BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == claims.UserID {
+		http.Error(w, "You can't ban yourself", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.userStore.GetUserByID(req.UserID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if !h.hub.outranks(claims.UserID, room.ID, req.UserID) {
+		http.Error(w, "You can only ban users with a lower role than yours", http.StatusForbidden)
+		return
+	}
+
+	if err := h.roomStore.BanUser(room.ID, req.UserID, claims.UserID, req.Reason); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+	h.hub.RemoveFromRoom(room.ID, req.UserID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnbanMember handles DELETE /api/rooms/{id}/bans/{userID} - lifts a ban
+func (h *MembershipHandler) UnbanMember(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if !h.hub.can(claims.UserID, room.ID, models.BanMemberPermission) {
+		http.Error(w, "Only moderators can lift bans", http.StatusForbidden)
+		return
+	}
+
+	if err := h.roomStore.UnbanUser(room.ID, mux.Vars(r)["userID"]); err != nil {
+		writeMembershipError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListBans handles GET /api/rooms/{id}/bans - lists the users banned from a room
+func (h *MembershipHandler) ListBans(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if !h.hub.can(claims.UserID, room.ID, models.BanMemberPermission) {
+		http.Error(w, "Only moderators can see bans", http.StatusForbidden)
+		return
+	}
+
+	bans, err := h.roomStore.GetBans(room.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve bans", http.StatusInternalServerError)
+		return
+	}
+	if bans == nil {
+		bans = []models.RoomBan{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
+
+// InviteMember handles POST /api/rooms/{id}/invitations - invites a user to
+// a room. Any member of the room can invite.
+func (h *MembershipHandler) InviteMember(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if room.Type == models.DirectRoom {
+		http.Error(w, "Nobody can be invited to a direct message conversation", http.StatusBadRequest)
+		return
+	}
+
+	var req models.InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == "" {
+		http.Error(w, "user_id is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := h.userStore.GetUserByID(req.UserID); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	banned, err := h.roomStore.IsBanned(room.ID, req.UserID)
+	if err != nil {
+		http.Error(w, "Failed to invite user", http.StatusInternalServerError)
+		return
+	}
+	if banned {
+		http.Error(w, "User is banned from this room", http.StatusForbidden)
+		return
+	}
+
+	member, err := h.roomStore.IsRoomMember(room.ID, req.UserID)
+	if err != nil {
+		http.Error(w, "Failed to invite user", http.StatusInternalServerError)
+		return
+	}
+	if member {
+		writeMembershipError(w, store.ErrAlreadyRoomMember)
+		return
+	}
+
+	invitation, err := h.roomStore.CreateInvitation(room.ID, req.UserID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to invite user", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := h.invitationResponse(invitation)
+	if err != nil {
+		http.Error(w, "Failed to invite user", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ListInvitations handles GET /api/invitations - lists the caller's pending invitations
+func (h *MembershipHandler) ListInvitations(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	invitations, err := h.roomStore.GetPendingInvitations(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve invitations", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]models.InvitationResponse, 0, len(invitations))
+	for i := range invitations {
+		invitation, err := h.invitationResponse(&invitations[i])
+		if err != nil {
+			continue
+		}
+		response = append(response, invitation)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// AcceptInvitation handles POST /api/invitations/{id}/accept - joins the
+// room the invitation is for and returns it
+func (h *MembershipHandler) AcceptInvitation(w http.ResponseWriter, r *http.Request) {
+	invitation, ok := h.respond(w, r, true)
+	if !ok {
+		return
+	}
+
+	room, err := h.roomStore.GetRoom(invitation.RoomID)
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newRoomResponse(room))
+}
+
+// DeclineInvitation handles POST /api/invitations/{id}/decline
+func (h *MembershipHandler) DeclineInvitation(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.respond(w, r, false); !ok {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// respond accepts or declines one of the caller's pending invitations
+func (h *MembershipHandler) respond(w http.ResponseWriter, r *http.Request, accept bool) (*models.RoomInvitation, bool) {
+	claims := auth.FromContext(r.Context())
+
+	invitationID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid invitation ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	// Other users' invitations are reported as missing
+	invitation, err := h.roomStore.GetInvitation(uint(invitationID))
+	if err == nil && invitation.UserID != claims.UserID {
+		err = store.ErrInvitationNotFound
+	}
+	if err == nil {
+		err = h.roomStore.RespondToInvitation(invitation.ID, accept)
+	}
+	if err != nil {
+		writeMembershipError(w, err)
+		return nil, false
+	}
+
+	return invitation, true
+}
+
+// loadRoom reads the {id} path variable and loads the room, replying 404
+// when it doesn't exist or the user can't access it and isn't a server admin
+func (h *MembershipHandler) loadRoom(w http.ResponseWriter, r *http.Request, claims *auth.Claims) (*models.Room, bool) {
+	roomID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	room, err := h.roomStore.GetRoom(uint(roomID))
+	if err == nil && !canAccessRoom(h.roomStore, room, claims.UserID) && !h.hub.config.IsAdmin(claims.UserID) {
+		err = store.ErrRoomNotFound
+	}
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil, false
+	}
+	return room, true
+}
+
+// memberResponse describes a membership with the member's username
+func (h *MembershipHandler) memberResponse(member models.RoomMember) (models.MemberResponse, error) {
+	user, err := h.userStore.GetUserByID(member.UserID)
+	if err != nil {
+		return models.MemberResponse{}, err
+	}
+	return models.MemberResponse{
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     member.Role,
+		JoinedAt: member.CreatedAt,
+	}, nil
+}
+
+// invitationResponse describes an invitation with its room and inviter
+func (h *MembershipHandler) invitationResponse(invitation *models.RoomInvitation) (models.InvitationResponse, error) {
+	response := models.InvitationResponse{
+		ID:        invitation.ID,
+		Status:    invitation.Status,
+		CreatedAt: invitation.CreatedAt,
+	}
+
+	room, err := h.roomStore.GetRoom(invitation.RoomID)
+	if err != nil {
+		return response, err
+	}
+	response.Room = newRoomResponse(room)
+
+	inviter, err := h.userStore.GetUserByID(invitation.InvitedBy)
+	if err != nil {
+		return response, err
+	}
+	response.InvitedBy = models.UserSummary{UserID: inviter.ID, Username: inviter.Username}
+
+	return response, nil
+}
+
+// writeMembershipError maps errors from membership operations onto HTTP responses
+func writeMembershipError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrAlreadyRoomMember):
+		http.Error(w, "Already a member of this room", http.StatusConflict)
+	case errors.Is(err, store.ErrNotRoomMember):
+		http.Error(w, "Not a member of this room", http.StatusNotFound)
+	case errors.Is(err, store.ErrInvitationNotFound):
+		http.Error(w, "Invitation not found", http.StatusNotFound)
+	case errors.Is(err, store.ErrAlreadyBanned):
+		http.Error(w, "User is already banned from this room", http.StatusConflict)
+	case errors.Is(err, store.ErrNotBanned):
+		http.Error(w, "User is not banned from this room", http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to update membership", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,348 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatapp/auth"
+	"chatapp/config"
+	"chatapp/models"
+	"chatapp/store"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// page size used when the client doesn't ask for one
+	defaultHistoryLimit = 50
+)
+
+// MessageHandler handles message history and message-level requests
+type MessageHandler struct {
+	config       *config.Config
+	hub          *Hub
+	roomStore    store.RoomStore
+	messageStore store.MessageStore
+}
+
+// NewMessageHandler creates a new message handler
+func NewMessageHandler(cfg *config.Config, hub *Hub, roomStore store.RoomStore, messageStore store.MessageStore) *MessageHandler {
+	return &MessageHandler{
+		config:       cfg,
+		hub:          hub,
+		roomStore:    roomStore,
+		messageStore: messageStore,
+	}
+}
+
+// ListRoomMessages handles GET /api/rooms/{id}/messages - returns a page of
+// room history. Pages are selected with the before/after message ID cursors
+// and limit query parameters; limit is capped at MESSAGE_HISTORY_SIZE.
+func (h *MessageHandler) ListRoomMessages(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	roomID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.roomStore.GetRoom(uint(roomID))
+	if err != nil || !canAccessRoom(h.roomStore, room, claims.UserID) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	query, ok := h.parseMessageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	// Fetch one extra message to learn whether another page exists
+	limit := query.Limit
+	query.Limit++
+	messages, err := h.messageStore.GetByRoom(uint(roomID), query)
+	if err != nil {
+		http.Error(w, "Failed to retrieve messages", http.StatusInternalServerError)
+		return
+	}
+
+	var page models.MessagePage
+	page.Messages, page.HasMore = trimPage(messages, limit, query)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// trimPage drops the extra message fetched beyond limit and reports whether
+// there was one. The extra message sits on the far side of the cursor direction.
+func trimPage(messages []models.Message, limit int, query store.MessageQuery) ([]models.Message, bool) {
+	if len(messages) <= limit {
+		return messages, false
+	}
+	if query.AfterID > 0 {
+		return messages[:limit], true
+	}
+	return messages[len(messages)-limit:], true
+}
+
+// parseMessageQuery reads the before, after and limit query parameters
+func (h *MessageHandler) parseMessageQuery(w http.ResponseWriter, r *http.Request) (store.MessageQuery, bool) {
+	params := r.URL.Query()
+	query := store.MessageQuery{Limit: defaultHistoryLimit}
+
+	for name, target := range map[string]*uint{"before": &query.BeforeID, "after": &query.AfterID} {
+		if value := params.Get(name); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				http.Error(w, "Invalid "+name+" cursor", http.StatusBadRequest)
+				return query, false
+			}
+			*target = uint(parsed)
+		}
+	}
+
+	if value := params.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return query, false
+		}
+		query.Limit = parsed
+	}
+	if query.Limit > h.config.MessageHistorySize {
+		query.Limit = h.config.MessageHistorySize
+	}
+
+	return query, true
+}
+
+// GetThread handles GET /api/messages/{id}/thread - returns a message and a
+// page of its replies, selected with the same before/after/limit parameters
+// as room history
+func (h *MessageHandler) GetThread(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	messageID, ok := parseMessageID(w, r)
+	if !ok {
+		return
+	}
+
+	parent, err := h.messageStore.GetByID(messageID)
+	if err == nil && !h.hub.canAccess(parent.RoomID, claims.UserID) {
+		err = store.ErrMessageNotFound
+	}
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	if parent.Reactions, err = h.messageStore.GetReactions(parent.ID); err != nil {
+		http.Error(w, "Failed to retrieve thread", http.StatusInternalServerError)
+		return
+	}
+
+	query, ok := h.parseMessageQuery(w, r)
+	if !ok {
+		return
+	}
+
+	// Fetch one extra reply to learn whether another page exists
+	limit := query.Limit
+	query.Limit++
+	replies, err := h.messageStore.GetThread(parent.ID, query)
+	if err != nil {
+		http.Error(w, "Failed to retrieve thread", http.StatusInternalServerError)
+		return
+	}
+
+	thread := models.Thread{Parent: *parent}
+	thread.Replies, thread.HasMore = trimPage(replies, limit, query)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(thread)
+}
+
+// EditMessage handles PATCH /api/messages/{id} - lets the author change a
+// message's content. The room is notified with a message_edited event.
+func (h *MessageHandler) EditMessage(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	messageID, ok := parseMessageID(w, r)
+	if !ok {
+		return
+	}
+
+	var req models.EditMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	message, err := h.hub.EditMessage(claims.UserID, messageID, req.Content)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+// DeleteMessage handles DELETE /api/messages/{id} - soft-deletes a message.
+// Authors can delete their own messages and moderators anyone's; the room is
+// sent a message_deleted tombstone.
+func (h *MessageHandler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	messageID, ok := parseMessageID(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.hub.DeleteMessage(claims.UserID, messageID); err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PinMessage handles PUT /api/messages/{id}/pin - pins a message to its room
+func (h *MessageHandler) PinMessage(w http.ResponseWriter, r *http.Request) {
+	h.setPinned(w, r, true)
+}
+
+// UnpinMessage handles DELETE /api/messages/{id}/pin
+func (h *MessageHandler) UnpinMessage(w http.ResponseWriter, r *http.Request) {
+	h.setPinned(w, r, false)
+}
+
+// setPinned pins or unpins the message named by the {id} path variable
+func (h *MessageHandler) setPinned(w http.ResponseWriter, r *http.Request, pin bool) {
+	claims := auth.FromContext(r.Context())
+
+	messageID, ok := parseMessageID(w, r)
+	if !ok {
+		return
+	}
+
+	message, err := h.hub.PinMessage(claims.UserID, messageID, pin)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(message)
+}
+
+// ListPinnedMessages handles GET /api/rooms/{id}/pins - lists a room's
+// pinned messages, most recently pinned first
+func (h *MessageHandler) ListPinnedMessages(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	roomID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+
+	room, err := h.roomStore.GetRoom(uint(roomID))
+	if err != nil || !canAccessRoom(h.roomStore, room, claims.UserID) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
+	}
+
+	messages, err := h.messageStore.GetPinned(room.ID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve pinned messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// PurgeDeletedMessages handles POST /api/admin/messages/purge - permanently
+// removes messages deleted longer ago than DELETED_MESSAGE_RETENTION
+func (h *MessageHandler) PurgeDeletedMessages(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+	if !h.config.IsAdmin(claims.UserID) {
+		http.Error(w, "Admin access required", http.StatusForbidden)
+		return
+	}
+
+	purged, err := h.messageStore.PurgeDeleted(time.Now().Add(-h.config.DeletedMessageRetention))
+	if err != nil {
+		http.Error(w, "Failed to purge messages", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.PurgeResponse{Purged: purged})
+}
+
+// GetRevisions handles GET /api/messages/{id}/revisions - lists the earlier
+// contents of an edited message, oldest first
+func (h *MessageHandler) GetRevisions(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	messageID, ok := parseMessageID(w, r)
+	if !ok {
+		return
+	}
+
+	message, err := h.messageStore.GetByID(messageID)
+	if err == nil && !h.hub.canAccess(message.RoomID, claims.UserID) {
+		err = store.ErrMessageNotFound
+	}
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+
+	revisions, err := h.messageStore.GetRevisions(messageID)
+	if err != nil {
+		http.Error(w, "Failed to retrieve revisions", http.StatusInternalServerError)
+		return
+	}
+	if revisions == nil {
+		revisions = []models.MessageRevision{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// parseMessageID reads the {id} path variable
+func parseMessageID(w http.ResponseWriter, r *http.Request) (uint, bool) {
+	messageID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return 0, false
+	}
+	return uint(messageID), true
+}
+
+// writeMessageError maps errors from message operations onto HTTP responses
+func writeMessageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, store.ErrMessageNotFound):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	case errors.Is(err, ErrNotMessageAuthor):
+		http.Error(w, "Only the author can change this message", http.StatusForbidden)
+	case errors.Is(err, ErrCannotDelete):
+		http.Error(w, "Only the author or a moderator can delete this message", http.StatusForbidden)
+	case errors.Is(err, ErrPermissionDenied):
+		http.Error(w, "Your role in this room doesn't allow that", http.StatusForbidden)
+	case errors.Is(err, ErrRoomArchived):
+		http.Error(w, "This room is archived and read-only", http.StatusConflict)
+	case errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrMessageTooLong):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Failed to update message", http.StatusInternalServerError)
+	}
+}
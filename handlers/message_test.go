@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"chatapp/models"
+	"chatapp/store"
+)
+
+func TestPurgeKeepsParentsOfRemainingReplies(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.createUser(t, "admin")
+	env.cfg.AdminUserIDs = []string{admin.ID}
+	env.cfg.DeletedMessageRetention = 0
+	h := NewMessageHandler(env.cfg, env.hub, env.rooms, env.messages)
+
+	answered := env.saveMessage(t, admin, env.general.ID, "answered question")
+	reply := &models.Message{Type: models.TextMessage, UserID: admin.ID, Username: admin.Username, RoomID: env.general.ID,
+		Content: "answer", ParentMessageID: &answered.ID}
+	if err := env.messages.Save(reply); err != nil {
+		t.Fatalf("saving reply: %v", err)
+	}
+	lone := env.saveMessage(t, admin, env.general.ID, "lone message")
+	for _, message := range []*models.Message{answered, lone} {
+		if err := env.hub.DeleteMessage(admin.ID, message.ID); err != nil {
+			t.Fatalf("deleting message: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.PurgeDeletedMessages(rec, withClaims(httptest.NewRequest(http.MethodPost, "/api/admin/messages/purge", nil), admin))
+	var response models.PurgeResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || response.Purged != 1 {
+		t.Fatalf("purge response = %+v (%v), want only the lone message purged", response, err)
+	}
+
+	replies, err := env.messages.GetThread(answered.ID, store.MessageQuery{Limit: 10})
+	if err != nil || len(replies) != 1 || replies[0].ID != reply.ID {
+		t.Errorf("thread = %+v (%v), want the remaining reply", replies, err)
+	}
+
+	// Once its last reply is deleted the parent goes with it
+	if err := env.hub.DeleteMessage(admin.ID, reply.ID); err != nil {
+		t.Fatalf("deleting reply: %v", err)
+	}
+	if purged, err := env.messages.PurgeDeleted(time.Now().Add(time.Second)); err != nil || purged != 2 {
+		t.Errorf("purging the finished thread removed %d messages (%v), want 2", purged, err)
+	}
+}
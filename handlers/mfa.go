@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"chatapp/auth"
+	"chatapp/models"
+	"chatapp/store"
+)
+
+// EnrollTOTP handles POST /api/mfa/totp/enroll - generates a TOTP secret for
+// the user's authenticator app. Two-factor authentication is only turned on
+// once ConfirmTOTP has seen a code from it.
+func (h *AuthHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	user, err := h.userStore.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled() {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+	if err := h.userStore.SetTOTPSecret(user.ID, secret); err != nil {
+		http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.TOTPEnrollmentResponse{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(secret, h.config.MFAIssuer, user.Username),
+	})
+}
+
+// ConfirmTOTP handles POST /api/mfa/totp/confirm - checks a code from the
+// authenticator app against the enrolled secret, turns on two-factor
+// authentication and returns the recovery codes
+func (h *AuthHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+	if rateLimited(w, h.usernameLimiter, claims.Username) {
+		return
+	}
+
+	var req models.MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if user.TOTPEnabled() {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if user.TOTPSecret == "" {
+		http.Error(w, "Start enrollment first", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, req.Code, time.Now())
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+	if err := h.userStore.UseTOTPStep(user.ID, step); err != nil {
+		if err == store.ErrCodeUsed {
+			http.Error(w, "Invalid code", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	codes, hashes, err := auth.NewRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := h.userStore.EnableTOTP(user.ID, hashes); err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication enabled for %s", user.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableTOTP handles POST /api/mfa/totp/disable - turns off two-factor
+// authentication. A current TOTP code or a recovery code is required, so a
+// stolen access token alone can't remove the second factor.
+func (h *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+	if rateLimited(w, h.usernameLimiter, claims.Username) {
+		return
+	}
+
+	var req models.MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, "Code is required", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if !user.TOTPEnabled() {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+
+	ok, err := h.checkMFACode(user, req.Code)
+	if err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Invalid code", http.StatusForbidden)
+		return
+	}
+
+	if err := h.userStore.DisableTOTP(user.ID); err != nil {
+		http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Two-factor authentication disabled for %s", user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LoginMFA handles POST /api/login/mfa - completes a login that requires a
+// second factor by exchanging the MFA token from /api/login and a TOTP or
+// recovery code for tokens. Wrong codes count towards the lockout like
+// wrong passwords.
+func (h *AuthHandler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	ip := clientIP(r, h.config)
+	if rateLimited(w, h.ipLimiter, ip) {
+		return
+	}
+
+	var req models.MFALoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.MFAToken == "" || req.Code == "" {
+		http.Error(w, "MFA token and code are required", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := auth.ValidateMFAChallenge(req.MFAToken)
+	if err != nil {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	if h.loginLocked(w, userLoginKey(claims.Username), ipLoginKey(ip)) {
+		return
+	}
+
+	user, err := h.userStore.GetUserByID(claims.UserID)
+	if err != nil || !user.TOTPEnabled() {
+		http.Error(w, "Invalid or expired MFA token", http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := h.checkMFACode(user, req.Code)
+	if err != nil {
+		http.Error(w, "Failed to check code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.loginFailed(user, user.Username, ip)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	h.completeLogin(w, user)
+}
+
+// checkMFACode reports whether code is a current TOTP code or an unused
+// recovery code of the user. Either is used up by a successful check.
+func (h *AuthHandler) checkMFACode(user *models.User, code string) (bool, error) {
+	if step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		err := h.userStore.UseTOTPStep(user.ID, step)
+		if err == store.ErrCodeUsed {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	err := h.userStore.UseRecoveryCode(user.ID, auth.HashRecoveryCode(code))
+	if err == store.ErrInvalidCode {
+		return false, nil
+	}
+	if err == nil {
+		log.Printf("Recovery code used by %s", user.Username)
+	}
+	return err == nil, err
+}
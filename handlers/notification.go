@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"chatapp/auth"
+	"chatapp/store"
+
+	"github.com/gorilla/mux"
+)
+
+// notificationListSize is how many notifications GET /api/notifications returns
+const notificationListSize = 50
+
+// NotificationHandler handles a user's in-app notifications
+type NotificationHandler struct {
+	notificationStore store.NotificationStore
+}
+
+// NewNotificationHandler creates a new notification handler
+func NewNotificationHandler(notificationStore store.NotificationStore) *NotificationHandler {
+	return &NotificationHandler{notificationStore: notificationStore}
+}
+
+// ListNotifications handles GET /api/notifications - lists the caller's
+// newest notifications, only the unread ones with unread=true
+func (h *NotificationHandler) ListNotifications(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	unreadOnly, _ := strconv.ParseBool(r.URL.Query().Get("unread"))
+	notifications, err := h.notificationStore.GetNotifications(claims.UserID, unreadOnly, notificationListSize)
+	if err != nil {
+		http.Error(w, "Failed to retrieve notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// MarkNotificationRead handles POST /api/notifications/{id}/read
+func (h *NotificationHandler) MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	notificationID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.notificationStore.MarkNotificationRead(uint(notificationID), claims.UserID); err != nil {
+		if err == store.ErrNotificationNotFound {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "Failed to update notification", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
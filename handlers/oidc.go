@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"chatapp/auth"
+	"chatapp/models"
+	"chatapp/oidc"
+	"chatapp/store"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// oidcLoginCookie carries a single sign-on login from the redirect to the
+	// identity provider back to the callback
+	oidcLoginCookie = "oidc_login"
+	// oidcLoginTTL is how long the user has to sign in at the provider
+	oidcLoginTTL = 10 * time.Minute
+	// maxUsernameAttempts bounds the suffixes tried when a new single sign-on
+	// user's preferred username is taken
+	maxUsernameAttempts = 20
+)
+
+var (
+	errSSONoEmail    = errors.New("identity provider returned no email address")
+	errSSOEmailTaken = errors.New("email belongs to an existing account and is not verified by the identity provider")
+)
+
+// AuthMethods handles GET /api/auth/methods - tells the login page whether
+// to offer password login, single sign-on or both
+func (h *AuthHandler) AuthMethods(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.AuthMethodsResponse{
+		Password: h.config.PasswordLogin,
+		OIDC:     h.sso != nil,
+	})
+}
+
+// OIDCLogin handles GET /api/auth/oidc/login - sends the browser to the
+// identity provider. The state, nonce and PKCE verifier of the login are
+// kept in a signed cookie for the callback.
+func (h *AuthHandler) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, h.ipLimiter, clientIP(r, h.config)) {
+		return
+	}
+
+	var secrets [3]string
+	for i := range secrets {
+		token, err := oidc.RandomToken()
+		if err != nil {
+			http.Error(w, "Failed to start single sign-on", http.StatusInternalServerError)
+			return
+		}
+		secrets[i] = token
+	}
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+	authURL, err := h.sso.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		log.Printf("Error starting single sign-on: %v", err)
+		h.ssoFailed(w, r, "Single sign-on is unavailable, please try again later")
+		return
+	}
+
+	cookie, err := auth.GenerateOIDCLogin(state, nonce, verifier, oidcLoginTTL)
+	if err != nil {
+		http.Error(w, "Failed to start single sign-on", http.StatusInternalServerError)
+		return
+	}
+	h.setLoginCookie(w, cookie, int(oidcLoginTTL.Seconds()))
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback handles GET /api/auth/oidc/callback - where the identity
+// provider sends the browser back with an authorization code. The code is
+// redeemed for an ID token, whose account is signed in to the linked user,
+// creating or linking one on first login. The chat tokens are handed to the
+// page in the URL fragment, which never reaches a server.
+func (h *AuthHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if rateLimited(w, h.ipLimiter, clientIP(r, h.config)) {
+		return
+	}
+
+	// The login cookie works once
+	cookie, err := r.Cookie(oidcLoginCookie)
+	h.setLoginCookie(w, "", -1)
+	if err != nil {
+		h.ssoFailed(w, r, "Single sign-on expired, please try again")
+		return
+	}
+	login, err := auth.ValidateOIDCLogin(cookie.Value)
+	if err != nil {
+		h.ssoFailed(w, r, "Single sign-on expired, please try again")
+		return
+	}
+
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		log.Printf("Single sign-on refused by the identity provider: %s %s", providerError, query.Get("error_description"))
+		h.ssoFailed(w, r, "Sign-in was cancelled or refused by the identity provider")
+		return
+	}
+	// A state other than the one this browser was sent off with means the
+	// response belongs to a login started elsewhere
+	if query.Get("state") != login.State || query.Get("code") == "" {
+		h.ssoFailed(w, r, "Single sign-on failed, please try again")
+		return
+	}
+
+	idToken, err := h.sso.Exchange(r.Context(), query.Get("code"), login.Verifier, login.Nonce)
+	if err != nil {
+		log.Printf("Error completing single sign-on: %v", err)
+		h.ssoFailed(w, r, "Single sign-on failed, please try again")
+		return
+	}
+
+	user, err := h.ssoUser(idToken)
+	if err != nil {
+		switch {
+		case errors.Is(err, errSSONoEmail):
+			h.ssoFailed(w, r, "Your identity provider account has no email address")
+		case errors.Is(err, errSSOEmailTaken):
+			h.ssoFailed(w, r, "An account with this email already exists; verify the email with your identity provider to use it")
+		default:
+			log.Printf("Error signing in %s from single sign-on: %v", idToken.Subject, err)
+			h.ssoFailed(w, r, "Single sign-on failed, please try again")
+		}
+		return
+	}
+
+	// Accounts with two-factor authentication still need their code
+	fragment := url.Values{}
+	if user.TOTPEnabled() {
+		mfaToken, _, err := auth.GenerateMFAChallenge(user.ID, user.Username)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		fragment.Set("mfa_required", "true")
+		fragment.Set("mfa_token", mfaToken)
+	} else {
+		response, err := h.issueTokens(user, uuid.New().String())
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		fragment.Set("token", response.Token)
+		fragment.Set("expires_at", response.ExpiresAt.Format(time.RFC3339))
+		fragment.Set("refresh_token", response.RefreshToken)
+		fragment.Set("username", response.Username)
+		fragment.Set("user_id", response.UserID)
+	}
+
+	http.Redirect(w, r, "/#"+fragment.Encode(), http.StatusFound)
+}
+
+// ssoUser returns the user linked to a single sign-on account. On first
+// login the account is linked to the user with the same verified email, or
+// a new user is created for it.
+func (h *AuthHandler) ssoUser(idToken *oidc.IDToken) (*models.User, error) {
+	issuer := h.sso.Issuer()
+	user, err := h.userStore.GetUserByIdentity(issuer, idToken.Subject)
+	if err != store.ErrUserNotFound {
+		return user, err
+	}
+
+	if idToken.Email == "" {
+		return nil, errSSONoEmail
+	}
+
+	// Only an email the provider vouches for may claim an existing account
+	if idToken.EmailVerified {
+		user, err = h.userStore.GetUserByEmail(idToken.Email)
+		if err != nil && err != store.ErrUserNotFound {
+			return nil, err
+		}
+	}
+
+	if user == nil {
+		user, err = h.createSSOUser(idToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := h.userStore.LinkIdentity(user.ID, issuer, idToken.Subject); err != nil {
+		// A concurrent first login linked the account already
+		if err == store.ErrIdentityLinked {
+			return h.userStore.GetUserByIdentity(issuer, idToken.Subject)
+		}
+		return nil, err
+	}
+
+	log.Printf("Single sign-on account %s linked to user %s", idToken.Subject, user.Username)
+	return user, nil
+}
+
+// createSSOUser creates a user for a single sign-on account. Single sign-on
+// users have no password; taken usernames get a numeric suffix.
+func (h *AuthHandler) createSSOUser(idToken *oidc.IDToken) (*models.User, error) {
+	base := ssoUsername(idToken)
+	for attempt := 1; attempt <= maxUsernameAttempts; attempt++ {
+		username := truncateUsername(base, "", h.config.MaxUsernameLength)
+		if attempt > 1 {
+			username = truncateUsername(base, fmt.Sprintf("-%d", attempt), h.config.MaxUsernameLength)
+		}
+
+		user, err := h.userStore.CreateUser(username, idToken.Email, "")
+		switch err {
+		case nil:
+			return user, nil
+		case store.ErrUserExists:
+			continue
+		case store.ErrEmailExists:
+			return nil, errSSOEmailTaken
+		default:
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free username for %q", base)
+}
+
+// ssoUsername picks a username for a new single sign-on user from the
+// preferred username, the email's local part or the name, keeping only
+// letters, digits, dots, dashes and underscores
+func ssoUsername(idToken *oidc.IDToken) string {
+	local, _, _ := strings.Cut(idToken.Email, "@")
+	for _, candidate := range []string{idToken.PreferredUsername, local, idToken.Name} {
+		username := strings.Map(func(r rune) rune {
+			switch {
+			case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_':
+				return r
+			case unicode.IsSpace(r):
+				return '_'
+			}
+			return -1
+		}, candidate)
+		if username != "" {
+			return username
+		}
+	}
+	return "user"
+}
+
+// truncateUsername shortens base so that base+suffix fits in max runes
+func truncateUsername(base, suffix string, max int) string {
+	runes := []rune(base)
+	if keep := max - len([]rune(suffix)); len(runes) > keep {
+		runes = runes[:keep]
+	}
+	return string(runes) + suffix
+}
+
+// setLoginCookie sets, or with a negative maxAge deletes, the single sign-on
+// login cookie
+func (h *AuthHandler) setLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     "/api/auth/oidc/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(h.config.OIDCRedirectURL, "https://"),
+		// Lax lets the cookie through on the provider's top-level redirect back
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ssoFailed sends the browser back to the chat page with an error to show
+func (h *AuthHandler) ssoFailed(w http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(w, r, "/#"+url.Values{"sso_error": {message}}.Encode(), http.StatusFound)
+}
@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"chatapp/auth"
+	"chatapp/oidc"
+	"chatapp/oidc/oidctest"
+	"chatapp/store"
+)
+
+// ssoHandler returns an AuthHandler signing in through a fresh identity
+// provider
+func (e *testEnv) ssoHandler(t *testing.T) (*AuthHandler, *oidctest.Server) {
+	t.Helper()
+
+	idp := oidctest.NewServer("chat", "client-secret")
+	t.Cleanup(idp.Close)
+
+	e.cfg.OIDCIssuerURL = idp.URL
+	e.cfg.OIDCClientID = idp.ClientID
+	e.cfg.OIDCClientSecret = idp.ClientSecret
+	e.cfg.OIDCRedirectURL = "https://chat.example.com/api/auth/oidc/callback"
+	sso := oidc.New(oidc.Config{
+		IssuerURL:    e.cfg.OIDCIssuerURL,
+		ClientID:     e.cfg.OIDCClientID,
+		ClientSecret: e.cfg.OIDCClientSecret,
+		RedirectURL:  e.cfg.OIDCRedirectURL,
+		Scopes:       e.cfg.OIDCScopes,
+	})
+	return NewAuthHandler(e.cfg, e.users, e.tokens, e.attempts, e.notifications, e.hub, sso), idp
+}
+
+// startSSO begins a login and returns the provider's callback to the chat
+// together with the browser's login cookie
+func startSSO(t *testing.T, h *AuthHandler, idp *oidctest.Server) (*url.URL, *http.Cookie) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.OIDCLogin(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status = %d (%s), want 302", rec.Code, rec.Body)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != oidcLoginCookie || !cookies[0].HttpOnly || !cookies[0].Secure {
+		t.Fatalf("login cookies = %v, want a secure, HTTP-only %s cookie", cookies, oidcLoginCookie)
+	}
+
+	callback, err := idp.Login(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("logging in at the provider: %v", err)
+	}
+	return callback, cookies[0]
+}
+
+// finishSSO delivers a provider callback with the login cookie and returns
+// the fragment the chat page is sent to
+func finishSSO(t *testing.T, h *AuthHandler, callback *url.URL, cookie *http.Cookie) url.Values {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, callback.RequestURI(), nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	h.OIDCCallback(rec, req)
+
+	location := rec.Header().Get("Location")
+	if rec.Code != http.StatusFound || !strings.HasPrefix(location, "/#") {
+		t.Fatalf("callback: status = %d, location %q; want a redirect to the chat page", rec.Code, location)
+	}
+	fragment, err := url.ParseQuery(strings.TrimPrefix(location, "/#"))
+	if err != nil {
+		t.Fatalf("parsing fragment %q: %v", location, err)
+	}
+	return fragment
+}
+
+// ssoLogin signs in at the provider and returns the resulting fragment
+func ssoLogin(t *testing.T, h *AuthHandler, idp *oidctest.Server) url.Values {
+	t.Helper()
+
+	callback, cookie := startSSO(t, h, idp)
+	return finishSSO(t, h, callback, cookie)
+}
+
+func TestSSOLoginProvisionsUser(t *testing.T) {
+	env := newTestEnv(t)
+	h, idp := env.ssoHandler(t)
+	idp.SetIdentity(oidctest.Identity{Subject: "sub-1", Email: "jane@corp.example", EmailVerified: true, PreferredUsername: "jane"})
+
+	first := ssoLogin(t, h, idp)
+	if first.Get("sso_error") != "" {
+		t.Fatalf("first login failed: %s", first.Get("sso_error"))
+	}
+	if first.Get("username") != "jane" {
+		t.Errorf("username = %q, want jane", first.Get("username"))
+	}
+	if claims, err := auth.ValidateToken(first.Get("token")); err != nil || claims.UserID != first.Get("user_id") {
+		t.Errorf("access token = %+v (%v), want one for the new user", claims, err)
+	}
+
+	linked, err := env.users.GetUserByIdentity(idp.URL, "sub-1")
+	if err != nil || linked.ID != first.Get("user_id") {
+		t.Fatalf("linked user = %+v (%v), want %s", linked, err, first.Get("user_id"))
+	}
+
+	// Later logins find the account by its identity, whatever its email now
+	idp.SetIdentity(oidctest.Identity{Subject: "sub-1", Email: "jane.doe@corp.example", EmailVerified: true, PreferredUsername: "jane"})
+	if again := ssoLogin(t, h, idp); again.Get("user_id") != first.Get("user_id") {
+		t.Errorf("second login signed in as %q (%s), want %s", again.Get("user_id"), again.Get("sso_error"), first.Get("user_id"))
+	}
+}
+
+func TestSSOLoginPicksFreeUsername(t *testing.T) {
+	env := newTestEnv(t)
+	h, idp := env.ssoHandler(t)
+	env.createUser(t, "jane")
+	idp.SetIdentity(oidctest.Identity{Subject: "sub-1", Email: "jane@corp.example", EmailVerified: true, PreferredUsername: "jane"})
+
+	if fragment := ssoLogin(t, h, idp); fragment.Get("username") != "jane-2" {
+		t.Errorf("username = %q (%s), want jane-2", fragment.Get("username"), fragment.Get("sso_error"))
+	}
+}
+
+func TestSSOLoginLinksVerifiedEmail(t *testing.T) {
+	env := newTestEnv(t)
+	h, idp := env.ssoHandler(t)
+	alice := env.createUser(t, "alice")
+	idp.SetIdentity(oidctest.Identity{Subject: "sub-1", Email: alice.Email, EmailVerified: true, PreferredUsername: "ally"})
+
+	fragment := ssoLogin(t, h, idp)
+	if fragment.Get("user_id") != alice.ID || fragment.Get("username") != "alice" {
+		t.Fatalf("signed in as %q (%s), want alice", fragment.Get("username"), fragment.Get("sso_error"))
+	}
+	if linked, err := env.users.GetUserByIdentity(idp.URL, "sub-1"); err != nil || linked.ID != alice.ID {
+		t.Errorf("linked user = %+v (%v), want alice", linked, err)
+	}
+}
+
+func TestSSOLoginRefusesUnverifiedEmail(t *testing.T) {
+	env := newTestEnv(t)
+	h, idp := env.ssoHandler(t)
+	alice := env.createUser(t, "alice")
+	idp.SetIdentity(oidctest.Identity{Subject: "sub-1", Email: alice.Email, EmailVerified: false, PreferredUsername: "alice"})
+
+	fragment := ssoLogin(t, h, idp)
+	if fragment.Get("sso_error") == "" || fragment.Get("token") != "" {
+		t.Fatalf("login with an unverified email of another user = %v, want an error", fragment)
+	}
+	if _, err := env.users.GetUserByIdentity(idp.URL, "sub-1"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("identity lookup: got %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestSSOCallbackRequiresOwnLogin(t *testing.T) {
+	env := newTestEnv(t)
+	h, idp := env.ssoHandler(t)
+	idp.SetIdentity(oidctest.Identity{Subject: "sub-1", Email: "jane@corp.example", EmailVerified: true})
+
+	// A callback without the cookie its login started with
+	callback, _ := startSSO(t, h, idp)
+	if fragment := finishSSO(t, h, callback, nil); fragment.Get("sso_error") == "" {
+		t.Errorf("callback without a login cookie = %v, want an error", fragment)
+	}
+
+	// An attacker's callback delivered to a victim's browser mid-login
+	attackerCallback, _ := startSSO(t, h, idp)
+	_, victimCookie := startSSO(t, h, idp)
+	if fragment := finishSSO(t, h, attackerCallback, victimCookie); fragment.Get("sso_error") == "" {
+		t.Errorf("callback of another login = %v, want an error", fragment)
+	}
+
+	// The right state with another login's code fails the PKCE and nonce checks
+	victimCallback, victimCookie := startSSO(t, h, idp)
+	query := victimCallback.Query()
+	query.Set("code", attackerCallback.Query().Get("code"))
+	victimCallback.RawQuery = query.Encode()
+	if fragment := finishSSO(t, h, victimCallback, victimCookie); fragment.Get("sso_error") == "" {
+		t.Errorf("callback with another login's code = %v, want an error", fragment)
+	}
+
+	if _, err := env.users.GetUserByIdentity(idp.URL, "sub-1"); !errors.Is(err, store.ErrUserNotFound) {
+		t.Errorf("identity lookup: got %v, want no account provisioned", err)
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"chatapp/models"
+	"chatapp/store"
+)
+
+// ProtocolV1 is the Sec-WebSocket-Protocol name of envelope version 1.
+// Connections that don't ask for a subprotocol use the legacy protocol of
+// bare frames.
+const ProtocolV1 = "chat.v1"
+
+// legacyProtocol is the version of connections without a subprotocol
+const legacyProtocol = 0
+
+// subprotocols maps the subprotocols the server speaks to their versions
+var subprotocols = map[string]int{
+	ProtocolV1: models.ProtocolVersion,
+}
+
+var (
+	errBadFrame           = errors.New("frame is not a valid request")
+	errUnsupportedVersion = errors.New("unsupported protocol version")
+	errUnknownOp          = errors.New("unknown op")
+	errNotSubscribed      = errors.New("not subscribed to room")
+	errAlreadySubscribed  = errors.New("already subscribed to room")
+	errHubClosed          = errors.New("server is shutting down")
+	errRateLimitAbuse     = errors.New("rate limit exceeded too often")
+)
+
+// supportsProtocol reports whether the server speaks one of the offered subprotocols
+func supportsProtocol(offered []string) bool {
+	for _, name := range offered {
+		if _, ok := subprotocols[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// outbound is a frame queued for writePump. Events hold the bare event
+// JSON and are wrapped in an envelope for versioned clients when written;
+// replies are complete envelopes.
+type outbound struct {
+	data  []byte
+	reply bool
+}
+
+// request is a decoded client frame
+type request struct {
+	op      models.Op
+	id      string
+	payload models.RequestPayload
+}
+
+// decode parses a client frame. Legacy frames are the payload itself with a
+// "type" field naming the op, defaulting to text. The returned request keeps
+// the op and ID even on error so the error reply can name them.
+func (c *Client) decode(data []byte) (request, error) {
+	if c.protocol == legacyProtocol {
+		var frame struct {
+			Type models.Op `json:"type"`
+			models.RequestPayload
+		}
+		if err := json.Unmarshal(data, &frame); err != nil {
+			return request{op: models.SendOp}, errBadFrame
+		}
+		if frame.Type == "" {
+			frame.Type = models.SendOp
+		}
+		return request{op: frame.Type, payload: frame.RequestPayload}, nil
+	}
+
+	var envelope models.Envelope
+	if err := json.Unmarshal(data, &envelope); err != nil {
+		return request{}, errBadFrame
+	}
+
+	req := request{op: envelope.Op, id: envelope.ID}
+	if envelope.Version != c.protocol {
+		return req, errUnsupportedVersion
+	}
+	if len(envelope.Payload) > 0 {
+		if err := json.Unmarshal(envelope.Payload, &req.payload); err != nil {
+			return req, errBadFrame
+		}
+	}
+	return req, nil
+}
+
+// respond answers a request: versioned clients get an ack carrying result,
+// or an error frame. Legacy clients only hear about errors, as a system
+// message.
+func (c *Client) respond(req request, result interface{}, err error) {
+	if c.protocol == legacyProtocol {
+		if err != nil {
+			c.sendSystemMessage(legacyErrorPrefix(req.op) + newErrorPayload(err).Message)
+		}
+		return
+	}
+
+	envelope := models.Envelope{Version: c.protocol, Op: models.AckOp, ID: req.id}
+	if err != nil {
+		envelope.Op = models.ErrorOp
+		result = newErrorPayload(err)
+	}
+	if result != nil {
+		payload, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("Error marshaling reply: %v", err)
+			return
+		}
+		envelope.Payload = payload
+	}
+
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		log.Printf("Error marshaling reply: %v", err)
+		return
+	}
+	c.queue(outbound{data: data, reply: true})
+}
+
+// newErrorPayload classifies a request error. Unexpected errors are logged
+// and reported without their details.
+func newErrorPayload(err error) models.ErrorPayload {
+	code := errorCode(err)
+	if code == models.InternalError {
+		log.Printf("Error handling WebSocket request: %v", err)
+		return models.ErrorPayload{Code: code, Message: "request failed, please try again"}
+	}
+
+	payload := models.ErrorPayload{Code: code, Message: err.Error()}
+	var rateErr *rateLimitError
+	if errors.As(err, &rateErr) {
+		payload.RetryAfter = retrySeconds(rateErr.retryAfter)
+	}
+	return payload
+}
+
+// errorCode returns the protocol error code for a request error
+func errorCode(err error) models.ErrorCode {
+	var rateErr *rateLimitError
+	switch {
+	case errors.Is(err, errBadFrame):
+		return models.BadRequestError
+	case errors.Is(err, errUnsupportedVersion):
+		return models.UnsupportedVersionError
+	case errors.Is(err, errUnknownOp):
+		return models.UnknownOpError
+	case errors.Is(err, ErrEmptyMessage), errors.Is(err, ErrMessageTooLong),
+		errors.Is(err, ErrInvalidEmoji), errors.Is(err, ErrInvalidParent):
+		return models.InvalidError
+	case errors.Is(err, store.ErrMessageNotFound), errors.Is(err, store.ErrRoomNotFound):
+		return models.NotFoundError
+	case errors.Is(err, ErrNotMessageAuthor), errors.Is(err, ErrCannotDelete),
+		errors.Is(err, ErrPermissionDenied):
+		return models.ForbiddenError
+	case errors.Is(err, ErrRoomArchived):
+		return models.RoomArchivedError
+	case errors.Is(err, errNotSubscribed):
+		return models.NotSubscribedError
+	case errors.Is(err, errAlreadySubscribed):
+		return models.AlreadySubscribedError
+	case errors.As(err, &rateErr):
+		return models.RateLimitedError
+	default:
+		return models.InternalError
+	}
+}
+
+// legacyErrorPrefix returns the text legacy clients see before a request error
+func legacyErrorPrefix(op models.Op) string {
+	switch op {
+	case models.SendOp:
+		return "Message not sent: "
+	case models.EditOp:
+		return "Could not edit message: "
+	case models.DeleteOp:
+		return "Could not delete message: "
+	case models.ReactOp, models.UnreactOp:
+		return "Could not update reaction: "
+	case models.PinOp:
+		return "Could not pin message: "
+	case models.UnpinOp:
+		return "Could not unpin message: "
+	case models.SubscribeOp:
+		return "Could not subscribe: "
+	case models.UnsubscribeOp:
+		return "Could not unsubscribe: "
+	default:
+		return "Request failed: "
+	}
+}
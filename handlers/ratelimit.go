@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatapp/config"
+	"chatapp/ratelimit"
+)
+
+// rateLimitError refuses a WebSocket frame sent faster than
+// MESSAGE_RATE_LIMIT allows
+type rateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded, retry in %ds", retrySeconds(e.retryAfter))
+}
+
+// retrySeconds rounds a wait up to whole seconds, as Retry-After expects
+func retrySeconds(wait time.Duration) int {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// rateLimited takes a token for key from limiter. When none is left it
+// replies 429 with a Retry-After header and returns true.
+func rateLimited(w http.ResponseWriter, limiter *ratelimit.Limiter, key string) bool {
+	allowed, retryAfter := limiter.Allow(key)
+	if allowed {
+		return false
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(retryAfter)))
+	http.Error(w, "Too many requests, please try again later", http.StatusTooManyRequests)
+	return true
+}
+
+// clientIP returns the address a request came from. Behind reverse proxies
+// (TRUST_PROXY_HEADERS) it is taken from X-Forwarded-For, where each proxy
+// appends the address it received the request from. Only the last
+// TRUSTED_PROXY_HOPS entries were written by our proxies; anything before
+// them is whatever the client sent, so the entry that many from the right
+// is the client. A request with fewer entries didn't come through all
+// proxies and is judged by its peer address.
+func clientIP(r *http.Request, cfg *config.Config) string {
+	if cfg.TrustProxyHeaders {
+		var entries []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			entries = append(entries, strings.Split(header, ",")...)
+		}
+		if len(entries) >= cfg.TrustedProxyHops {
+			ip := strings.TrimSpace(entries[len(entries)-cfg.TrustedProxyHops])
+			if net.ParseIP(ip) != nil {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
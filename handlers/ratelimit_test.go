@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"chatapp/config"
+	"chatapp/models"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name      string
+		trust     bool
+		hops      int
+		forwarded []string
+		want      string
+	}{
+		{"headers ignored", false, 1, []string{"203.0.113.7"}, "192.0.2.1"},
+		{"no header", true, 1, nil, "192.0.2.1"},
+		{"single proxy", true, 1, []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entry before ours", true, 1, []string{"198.51.100.9, 203.0.113.7"}, "203.0.113.7"},
+		{"two proxies", true, 2, []string{"198.51.100.9, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"repeated headers", true, 2, []string{"198.51.100.9", "203.0.113.7", "10.0.0.2"}, "203.0.113.7"},
+		{"fewer entries than proxies", true, 2, []string{"203.0.113.7"}, "192.0.2.1"},
+		{"not an address", true, 1, []string{"198.51.100.9, garbage"}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		cfg := config.Default()
+		cfg.TrustProxyHeaders = tt.trust
+		cfg.TrustedProxyHops = tt.hops
+
+		r := httptest.NewRequest("POST", "/api/login", nil)
+		r.RemoteAddr = "192.0.2.1:51234"
+		for _, value := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := clientIP(r, cfg); got != tt.want {
+			t.Errorf("%s: clientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMalformedFramesAreRateLimited(t *testing.T) {
+	env := newTestEnv(t, func(cfg *config.Config) {
+		cfg.MessageRateLimit = config.Rate{Limit: 2, Per: time.Hour}
+		cfg.MessageRateLimitStrikes = 1
+	})
+	server := env.wsServer(t)
+	alice := env.createUser(t, "alice")
+
+	conn := dial(t, server, alice)
+	readUntil(t, conn, event(models.SubscribedEvent))
+
+	// Frames of an unsupported version never decode into a request
+	wantCodes := []models.ErrorCode{models.UnsupportedVersionError, models.UnsupportedVersionError, models.RateLimitedError}
+	for i, want := range wantCodes {
+		id := strconv.Itoa(i)
+		frame := `{"v":99,"op":"send","id":"` + id + `","payload":{"content":"hi"}}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("writing frame: %v", err)
+		}
+
+		var payload models.ErrorPayload
+		if err := json.Unmarshal(readUntil(t, conn, reply(id)).Payload, &payload); err != nil {
+			t.Fatalf("decoding error: %v", err)
+		}
+		if payload.Code != want {
+			t.Errorf("frame %d: error %q, want %q", i, payload.Code, want)
+		}
+	}
+
+	// Out of strikes, the connection is closed
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`garbage`)); err != nil {
+		t.Fatalf("writing frame: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, CloseRateLimited) {
+				t.Errorf("connection ended with %v, want close code %d", err, CloseRateLimited)
+			}
+			break
+		}
+	}
+}
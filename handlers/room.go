@@ -2,24 +2,39 @@ package handlers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 
+	"chatapp/auth"
 	"chatapp/models"
 	"chatapp/store"
 
 	"github.com/gorilla/mux"
 )
 
+const (
+	// limits on room details, in characters
+	maxTopicLength       = 255
+	maxDescriptionLength = 4000
+)
+
 // RoomHandler handles room-related requests
 type RoomHandler struct {
-	roomStore *store.RoomStore
+	hub          *Hub
+	roomStore    store.RoomStore
+	messageStore store.MessageStore
 }
 
 // NewRoomHandler creates a new room handler
-func NewRoomHandler(roomStore *store.RoomStore) *RoomHandler {
+func NewRoomHandler(hub *Hub, roomStore store.RoomStore, messageStore store.MessageStore) *RoomHandler {
 	return &RoomHandler{
-		roomStore: roomStore,
+		hub:          hub,
+		roomStore:    roomStore,
+		messageStore: messageStore,
 	}
 }
 
@@ -31,33 +46,54 @@ func (h *RoomHandler) ListRooms(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Users also see the private rooms they are a member of
+	claims := auth.FromContext(r.Context())
+	memberRooms, err := h.roomStore.GetUserRooms(claims.UserID, models.ChannelRoom)
+	if err != nil {
+		http.Error(w, "Failed to retrieve rooms", http.StatusInternalServerError)
+		return
+	}
+	for _, room := range memberRooms {
+		if room.Visibility == models.PrivateRoom {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+
 	response := make([]models.RoomResponse, len(rooms))
 	for i, room := range rooms {
-		response[i] = models.RoomResponse{
-			ID:        room.ID,
-			Name:      room.Name,
-			CreatedAt: room.CreatedAt,
-		}
+		response[i] = newRoomResponse(&room)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// CreateRoom handles POST /api/rooms - creates a new room
+// CreateRoom handles POST /api/rooms - creates a new room owned by the caller
 func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
 	var req models.CreateRoomRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	if req.Name == "" {
-		http.Error(w, "Room name is required", http.StatusBadRequest)
+	if problem := validateRoomName(req.Name); problem != "" {
+		http.Error(w, problem, http.StatusBadRequest)
+		return
+	}
+
+	switch req.Visibility {
+	case "":
+		req.Visibility = models.PublicRoom
+	case models.PublicRoom, models.PrivateRoom:
+	default:
+		http.Error(w, "Visibility must be public or private", http.StatusBadRequest)
 		return
 	}
 
-	room, err := h.roomStore.CreateRoom(req.Name)
+	room, err := h.roomStore.CreateRoom(req.Name, req.Visibility, claims.UserID)
 	if err != nil {
 		if err == store.ErrRoomExists {
 			http.Error(w, "Room already exists", http.StatusConflict)
@@ -67,11 +103,7 @@ func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := models.RoomResponse{
-		ID:        room.ID,
-		Name:      room.Name,
-		CreatedAt: room.CreatedAt,
-	}
+	response := newRoomResponse(room)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -80,6 +112,8 @@ func (h *RoomHandler) CreateRoom(w http.ResponseWriter, r *http.Request) {
 
 // GetRoom handles GET /api/rooms/{id} - gets a specific room
 func (h *RoomHandler) GetRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
 	vars := mux.Vars(r)
 	roomIDStr := vars["id"]
 	
@@ -99,12 +133,190 @@ func (h *RoomHandler) GetRoom(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := models.RoomResponse{
-		ID:        room.ID,
-		Name:      room.Name,
-		CreatedAt: room.CreatedAt,
+	// Private rooms are only shown to their members
+	if !canAccessRoom(h.roomStore, room, claims.UserID) {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return
 	}
 
+	response := newRoomResponse(room)
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
+
+// UpdateRoom handles PATCH /api/rooms/{id} - changes a room's name, topic,
+// description or archived flag. Renaming and editing the topic and
+// description need the rename permission; archiving needs the archive
+// permission. Connected clients receive a room_updated event.
+func (h *RoomHandler) UpdateRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadManagedRoom(w, r, claims)
+	if !ok {
+		return
+	}
+
+	var req models.UpdateRoomRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil || req.Topic != nil || req.Description != nil {
+		if !h.hub.can(claims.UserID, room.ID, models.RenameRoomPermission) {
+			http.Error(w, "Only the room owner or a moderator can change its details", http.StatusForbidden)
+			return
+		}
+	}
+	if req.Archived != nil && !h.hub.can(claims.UserID, room.ID, models.ArchiveRoomPermission) {
+		http.Error(w, "Only the room owner can archive it", http.StatusForbidden)
+		return
+	}
+
+	if req.Name != nil {
+		if problem := validateRoomName(*req.Name); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+		room.Name = *req.Name
+	}
+	if req.Topic != nil {
+		if utf8.RuneCountInString(*req.Topic) > maxTopicLength {
+			http.Error(w, "Topic is too long", http.StatusBadRequest)
+			return
+		}
+		room.Topic = *req.Topic
+	}
+	if req.Description != nil {
+		if utf8.RuneCountInString(*req.Description) > maxDescriptionLength {
+			http.Error(w, "Description is too long", http.StatusBadRequest)
+			return
+		}
+		room.Description = *req.Description
+	}
+	if req.Archived != nil {
+		room.Archived = *req.Archived
+	}
+
+	if err := h.roomStore.UpdateRoom(room); err != nil {
+		if err == store.ErrRoomExists {
+			http.Error(w, "Room already exists", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update room", http.StatusInternalServerError)
+		return
+	}
+	h.hub.PublishRoomUpdate(room)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newRoomResponse(room))
+}
+
+// DeleteRoom handles DELETE /api/rooms/{id} - deletes a room and its
+// messages for good and disconnects its clients. Only the owner may delete,
+// and the default room is kept for clients that join it without asking.
+func (h *RoomHandler) DeleteRoom(w http.ResponseWriter, r *http.Request) {
+	claims := auth.FromContext(r.Context())
+
+	room, ok := h.loadManagedRoom(w, r, claims)
+	if !ok {
+		return
+	}
+	if !h.hub.can(claims.UserID, room.ID, models.DeleteRoomPermission) {
+		http.Error(w, "Only the room owner can delete it", http.StatusForbidden)
+		return
+	}
+	if room.ID == DefaultRoomID {
+		http.Error(w, "The default room can't be deleted", http.StatusConflict)
+		return
+	}
+
+	if err := h.roomStore.DeleteRoom(room.ID); err != nil {
+		http.Error(w, "Failed to delete room", http.StatusInternalServerError)
+		return
+	}
+	h.hub.CloseRoom(room.ID)
+
+	// The room is gone either way; leftover messages are unreachable
+	if err := h.messageStore.DeleteRoomMessages(room.ID); err != nil {
+		log.Printf("Error deleting messages of room %d: %v", room.ID, err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadManagedRoom reads the {id} path variable and loads a channel the user
+// can access, replying 404 for unknown rooms and 400 for direct messages
+func (h *RoomHandler) loadManagedRoom(w http.ResponseWriter, r *http.Request, claims *auth.Claims) (*models.Room, bool) {
+	roomID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	room, err := h.roomStore.GetRoom(uint(roomID))
+	if err == nil && !canAccessRoom(h.roomStore, room, claims.UserID) && !h.hub.config.IsAdmin(claims.UserID) {
+		err = store.ErrRoomNotFound
+	}
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil, false
+	}
+	if room.Type == models.DirectRoom {
+		http.Error(w, "Direct message conversations can't be changed", http.StatusBadRequest)
+		return nil, false
+	}
+	return room, true
+}
+
+// validateRoomName returns why a channel name is unacceptable, or ""
+func validateRoomName(name string) string {
+	if name == "" {
+		return "Room name is required"
+	}
+	if strings.HasPrefix(name, store.DirectRoomPrefix) {
+		return "Room names starting with \"" + store.DirectRoomPrefix + "\" are reserved"
+	}
+	return ""
+}
+
+// newRoomResponse converts a room into its API representation
+func newRoomResponse(room *models.Room) models.RoomResponse {
+	return models.RoomResponse{
+		ID:          room.ID,
+		Name:        room.Name,
+		Type:        room.Type,
+		Visibility:  room.Visibility,
+		Topic:       room.Topic,
+		Description: room.Description,
+		Archived:    room.Archived,
+		CreatedBy:   room.CreatedBy,
+		CreatedAt:   room.CreatedAt,
+		UpdatedAt:   room.UpdatedAt,
+	}
+}
+
+// canAccessRoom reports whether a user may read and post in a room. Public
+// rooms are open to everyone; private rooms, including direct message
+// rooms, only to their members. Banned users can't access the room at all.
+func canAccessRoom(roomStore store.RoomStore, room *models.Room, userID string) bool {
+	banned, err := roomStore.IsBanned(room.ID, userID)
+	if err != nil {
+		log.Printf("Error checking bans of room %d: %v", room.ID, err)
+		return false
+	}
+	if banned {
+		return false
+	}
+	if room.Visibility == models.PublicRoom {
+		return true
+	}
+
+	member, err := roomStore.IsRoomMember(room.ID, userID)
+	if err != nil {
+		log.Printf("Error checking membership of room %d: %v", room.ID, err)
+		return false
+	}
+	return member
+}
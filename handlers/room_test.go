@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"chatapp/models"
+
+	"github.com/gorilla/mux"
+)
+
+// deleteRoom calls DeleteRoom for roomID on behalf of user
+func (e *testEnv) deleteRoom(t *testing.T, user *models.User, roomID uint) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/rooms/"+strconv.Itoa(int(roomID)), nil)
+	r = mux.SetURLVars(withClaims(r, user), map[string]string{"id": strconv.Itoa(int(roomID))})
+	rec := httptest.NewRecorder()
+	NewRoomHandler(e.hub, e.rooms, e.messages).DeleteRoom(rec, r)
+	return rec
+}
+
+func TestDeleteRoomKeepsDefaultRoom(t *testing.T) {
+	env := newTestEnv(t)
+	admin := env.createUser(t, "admin")
+	env.cfg.AdminUserIDs = []string{admin.ID}
+
+	if env.general.ID != DefaultRoomID {
+		t.Fatalf("default room has ID %d, want %d", env.general.ID, DefaultRoomID)
+	}
+	if rec := env.deleteRoom(t, admin, DefaultRoomID); rec.Code != http.StatusConflict {
+		t.Fatalf("deleting the default room: status = %d, want 409", rec.Code)
+	}
+	if _, err := env.rooms.GetRoom(DefaultRoomID); err != nil {
+		t.Fatalf("default room is gone: %v", err)
+	}
+
+	room, err := env.rooms.CreateRoom("Team", models.PublicRoom, admin.ID)
+	if err != nil {
+		t.Fatalf("creating room: %v", err)
+	}
+	if rec := env.deleteRoom(t, admin, room.ID); rec.Code != http.StatusNoContent {
+		t.Fatalf("deleting another room: status = %d (%s), want 204", rec.Code, rec.Body)
+	}
+}
@@ -1,37 +1,83 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"chatapp/auth"
+	"chatapp/config"
 	"chatapp/database"
 	"chatapp/handlers"
+	"chatapp/migrations"
 	"chatapp/models"
+	"chatapp/oidc"
 	"chatapp/store"
 
 	"github.com/gorilla/mux"
 )
 
 func main() {
+	// Load configuration from flags, environment and .env
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+
 	// Initialize database
-	if err := database.InitDB("chatapp.db"); err != nil {
+	db, err := database.InitDB(cfg)
+	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 
-	// Auto-migrate models
-	if err := database.AutoMigrate(&models.Message{}, &models.Room{}); err != nil {
+	// "chatapp migrate ..." manages the schema and exits without serving
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(db, args[1:]); err != nil {
+			log.Fatalf("Migration command failed: %v", err)
+		}
+		return
+	}
+
+	// Migration commands need no signing key, so auth is configured after them
+	if err := auth.Configure(cfg); err != nil {
+		log.Fatalf("Failed to configure authentication: %v", err)
+	}
+
+	// Apply pending schema migrations
+	if err := migrations.Up(db); err != nil {
 		log.Fatalf("Failed to migrate database: %v", err)
 	}
 
 	// Initialize stores
-	userStore := store.NewUserStore()
-	roomStore := store.NewRoomStore()
-	messageStore := store.NewMessageStore()
+	userStore := store.NewGormUserStore(db)
+	roomStore := store.NewGormRoomStore(db)
+	messageStore := store.NewGormMessageStore(db)
+	tokenStore := store.NewGormTokenStore(db)
+	attemptStore := store.NewGormLoginAttemptStore(db)
+	notificationStore := store.NewGormNotificationStore(db)
+
+	// Access tokens of logged out sessions are rejected everywhere
+	auth.SetRevocationList(tokenStore)
+	if err := tokenStore.PurgeExpired(time.Now()); err != nil {
+		log.Printf("Warning: Could not purge expired tokens: %v", err)
+	}
+	if err := attemptStore.PurgeLoginAttempts(time.Now().Add(-cfg.LoginFailureWindow)); err != nil {
+		log.Printf("Warning: Could not purge old failed logins: %v", err)
+	}
 
 	// Create default room if it doesn't exist
-	defaultRoom, err := roomStore.GetRoom(1)
+	defaultRoom, err := roomStore.GetRoom(handlers.DefaultRoomID)
 	if err != nil {
-		defaultRoom, err = roomStore.CreateRoom("General")
+		defaultRoom, err = roomStore.CreateRoom("General", models.PublicRoom, "")
 		if err != nil {
 			log.Printf("Warning: Could not create default room: %v", err)
 		} else {
@@ -40,12 +86,29 @@ func main() {
 	}
 
 	// Initialize the WebSocket hub
-	hub := handlers.NewHub(roomStore, messageStore)
+	hub := handlers.NewHub(cfg, roomStore, messageStore)
 	go hub.Run()
 
+	// Single sign-on, when an identity provider is configured
+	var sso *oidc.Provider
+	if cfg.OIDCEnabled() {
+		sso = oidc.New(oidc.Config{
+			IssuerURL:    cfg.OIDCIssuerURL,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       cfg.OIDCScopes,
+		})
+		log.Printf("Single sign-on enabled with %s", cfg.OIDCIssuerURL)
+	}
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(userStore)
-	roomHandler := handlers.NewRoomHandler(roomStore)
+	authHandler := handlers.NewAuthHandler(cfg, userStore, tokenStore, attemptStore, notificationStore, hub, sso)
+	roomHandler := handlers.NewRoomHandler(hub, roomStore, messageStore)
+	directRoomHandler := handlers.NewDirectRoomHandler(roomStore, userStore)
+	membershipHandler := handlers.NewMembershipHandler(hub, roomStore, userStore)
+	messageHandler := handlers.NewMessageHandler(cfg, hub, roomStore, messageStore)
+	notificationHandler := handlers.NewNotificationHandler(notificationStore)
 
 	// Create router
 	router := mux.NewRouter()
@@ -53,24 +116,130 @@ func main() {
 	// Serve static files
 	router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("static/"))))
 
-	// Auth routes
+	// Auth routes. Refreshing and logging out take the refresh token, so they
+	// work once the access token has expired.
 	router.HandleFunc("/api/register", authHandler.Register).Methods("POST")
 	router.HandleFunc("/api/login", authHandler.Login).Methods("POST")
+	router.HandleFunc("/api/login/mfa", authHandler.LoginMFA).Methods("POST")
+	router.HandleFunc("/api/token/refresh", authHandler.Refresh).Methods("POST")
+	router.HandleFunc("/api/logout", authHandler.Logout).Methods("POST")
+	router.HandleFunc("/api/auth/methods", authHandler.AuthMethods).Methods("GET")
+	if sso != nil {
+		router.HandleFunc("/api/auth/oidc/login", authHandler.OIDCLogin).Methods("GET")
+		router.HandleFunc("/api/auth/oidc/callback", authHandler.OIDCCallback).Methods("GET")
+	}
+	router.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler).Methods("GET")
+
+	// Every other API route requires a valid access token
+	api := router.PathPrefix("/api").Subrouter()
+	api.Use(handlers.RequireAuth)
 
 	// Room routes
-	router.HandleFunc("/api/rooms", roomHandler.ListRooms).Methods("GET")
-	router.HandleFunc("/api/rooms", roomHandler.CreateRoom).Methods("POST")
-	router.HandleFunc("/api/rooms/{id}", roomHandler.GetRoom).Methods("GET")
+	api.HandleFunc("/rooms", roomHandler.ListRooms).Methods("GET")
+	api.HandleFunc("/rooms", roomHandler.CreateRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}", roomHandler.GetRoom).Methods("GET")
+	api.HandleFunc("/rooms/{id}", roomHandler.UpdateRoom).Methods("PATCH")
+	api.HandleFunc("/rooms/{id}", roomHandler.DeleteRoom).Methods("DELETE")
+	api.HandleFunc("/rooms/{id}/messages", messageHandler.ListRoomMessages).Methods("GET")
+	api.HandleFunc("/rooms/{id}/pins", messageHandler.ListPinnedMessages).Methods("GET")
+
+	// Membership routes
+	api.HandleFunc("/rooms/{id}/members", membershipHandler.ListMembers).Methods("GET")
+	api.HandleFunc("/rooms/{id}/members/{userID}", membershipHandler.KickMember).Methods("DELETE")
+	api.HandleFunc("/rooms/{id}/members/{userID}/role", membershipHandler.SetMemberRole).Methods("PUT")
+	api.HandleFunc("/rooms/{id}/bans", membershipHandler.ListBans).Methods("GET")
+	api.HandleFunc("/rooms/{id}/bans", membershipHandler.BanMember).Methods("POST")
+	api.HandleFunc("/rooms/{id}/bans/{userID}", membershipHandler.UnbanMember).Methods("DELETE")
+	api.HandleFunc("/rooms/{id}/join", membershipHandler.JoinRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/leave", membershipHandler.LeaveRoom).Methods("POST")
+	api.HandleFunc("/rooms/{id}/invitations", membershipHandler.InviteMember).Methods("POST")
+	api.HandleFunc("/invitations", membershipHandler.ListInvitations).Methods("GET")
+	api.HandleFunc("/invitations/{id}/accept", membershipHandler.AcceptInvitation).Methods("POST")
+	api.HandleFunc("/invitations/{id}/decline", membershipHandler.DeclineInvitation).Methods("POST")
+
+	// Direct message routes
+	api.HandleFunc("/dms", directRoomHandler.ListDirectRooms).Methods("GET")
+	api.HandleFunc("/dms", directRoomHandler.CreateDirectRoom).Methods("POST")
+
+	// Message routes
+	api.HandleFunc("/messages/{id}", messageHandler.EditMessage).Methods("PATCH")
+	api.HandleFunc("/messages/{id}", messageHandler.DeleteMessage).Methods("DELETE")
+	api.HandleFunc("/messages/{id}/revisions", messageHandler.GetRevisions).Methods("GET")
+	api.HandleFunc("/messages/{id}/thread", messageHandler.GetThread).Methods("GET")
+	api.HandleFunc("/messages/{id}/pin", messageHandler.PinMessage).Methods("PUT")
+	api.HandleFunc("/messages/{id}/pin", messageHandler.UnpinMessage).Methods("DELETE")
+
+	// Notification routes
+	api.HandleFunc("/notifications", notificationHandler.ListNotifications).Methods("GET")
+	api.HandleFunc("/notifications/{id}/read", notificationHandler.MarkNotificationRead).Methods("POST")
+
+	// Two-factor authentication routes
+	api.HandleFunc("/mfa/totp/enroll", authHandler.EnrollTOTP).Methods("POST")
+	api.HandleFunc("/mfa/totp/confirm", authHandler.ConfirmTOTP).Methods("POST")
+	api.HandleFunc("/mfa/totp/disable", authHandler.DisableTOTP).Methods("POST")
+
+	// Admin routes
+	api.HandleFunc("/admin/messages/purge", messageHandler.PurgeDeletedMessages).Methods("POST")
+	api.HandleFunc("/admin/users/{username}/unlock", authHandler.UnlockAccount).Methods("POST")
 
 	// WebSocket route
-	router.HandleFunc("/ws", handlers.WSHandler(hub, roomStore)).Methods("GET")
+	router.Handle("/ws", handlers.RequireAuth(handlers.WSHandler(hub, roomStore))).Methods("GET")
 
 	// Home route
 	router.HandleFunc("/", handlers.HomeHandler).Methods("GET")
 
 	// Start server
-	log.Println("Server starting on :8080")
-	log.Println("Authentication enabled - users must register/login to chat")
-	log.Println("Database: chatapp.db")
-	log.Fatal(http.ListenAndServe(":8080", router))
+	server := &http.Server{
+		Addr:    cfg.Addr(),
+		Handler: router,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		log.Printf("Server starting on %s", cfg.Addr())
+		log.Println("Authentication enabled - users must register/login to chat")
+		log.Printf("Database: %s", database.Redact(cfg.DatabaseURL))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// SIGHUP re-reads the configuration and rotates to the configured
+	// signing key, e.g. after JWT_SIGNING_KEY_FILE was replaced on disk
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloaded, _, err := config.Load(os.Args[1:])
+			if err == nil {
+				err = auth.Rotate(reloaded)
+			}
+			if err != nil {
+				log.Printf("Key rotation failed, keeping current key: %v", err)
+			}
+		}
+	}()
+
+	// Wait for SIGINT/SIGTERM, then stop accepting connections, close every
+	// WebSocket client and flush pending message saves before exiting
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("HTTP server shutdown: %v", err)
+	}
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Hub shutdown: %v", err)
+	}
+
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	log.Println("Server stopped")
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"chatapp/migrations"
+
+	"gorm.io/gorm"
+)
+
+// runMigrateCommand implements "chatapp migrate [up|down [steps]|status]"
+func runMigrateCommand(db *gorm.DB, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		return migrations.Up(db)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil || parsed < 1 {
+				return fmt.Errorf("invalid step count %q", args[1])
+			}
+			steps = parsed
+		}
+		return migrations.Down(db, steps)
+
+	case "status":
+		statuses, err := migrations.List(db)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Applied {
+				state = "applied " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30s %s\n", status.Version, status.Name, state)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("unknown migrate command %q (expected up, down or status)", command)
+	}
+}
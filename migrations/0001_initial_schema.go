@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// initialSchema creates the users, rooms and messages tables. It uses
+// AutoMigrate so databases created before versioned migrations existed are
+// adopted as-is rather than failing on already existing tables.
+var initialSchema = Migration{
+	Version: 1,
+	Name:    "initial_schema",
+	Up: func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&user0001{}, &room0001{}, &message0001{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&message0001{}, &room0001{}, &user0001{})
+	},
+}
+
+type user0001 struct {
+	ID           string `gorm:"primaryKey;size:36"`
+	Username     string `gorm:"size:100;not null;uniqueIndex"`
+	Email        string `gorm:"size:255;not null;uniqueIndex"`
+	PasswordHash string `gorm:"size:255;not null"`
+	CreatedAt    time.Time
+}
+
+func (user0001) TableName() string { return "users" }
+
+type room0001 struct {
+	ID        uint   `gorm:"primaryKey"`
+	Name      string `gorm:"size:100;not null;unique"`
+	CreatedAt time.Time
+}
+
+func (room0001) TableName() string { return "rooms" }
+
+type message0001 struct {
+	ID        uint           `gorm:"primaryKey"`
+	Type      string         `gorm:"size:20;not null"`
+	UserID    string         `gorm:"size:100;index"`
+	Username  string         `gorm:"size:100;not null"`
+	RoomID    uint           `gorm:"index;not null"`
+	Content   string         `gorm:"type:text;not null"`
+	Timestamp time.Time      `gorm:"autoCreateTime"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+func (message0001) TableName() string { return "messages" }
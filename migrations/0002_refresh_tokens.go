@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// refreshTokens adds server-side refresh tokens and the revoked session list
+var refreshTokens = Migration{
+	Version: 2,
+	Name:    "refresh_tokens",
+	Up: func(tx *gorm.DB) error {
+		return tx.Migrator().CreateTable(&refreshToken0002{}, &revokedSession0002{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&revokedSession0002{}, &refreshToken0002{})
+	},
+}
+
+type refreshToken0002 struct {
+	ID        string    `gorm:"primaryKey;size:36"`
+	UserID    string    `gorm:"size:36;not null;index"`
+	SessionID string    `gorm:"size:36;not null;index"`
+	TokenHash string    `gorm:"size:64;not null;uniqueIndex"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
+
+func (refreshToken0002) TableName() string { return "refresh_tokens" }
+
+type revokedSession0002 struct {
+	SessionID string    `gorm:"primaryKey;size:36"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+func (revokedSession0002) TableName() string { return "revoked_sessions" }
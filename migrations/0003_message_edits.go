@@ -0,0 +1,40 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// messageEdits adds messages.edited_at and the message_revisions table
+var messageEdits = Migration{
+	Version: 3,
+	Name:    "message_edits",
+	Up: func(tx *gorm.DB) error {
+		if err := tx.Migrator().AddColumn(&message0003{}, "EditedAt"); err != nil {
+			return err
+		}
+		return tx.Migrator().CreateTable(&messageRevision0003{})
+	},
+	Down: func(tx *gorm.DB) error {
+		if err := tx.Migrator().DropTable(&messageRevision0003{}); err != nil {
+			return err
+		}
+		return dropColumns(tx, &message0003{}, "EditedAt")
+	},
+}
+
+type message0003 struct {
+	EditedAt *time.Time
+}
+
+func (message0003) TableName() string { return "messages" }
+
+type messageRevision0003 struct {
+	ID        uint   `gorm:"primaryKey"`
+	MessageID uint   `gorm:"index;not null"`
+	Content   string `gorm:"type:text;not null"`
+	CreatedAt time.Time
+}
+
+func (messageRevision0003) TableName() string { return "message_revisions" }
@@ -0,0 +1,28 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// messageReactions adds the message_reactions table
+var messageReactions = Migration{
+	Version: 4,
+	Name:    "message_reactions",
+	Up: func(tx *gorm.DB) error {
+		return tx.Migrator().CreateTable(&messageReaction0004{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&messageReaction0004{})
+	},
+}
+
+type messageReaction0004 struct {
+	MessageID uint   `gorm:"primaryKey;autoIncrement:false"`
+	UserID    string `gorm:"primaryKey;size:36"`
+	Emoji     string `gorm:"primaryKey;size:64"`
+	CreatedAt time.Time
+}
+
+func (messageReaction0004) TableName() string { return "message_reactions" }
@@ -0,0 +1,38 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// messageThreads adds reply threads: messages.parent_message_id plus the
+// reply summary kept on the parent message
+var messageThreads = Migration{
+	Version: 5,
+	Name:    "message_threads",
+	Up: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		for _, column := range []string{"ParentMessageID", "ReplyCount", "LastReplyAt"} {
+			if err := migrator.AddColumn(&message0005{}, column); err != nil {
+				return err
+			}
+		}
+		return migrator.CreateIndex(&message0005{}, "ParentMessageID")
+	},
+	Down: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.DropIndex(&message0005{}, "ParentMessageID"); err != nil {
+			return err
+		}
+		return dropColumns(tx, &message0005{}, "LastReplyAt", "ReplyCount", "ParentMessageID")
+	},
+}
+
+type message0005 struct {
+	ParentMessageID *uint `gorm:"index"`
+	ReplyCount      int   `gorm:"not null;default:0"`
+	LastReplyAt     *time.Time
+}
+
+func (message0005) TableName() string { return "messages" }
@@ -0,0 +1,48 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// directMessages adds rooms.type, so direct message conversations can live
+// alongside public rooms, and the room_members table holding participants
+var directMessages = Migration{
+	Version: 6,
+	Name:    "direct_messages",
+	Up: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.AddColumn(&room0006{}, "Type"); err != nil {
+			return err
+		}
+		if err := migrator.CreateIndex(&room0006{}, "Type"); err != nil {
+			return err
+		}
+		return migrator.CreateTable(&roomMember0006{})
+	},
+	Down: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.DropTable(&roomMember0006{}); err != nil {
+			return err
+		}
+		if err := migrator.DropIndex(&room0006{}, "Type"); err != nil {
+			return err
+		}
+		return dropColumns(tx, &room0006{}, "Type")
+	},
+}
+
+type room0006 struct {
+	Type string `gorm:"size:20;not null;default:channel;index"`
+}
+
+func (room0006) TableName() string { return "rooms" }
+
+type roomMember0006 struct {
+	RoomID    uint   `gorm:"primaryKey;autoIncrement:false"`
+	UserID    string `gorm:"primaryKey;size:36;index"`
+	CreatedAt time.Time
+}
+
+func (roomMember0006) TableName() string { return "room_members" }
@@ -0,0 +1,51 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// roomMembership adds rooms.visibility for private rooms and the
+// room_invitations table
+var roomMembership = Migration{
+	Version: 7,
+	Name:    "room_membership",
+	Up: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.AddColumn(&room0007{}, "Visibility"); err != nil {
+			return err
+		}
+
+		// Direct message rooms were always members-only
+		if err := tx.Model(&room0007{}).Where("type = ?", "direct").Update("visibility", "private").Error; err != nil {
+			return err
+		}
+		return migrator.CreateTable(&roomInvitation0007{})
+	},
+	Down: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.DropTable(&roomInvitation0007{}); err != nil {
+			return err
+		}
+		return dropColumns(tx, &room0007{}, "Visibility")
+	},
+}
+
+type room0007 struct {
+	Visibility string `gorm:"size:20;not null;default:public"`
+}
+
+func (room0007) TableName() string { return "rooms" }
+
+type roomInvitation0007 struct {
+	ID          uint   `gorm:"primaryKey"`
+	RoomID      uint   `gorm:"not null;uniqueIndex:idx_room_invitations_room_user"`
+	UserID      string `gorm:"size:36;not null;uniqueIndex:idx_room_invitations_room_user;index"`
+	InvitedBy   string `gorm:"size:36;not null"`
+	Status      string `gorm:"size:20;not null"`
+	CreatedAt   time.Time
+	RespondedAt *time.Time
+}
+
+func (roomInvitation0007) TableName() string { return "room_invitations" }
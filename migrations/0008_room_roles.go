@@ -0,0 +1,64 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// roomRoles adds room_members.role, the room_bans table and message pins
+var roomRoles = Migration{
+	Version: 8,
+	Name:    "room_roles",
+	Up: func(tx *gorm.DB) error {
+		// Existing channels get no owner: rooms don't record their creator
+		// until version 10, and joining as a channel was created doesn't prove
+		// having created it. Server admins manage them.
+		migrator := tx.Migrator()
+		if err := migrator.AddColumn(&roomMember0008{}, "Role"); err != nil {
+			return err
+		}
+		if err := migrator.CreateTable(&roomBan0008{}); err != nil {
+			return err
+		}
+		if err := migrator.AddColumn(&message0008{}, "PinnedAt"); err != nil {
+			return err
+		}
+		return migrator.AddColumn(&message0008{}, "PinnedBy")
+	},
+	Down: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := dropColumns(tx, &message0008{}, "PinnedBy", "PinnedAt"); err != nil {
+			return err
+		}
+		if err := migrator.DropTable(&roomBan0008{}); err != nil {
+			return err
+		}
+		return dropColumns(tx, &roomMember0008{}, "Role")
+	},
+}
+
+type roomMember0008 struct {
+	RoomID uint
+	UserID string
+	Role   string `gorm:"size:20;not null;default:member"`
+}
+
+func (roomMember0008) TableName() string { return "room_members" }
+
+type roomBan0008 struct {
+	RoomID    uint   `gorm:"primaryKey;autoIncrement:false"`
+	UserID    string `gorm:"primaryKey;size:36"`
+	BannedBy  string `gorm:"size:36;not null"`
+	Reason    string `gorm:"size:255"`
+	CreatedAt time.Time
+}
+
+func (roomBan0008) TableName() string { return "room_bans" }
+
+type message0008 struct {
+	PinnedAt *time.Time
+	PinnedBy string `gorm:"size:36"`
+}
+
+func (message0008) TableName() string { return "messages" }
@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// roomDetails adds the topic, description, archived flag and updated_at
+// columns to rooms
+var roomDetails = Migration{
+	Version: 9,
+	Name:    "room_details",
+	Up: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		for _, column := range []string{"Topic", "Description", "Archived", "UpdatedAt"} {
+			if err := migrator.AddColumn(&room0009{}, column); err != nil {
+				return err
+			}
+		}
+
+		// Existing rooms haven't changed since they were created
+		return tx.Model(&room0009{}).Where("updated_at IS NULL").Update("updated_at", gorm.Expr("created_at")).Error
+	},
+	Down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &room0009{}, "UpdatedAt", "Archived", "Description", "Topic")
+	},
+}
+
+type room0009 struct {
+	Topic       string `gorm:"size:255"`
+	Description string `gorm:"type:text"`
+	Archived    bool   `gorm:"not null;default:false"`
+	UpdatedAt   *time.Time
+}
+
+func (room0009) TableName() string { return "rooms" }
@@ -0,0 +1,45 @@
+package migrations
+
+import "gorm.io/gorm"
+
+// roomCreators adds rooms.created_by
+var roomCreators = Migration{
+	Version: 10,
+	Name:    "room_creators",
+	Up: func(tx *gorm.DB) error {
+		if err := tx.Migrator().AddColumn(&room0010{}, "CreatedBy"); err != nil {
+			return err
+		}
+
+		// Since roles were added the creator of a channel became its owner, so
+		// each channel's owner is its creator. Older channels have neither.
+		var owners []struct {
+			RoomID uint
+			UserID string
+		}
+		err := tx.Table("room_members").
+			Joins("JOIN rooms ON rooms.id = room_members.room_id").
+			Where("rooms.type = ? AND room_members.role = ?", "channel", "owner").
+			Select("room_members.room_id, room_members.user_id").
+			Find(&owners).Error
+		if err != nil {
+			return err
+		}
+		for _, owner := range owners {
+			err := tx.Model(&room0010{}).Where("id = ?", owner.RoomID).Update("created_by", owner.UserID).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Down: func(tx *gorm.DB) error {
+		return dropColumns(tx, &room0010{}, "CreatedBy")
+	},
+}
+
+type room0010 struct {
+	CreatedBy string `gorm:"size:36"`
+}
+
+func (room0010) TableName() string { return "rooms" }
@@ -0,0 +1,39 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// loginLockouts adds failed login tracking and in-app notifications
+var loginLockouts = Migration{
+	Version: 11,
+	Name:    "login_lockouts",
+	Up: func(tx *gorm.DB) error {
+		return tx.Migrator().CreateTable(&loginAttempt0011{}, &notification0011{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&notification0011{}, &loginAttempt0011{})
+	},
+}
+
+type loginAttempt0011 struct {
+	Key          string    `gorm:"primaryKey;size:255;column:attempt_key"`
+	Failures     int       `gorm:"not null;default:0"`
+	LastFailedAt time.Time `gorm:"not null;index"`
+	LockedUntil  *time.Time
+}
+
+func (loginAttempt0011) TableName() string { return "login_attempts" }
+
+type notification0011 struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"size:36;not null;index"`
+	Type      string `gorm:"size:32;not null"`
+	Content   string `gorm:"type:text;not null"`
+	ReadAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (notification0011) TableName() string { return "notifications" }
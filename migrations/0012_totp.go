@@ -0,0 +1,47 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// totp adds TOTP two-factor authentication to users and their recovery codes
+var totp = Migration{
+	Version: 12,
+	Name:    "totp",
+	Up: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		for _, column := range []string{"TOTPSecret", "TOTPEnabledAt", "TOTPLastStep"} {
+			if err := migrator.AddColumn(&user0012{}, column); err != nil {
+				return err
+			}
+		}
+		return migrator.CreateTable(&recoveryCode0012{})
+	},
+	Down: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.DropTable(&recoveryCode0012{}); err != nil {
+			return err
+		}
+		return dropColumns(tx, &user0012{}, "TOTPLastStep", "TOTPEnabledAt", "TOTPSecret")
+	},
+}
+
+type user0012 struct {
+	TOTPSecret    string `gorm:"size:64"`
+	TOTPEnabledAt *time.Time
+	TOTPLastStep  int64 `gorm:"not null;default:0"`
+}
+
+func (user0012) TableName() string { return "users" }
+
+type recoveryCode0012 struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"size:36;not null;index"`
+	CodeHash  string `gorm:"size:64;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (recoveryCode0012) TableName() string { return "recovery_codes" }
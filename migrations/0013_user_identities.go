@@ -0,0 +1,29 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// userIdentities links users to their single sign-on accounts
+var userIdentities = Migration{
+	Version: 13,
+	Name:    "user_identities",
+	Up: func(tx *gorm.DB) error {
+		return tx.Migrator().CreateTable(&userIdentity0013{})
+	},
+	Down: func(tx *gorm.DB) error {
+		return tx.Migrator().DropTable(&userIdentity0013{})
+	},
+}
+
+type userIdentity0013 struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"size:36;not null;index"`
+	Issuer    string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Subject   string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	CreatedAt time.Time
+}
+
+func (userIdentity0013) TableName() string { return "user_identities" }
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// messageChanges adds messages.changed_at, the last time a message was
+// edited, deleted, reacted to, pinned or replied to, so resuming clients can
+// be sent the changes to messages they had already seen
+var messageChanges = Migration{
+	Version: 14,
+	Name:    "message_changes",
+	Up: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.AddColumn(&message0014{}, "ChangedAt"); err != nil {
+			return err
+		}
+		return migrator.CreateIndex(&message0014{}, "ChangedAt")
+	},
+	Down: func(tx *gorm.DB) error {
+		migrator := tx.Migrator()
+		if err := migrator.DropIndex(&message0014{}, "ChangedAt"); err != nil {
+			return err
+		}
+		return dropColumns(tx, &message0014{}, "ChangedAt")
+	},
+}
+
+type message0014 struct {
+	ChangedAt *time.Time `gorm:"index"`
+}
+
+func (message0014) TableName() string { return "messages" }
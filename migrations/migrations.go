@@ -0,0 +1,244 @@
+package migrations
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ErrSchemaAhead is returned when the database has migrations applied that
+// this binary does not know about, i.e. it was migrated by a newer release.
+var ErrSchemaAhead = errors.New("database schema is newer than this binary")
+
+// Migration is a single numbered schema change. Up and Down run inside a
+// transaction and must not depend on the current models package: each
+// migration snapshots the table shapes it works with so it keeps meaning the
+// same thing as the models evolve.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// all lists every migration in version order. New migrations are appended here.
+var all = []Migration{
+	initialSchema,
+	refreshTokens,
+	messageEdits,
+	messageReactions,
+	messageThreads,
+	directMessages,
+	roomMembership,
+	roomRoles,
+	roomDetails,
+	roomCreators,
+	loginLockouts,
+	totp,
+	userIdentities,
+	messageChanges,
+}
+
+// schemaMigration records an applied migration
+type schemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:255;not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigration) TableName() string { return "schema_migrations" }
+
+// Status describes one known migration and whether it has been applied
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// All returns the known migrations in version order
+func All() []Migration {
+	migrations := make([]Migration, len(all))
+	copy(migrations, all)
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+// Latest returns the highest version this binary knows about
+func Latest() int {
+	migrations := All()
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// CurrentVersion returns the highest applied version, or 0 for a fresh database
+func CurrentVersion(db *gorm.DB) (int, error) {
+	if err := ensureTable(db); err != nil {
+		return 0, err
+	}
+
+	var version int
+	err := db.Model(&schemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// Up applies every pending migration in order. It refuses to run when the
+// database has already been migrated past the latest known version.
+func Up(db *gorm.DB) error {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+	if err := checkNotAhead(applied); err != nil {
+		return err
+	}
+
+	for _, m := range All() {
+		if _, done := applied[m.Version]; done {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("migration %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied migration %04d_%s", m.Version, m.Name)
+	}
+
+	return nil
+}
+
+// Down rolls back the most recently applied migrations, up to steps of them
+func Down(db *gorm.DB, steps int) error {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return err
+	}
+	if err := checkNotAhead(applied); err != nil {
+		return err
+	}
+
+	migrations := All()
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, done := applied[m.Version]; !done {
+			continue
+		}
+		if m.Down == nil {
+			return fmt.Errorf("migration %04d_%s cannot be rolled back", m.Version, m.Name)
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return fmt.Errorf("rollback of %04d_%s failed: %w", m.Version, m.Name, err)
+		}
+		log.Printf("Rolled back migration %04d_%s", m.Version, m.Name)
+		steps--
+	}
+
+	return nil
+}
+
+// List reports every known migration along with its applied state
+func List(db *gorm.DB) ([]Status, error) {
+	applied, err := appliedVersions(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []Status
+	for _, m := range All() {
+		status := Status{Version: m.Version, Name: m.Name}
+		if record, done := applied[m.Version]; done {
+			status.Applied = true
+			status.AppliedAt = record.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// ensureTable creates the schema_migrations table if it does not exist yet
+func ensureTable(db *gorm.DB) error {
+	if db.Migrator().HasTable(&schemaMigration{}) {
+		return nil
+	}
+	return db.Migrator().CreateTable(&schemaMigration{})
+}
+
+// appliedVersions loads the applied migrations keyed by version
+func appliedVersions(db *gorm.DB) (map[int]schemaMigration, error) {
+	if err := ensureTable(db); err != nil {
+		return nil, err
+	}
+
+	var records []schemaMigration
+	if err := db.Find(&records).Error; err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]schemaMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+	return applied, nil
+}
+
+// checkNotAhead fails when any applied version is unknown to this binary
+func checkNotAhead(applied map[int]schemaMigration) error {
+	latest := Latest()
+	for version := range applied {
+		if version > latest {
+			return fmt.Errorf("%w: database is at version %d, binary supports up to %d", ErrSchemaAhead, version, latest)
+		}
+	}
+	return nil
+}
+
+// dropColumns removes columns from the table of value. SQLite can't drop a
+// column in place, so GORM rebuilds the table there and every index on it is
+// lost; those are recreated afterwards. Indexes on the dropped columns must be
+// dropped before calling this.
+func dropColumns(tx *gorm.DB, value interface{}, columns ...string) error {
+	var indexes []string
+	if tx.Dialector.Name() == "sqlite" {
+		stmt := &gorm.Statement{DB: tx}
+		if err := stmt.Parse(value); err != nil {
+			return err
+		}
+		err := tx.Raw("SELECT sql FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND sql IS NOT NULL", stmt.Table).
+			Scan(&indexes).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, column := range columns {
+		if err := tx.Migrator().DropColumn(value, column); err != nil {
+			return err
+		}
+	}
+
+	for _, index := range indexes {
+		if err := tx.Exec(index).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -10,30 +10,119 @@ import (
 type MessageType string
 
 const (
-	TextMessage      MessageType = "text"
-	UserJoinMessage  MessageType = "user_join"
-	UserLeftMessage  MessageType = "user_left"
-	SystemMessage    MessageType = "system"
-	TypingMessage    MessageType = "typing"
+	TextMessage     MessageType = "text"
+	UserJoinMessage MessageType = "user_join"
+	UserLeftMessage MessageType = "user_left"
+	SystemMessage   MessageType = "system"
+	TypingMessage   MessageType = "typing"
+
+	// Events about existing messages
+	MessageEditedEvent   MessageType = "message_edited"
+	MessageDeletedEvent  MessageType = "message_deleted"
+	ReactionsEvent       MessageType = "message_reactions"
+	ThreadUpdatedEvent   MessageType = "thread_updated"
+	MessagePinnedEvent   MessageType = "message_pinned"
+	MessageUnpinnedEvent MessageType = "message_unpinned"
+
+	// Events about rooms and the connection's subscriptions to them
+	RoomUpdatedEvent  MessageType = "room_updated"
+	SubscribedEvent   MessageType = "subscribed"
+	UnsubscribedEvent MessageType = "unsubscribed"
+	HistoryGapEvent   MessageType = "history_gap"
+
+	// Notices for one user rather than a room
+	NotificationEvent MessageType = "notification"
 )
 
 // Message represents a chat message (both in-memory and persisted)
 type Message struct {
-	ID        uint            `gorm:"primaryKey" json:"id"`
-	Type      MessageType     `gorm:"size:20;not null" json:"type"`
-	UserID    string          `gorm:"size:100;index" json:"user_id"`
-	Username  string          `gorm:"size:100;not null" json:"username"`
-	RoomID    uint            `gorm:"index;not null" json:"room_id"`
-	Content   string          `gorm:"type:text;not null" json:"content"`
-	Timestamp time.Time       `gorm:"autoCreateTime" json:"timestamp"`
-	DeletedAt gorm.DeletedAt  `gorm:"index" json:"-"`
+	ID        uint           `gorm:"primaryKey" json:"id"`
+	Type      MessageType    `gorm:"size:20;not null" json:"type"`
+	UserID    string         `gorm:"size:100;index" json:"user_id"`
+	Username  string         `gorm:"size:100;not null" json:"username"`
+	RoomID    uint           `gorm:"index;not null" json:"room_id"`
+	Content   string         `gorm:"type:text;not null" json:"content"`
+	Timestamp time.Time      `gorm:"autoCreateTime" json:"timestamp"`
+	EditedAt  *time.Time     `json:"edited_at,omitempty"`
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+
+	// Last edit, deletion, reaction, pin or reply, for replaying changes to
+	// clients that resume after a disconnect
+	ChangedAt *time.Time `gorm:"index" json:"-"`
+
+	// Threads: replies point at their parent, which keeps the reply summary
+	ParentMessageID *uint      `gorm:"index" json:"parent_message_id,omitempty"`
+	ReplyCount      int        `gorm:"not null;default:0" json:"reply_count,omitempty"`
+	LastReplyAt     *time.Time `json:"last_reply_at,omitempty"`
+
+	// Pinned messages are listed for the room at /api/rooms/{id}/pins
+	PinnedAt *time.Time `json:"pinned_at,omitempty"`
+	PinnedBy string     `gorm:"size:36" json:"pinned_by,omitempty"`
+
+	// Aggregated reactions, filled in when messages are read back
+	Reactions []ReactionCount `gorm:"-" json:"reactions,omitempty"`
+
+	// The room's new details, sent with room_updated events
+	Room *RoomResponse `gorm:"-" json:"room,omitempty"`
+
+	// The notice sent with notification events
+	Notification *Notification `gorm:"-" json:"notification,omitempty"`
+}
+
+// MessageRevision keeps the content a message had before an edit
+type MessageRevision struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"index;not null" json:"message_id"`
+	Content   string    `gorm:"type:text;not null" json:"content"`
+	CreatedAt time.Time `json:"created_at"` // when this content was replaced
+}
+
+// Reaction is one user's emoji reaction to a message
+type Reaction struct {
+	MessageID uint      `gorm:"primaryKey;autoIncrement:false" json:"message_id"`
+	UserID    string    `gorm:"primaryKey;size:36" json:"user_id"`
+	Emoji     string    `gorm:"primaryKey;size:64" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName keeps reactions in message_reactions
+func (Reaction) TableName() string { return "message_reactions" }
+
+// ReactionCount aggregates the reactions to a message with the same emoji
+type ReactionCount struct {
+	Emoji   string   `json:"emoji"`
+	Count   int      `json:"count"`
+	UserIDs []string `json:"user_ids"`
+}
+
+// EditMessageRequest represents a request to edit a message
+type EditMessageRequest struct {
+	Content string `json:"content"`
+}
+
+// PurgeResponse reports how many deleted messages were permanently removed
+type PurgeResponse struct {
+	Purged int64 `json:"purged"`
+}
+
+// Thread is a message together with a page of its replies
+type Thread struct {
+	Parent  Message   `json:"parent"`
+	Replies []Message `json:"replies"`
+	HasMore bool      `json:"has_more"`
+}
+
+// MessagePage is one page of room history returned by the REST API
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	HasMore  bool      `json:"has_more"`
 }
 
 // TypingIndicator represents a typing indicator message
 type TypingIndicator struct {
-	Type      MessageType `json:"type"`
-	UserID    string      `json:"user_id"`
-	Username  string      `json:"username"`
-	RoomID    uint        `json:"room_id"`
-	IsTyping  bool        `json:"is_typing"`
+	Type     MessageType `json:"type"`
+	UserID   string      `json:"user_id"`
+	Username string      `json:"username"`
+	RoomID   uint        `json:"room_id"`
+	IsTyping bool        `json:"is_typing"`
 }
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// NotificationType says what a notification is about
+type NotificationType string
+
+const (
+	// AccountLockedNotification tells a user that failed logins locked their account
+	AccountLockedNotification NotificationType = "account_locked"
+)
+
+// Notification is an in-app notice for one user. Connected clients receive
+// it as a notification event; the rest are listed at /api/notifications.
+type Notification struct {
+	ID        uint             `gorm:"primaryKey" json:"id"`
+	UserID    string           `gorm:"size:36;not null;index" json:"user_id"`
+	Type      NotificationType `gorm:"size:32;not null" json:"type"`
+	Content   string           `gorm:"type:text;not null" json:"content"`
+	ReadAt    *time.Time       `json:"read_at,omitempty"`
+	CreatedAt time.Time        `json:"created_at"`
+}
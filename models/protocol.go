@@ -0,0 +1,79 @@
+package models
+
+import "encoding/json"
+
+// ProtocolVersion is the current version of the WebSocket envelope protocol
+const ProtocolVersion = 1
+
+// Op identifies what a WebSocket envelope asks for or carries
+type Op string
+
+// Requests sent by clients. Each one is answered with an ack or an error
+// carrying the request's ID.
+const (
+	SendOp        Op = "text"
+	EditOp        Op = "edit"
+	DeleteOp      Op = "delete"
+	ReactOp       Op = "react"
+	UnreactOp     Op = "unreact"
+	PinOp         Op = "pin"
+	UnpinOp       Op = "unpin"
+	TypingOp      Op = "typing"
+	SubscribeOp   Op = "subscribe"
+	UnsubscribeOp Op = "unsubscribe"
+)
+
+// Frames sent by the server
+const (
+	AckOp   Op = "ack"
+	ErrorOp Op = "error"
+	EventOp Op = "event"
+)
+
+// Envelope is a WebSocket frame of the versioned protocol. ID is chosen by
+// the client for requests and echoed in the ack or error that answers them;
+// events carry no ID.
+type Envelope struct {
+	Version int             `json:"v"`
+	Op      Op              `json:"op"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// RequestPayload holds the fields of every client request; each op reads
+// the ones it needs. Requests without a room_id are for the connection's
+// default room. Since is the last message a resubscribing client saw.
+type RequestPayload struct {
+	RoomID          *uint  `json:"room_id,omitempty"`
+	ID              uint   `json:"id,omitempty"`
+	Content         string `json:"content,omitempty"`
+	ParentMessageID *uint  `json:"parent_message_id,omitempty"`
+	Emoji           string `json:"emoji,omitempty"`
+	IsTyping        bool   `json:"is_typing,omitempty"`
+	Since           *uint  `json:"since,omitempty"`
+}
+
+// ErrorCode classifies why a request failed
+type ErrorCode string
+
+const (
+	BadRequestError         ErrorCode = "bad_request"
+	UnsupportedVersionError ErrorCode = "unsupported_version"
+	UnknownOpError          ErrorCode = "unknown_op"
+	InvalidError            ErrorCode = "invalid"
+	NotFoundError           ErrorCode = "not_found"
+	ForbiddenError          ErrorCode = "forbidden"
+	RoomArchivedError       ErrorCode = "room_archived"
+	NotSubscribedError      ErrorCode = "not_subscribed"
+	AlreadySubscribedError  ErrorCode = "already_subscribed"
+	RateLimitedError        ErrorCode = "rate_limited"
+	InternalError           ErrorCode = "internal"
+)
+
+// ErrorPayload is the payload of an error frame. RetryAfter is the number
+// of seconds to wait before retrying a rate_limited request.
+type ErrorPayload struct {
+	Code       ErrorCode `json:"code"`
+	Message    string    `json:"message"`
+	RetryAfter int       `json:"retry_after,omitempty"`
+}
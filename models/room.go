@@ -2,21 +2,207 @@ package models
 
 import "time"
 
-// Room represents a chat room
+// RoomType distinguishes public rooms from direct message conversations
+type RoomType string
+
+const (
+	ChannelRoom RoomType = "channel"
+	DirectRoom  RoomType = "direct"
+)
+
+// RoomVisibility controls who can see and join a room
+type RoomVisibility string
+
+const (
+	PublicRoom  RoomVisibility = "public"  // listed, anyone can join
+	PrivateRoom RoomVisibility = "private" // unlisted, members only, join by invitation
+)
+
+// Room represents a chat room. Archived rooms stay readable but accept no
+// new messages, edits, deletions, reactions or pins.
 type Room struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	Name      string    `gorm:"size:100;not null;unique" json:"name"`
+	ID          uint           `gorm:"primaryKey" json:"id"`
+	Name        string         `gorm:"size:100;not null;unique" json:"name"`
+	Type        RoomType       `gorm:"size:20;not null;default:channel;index" json:"type"`
+	Visibility  RoomVisibility `gorm:"size:20;not null;default:public" json:"visibility"`
+	Topic       string         `gorm:"size:255" json:"topic"`
+	Description string         `gorm:"type:text" json:"description"`
+	Archived    bool           `gorm:"not null;default:false" json:"archived"`
+	CreatedBy   string         `gorm:"size:36" json:"created_by"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+}
+
+// RoomRole is a member's role within one room
+type RoomRole string
+
+const (
+	OwnerRole     RoomRole = "owner"
+	ModeratorRole RoomRole = "moderator"
+	MemberRole    RoomRole = "member"
+)
+
+// RoomPermission is an action in a room that not every member may take
+type RoomPermission string
+
+const (
+	RenameRoomPermission       RoomPermission = "rename_room" // name, topic and description
+	ArchiveRoomPermission      RoomPermission = "archive_room"
+	DeleteRoomPermission       RoomPermission = "delete_room"
+	ManageRolesPermission      RoomPermission = "manage_roles"
+	KickMemberPermission       RoomPermission = "kick_member"
+	BanMemberPermission        RoomPermission = "ban_member"
+	PinMessagePermission       RoomPermission = "pin_message"
+	DeleteAnyMessagePermission RoomPermission = "delete_any_message"
+)
+
+// rolePermissions lists what each role may do; owners may do everything
+var rolePermissions = map[RoomRole][]RoomPermission{
+	ModeratorRole: {
+		RenameRoomPermission,
+		KickMemberPermission,
+		BanMemberPermission,
+		PinMessagePermission,
+		DeleteAnyMessagePermission,
+	},
+}
+
+// Can reports whether the role grants a permission
+func (r RoomRole) Can(permission RoomPermission) bool {
+	if r == OwnerRole {
+		return true
+	}
+	for _, granted := range rolePermissions[r] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Outranks reports whether the role is above other, e.g. whether a
+// moderator may kick a member
+func (r RoomRole) Outranks(other RoomRole) bool {
+	rank := map[RoomRole]int{MemberRole: 1, ModeratorRole: 2, OwnerRole: 3}
+	return rank[r] > rank[other]
+}
+
+// RoomMember records that a user belongs to a room and their role in it
+type RoomMember struct {
+	RoomID    uint      `gorm:"primaryKey;autoIncrement:false" json:"room_id"`
+	UserID    string    `gorm:"primaryKey;size:36;index" json:"user_id"`
+	Role      RoomRole  `gorm:"size:20;not null;default:member" json:"role"`
+	CreatedAt time.Time `json:"joined_at"`
+}
+
+// RoomBan keeps a user out of a room
+type RoomBan struct {
+	RoomID    uint      `gorm:"primaryKey;autoIncrement:false" json:"room_id"`
+	UserID    string    `gorm:"primaryKey;size:36" json:"user_id"`
+	BannedBy  string    `gorm:"size:36;not null" json:"banned_by"`
+	Reason    string    `gorm:"size:255" json:"reason,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 }
 
+// InvitationStatus is the state of a room invitation
+type InvitationStatus string
+
+const (
+	InvitationPending  InvitationStatus = "pending"
+	InvitationAccepted InvitationStatus = "accepted"
+	InvitationDeclined InvitationStatus = "declined"
+)
+
+// RoomInvitation invites a user to become a member of a room
+type RoomInvitation struct {
+	ID          uint             `gorm:"primaryKey" json:"id"`
+	RoomID      uint             `gorm:"not null;uniqueIndex:idx_room_invitations_room_user" json:"room_id"`
+	UserID      string           `gorm:"size:36;not null;uniqueIndex:idx_room_invitations_room_user;index" json:"user_id"`
+	InvitedBy   string           `gorm:"size:36;not null" json:"invited_by"`
+	Status      InvitationStatus `gorm:"size:20;not null" json:"status"`
+	CreatedAt   time.Time        `json:"created_at"`
+	RespondedAt *time.Time       `json:"responded_at,omitempty"`
+}
+
 // RoomResponse represents a room in API responses
 type RoomResponse struct {
-	ID        uint      `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          uint           `json:"id"`
+	Name        string         `json:"name"`
+	Type        RoomType       `json:"type"`
+	Visibility  RoomVisibility `json:"visibility"`
+	Topic       string         `json:"topic"`
+	Description string         `json:"description"`
+	Archived    bool           `json:"archived"`
+	CreatedBy   string         `json:"created_by"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
 }
 
-// CreateRoomRequest represents a request to create a room
+// UpdateRoomRequest represents a partial update of a room's details; fields
+// left out of the request are unchanged
+type UpdateRoomRequest struct {
+	Name        *string `json:"name"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+	Archived    *bool   `json:"archived"`
+}
+
+// CreateRoomRequest represents a request to create a room. Visibility
+// defaults to public.
 type CreateRoomRequest struct {
-	Name string `json:"name"`
+	Name       string         `json:"name"`
+	Visibility RoomVisibility `json:"visibility"`
+}
+
+// InviteRequest represents a request to invite a user to a room
+type InviteRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// InvitationResponse represents a room invitation in API responses
+type InvitationResponse struct {
+	ID        uint             `json:"id"`
+	Room      RoomResponse     `json:"room"`
+	InvitedBy UserSummary      `json:"invited_by"`
+	Status    InvitationStatus `json:"status"`
+	CreatedAt time.Time        `json:"created_at"`
+}
+
+// MemberResponse represents a room member in API responses
+type MemberResponse struct {
+	UserID   string    `json:"user_id"`
+	Username string    `json:"username"`
+	Role     RoomRole  `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// SetRoleRequest represents a request to change a member's role
+type SetRoleRequest struct {
+	Role RoomRole `json:"role"`
+}
+
+// BanRequest represents a request to ban a user from a room
+type BanRequest struct {
+	UserID string `json:"user_id"`
+	Reason string `json:"reason"`
+}
+
+// CreateDirectRoomRequest represents a request to open a direct message
+// conversation with another user
+type CreateDirectRoomRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// DirectRoomResponse represents a direct message conversation in API
+// responses, from the point of view of the requesting user
+type DirectRoomResponse struct {
+	ID          uint        `json:"id"`
+	Participant UserSummary `json:"participant"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// UserSummary is the public part of a user
+type UserSummary struct {
+	UserID   string `json:"user_id"`
+	Username string `json:"username"`
 }
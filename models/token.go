@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// RefreshToken is a server-side record of an issued refresh token. Only the
+// SHA-256 hash of the token is stored. Tokens rotate on every use; all tokens
+// descending from one login share a SessionID so the whole chain can be revoked.
+type RefreshToken struct {
+	ID        string     `gorm:"primaryKey;size:36" json:"id"`
+	UserID    string     `gorm:"size:36;not null;index" json:"user_id"`
+	SessionID string     `gorm:"size:36;not null;index" json:"session_id"`
+	TokenHash string     `gorm:"size:64;not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time  `gorm:"not null;index" json:"expires_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// RevokedSession marks a session whose access tokens must no longer be
+// accepted. Entries can be purged once every access token issued for the
+// session has expired.
+type RevokedSession struct {
+	SessionID string    `gorm:"primaryKey;size:36"`
+	ExpiresAt time.Time `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+// RefreshRequest represents a request to exchange a refresh token
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// LogoutRequest represents a logout request
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
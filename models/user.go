@@ -4,11 +4,50 @@ import "time"
 
 // User represents a registered user
 type User struct {
-	ID           string    `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"` // Never expose password hash in JSON
+	ID           string    `gorm:"primaryKey;size:36" json:"id"`
+	Username     string    `gorm:"size:100;not null;uniqueIndex" json:"username"`
+	Email        string    `gorm:"size:255;not null;uniqueIndex" json:"email"`
+	PasswordHash string    `gorm:"size:255;not null" json:"-"` // Never expose password hash in JSON
 	CreatedAt    time.Time `json:"created_at"`
+
+	// Two-factor authentication. TOTPSecret is set when enrollment starts and
+	// TOTPEnabledAt once a code has confirmed it. TOTPLastStep is the time
+	// step of the last code used, so a code can't be used twice.
+	TOTPSecret    string     `gorm:"size:64" json:"-"`
+	TOTPEnabledAt *time.Time `json:"-"`
+	TOTPLastStep  int64      `gorm:"not null;default:0" json:"-"`
+}
+
+// TOTPEnabled reports whether logging in takes a second factor
+func (u *User) TOTPEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+// RecoveryCode is a single-use code that stands in for a TOTP code when the
+// user has lost their authenticator. Only the SHA-256 hash is stored.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"size:36;not null;index"`
+	CodeHash  string `gorm:"size:64;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// UserIdentity links a user to an account at a single sign-on identity
+// provider. The issuer and subject of the provider's ID tokens identify the
+// account for good, unlike its email or username.
+type UserIdentity struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    string `gorm:"size:36;not null;index"`
+	Issuer    string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	Subject   string `gorm:"size:255;not null;uniqueIndex:idx_user_identities_issuer_subject"`
+	CreatedAt time.Time
+}
+
+// AuthMethodsResponse tells the login page which ways of signing in are on
+type AuthMethodsResponse struct {
+	Password bool `json:"password"`
+	OIDC     bool `json:"oidc"`
 }
 
 // LoginRequest represents a login request
@@ -26,7 +65,53 @@ type RegisterRequest struct {
 
 // AuthResponse represents an authentication response
 type AuthResponse struct {
-	Token    string `json:"token"`
-	Username string `json:"username"`
-	UserID   string `json:"user_id"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	Username     string    `json:"username"`
+	UserID       string    `json:"user_id"`
+}
+
+// MFAChallengeResponse is returned by login instead of tokens when the
+// account has two-factor authentication. The MFA token is exchanged for
+// tokens at /api/login/mfa together with a code.
+type MFAChallengeResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// MFALoginRequest completes a login that requires a second factor
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+// MFACodeRequest carries a TOTP or recovery code
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// TOTPEnrollmentResponse holds a new TOTP secret for the user's
+// authenticator app
+type TOTPEnrollmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+// RecoveryCodesResponse lists newly issued recovery codes. They are only
+// ever shown once.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// LoginAttempt counts the consecutive failed logins for one username or
+// client IP. Key is "user:<username>" or "ip:<address>". While LockedUntil
+// is in the future logins for the key are refused without checking the
+// password.
+type LoginAttempt struct {
+	Key          string    `gorm:"primaryKey;size:255;column:attempt_key"`
+	Failures     int       `gorm:"not null;default:0"`
+	LastFailedAt time.Time `gorm:"not null;index"`
+	LockedUntil  *time.Time
 }
@@ -0,0 +1,92 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// jwk is a public JSON Web Key (RFC 7517) as published by the provider
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// jwkSet is the document served at the provider's jwks_uri
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// publicKeys returns the set's signing keys by key ID. Encryption keys and
+// key types that can't sign ID tokens are skipped.
+func (s jwkSet) publicKeys() map[string]interface{} {
+	keys := make(map[string]interface{})
+	for _, k := range s.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key := k.publicKey(); key != nil {
+			keys[k.KeyID] = key
+		}
+	}
+	return keys
+}
+
+// publicKey decodes the key, or returns nil when it is malformed or of an
+// unsupported type
+func (k jwk) publicKey() interface{} {
+	switch k.KeyType {
+	case "RSA":
+		n, okN := decodeBigInt(k.N)
+		e, okE := decodeBigInt(k.E)
+		if !okN || !okE || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil
+		}
+		x, okX := decodeBigInt(k.X)
+		y, okY := decodeBigInt(k.Y)
+		if !okX || !okY {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil
+		}
+		return ed25519.PublicKey(x)
+	}
+	return nil
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(value string) (*big.Int, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, false
+	}
+	return new(big.Int).SetBytes(data), true
+}
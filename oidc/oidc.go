@@ -0,0 +1,328 @@
+// Package oidc implements single sign-on against an OpenID Connect identity
+// provider with the authorization code flow and PKCE
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// keyRefreshInterval limits how often the provider's keys are fetched again
+// for an ID token signed with an unknown key
+const keyRefreshInterval = time.Minute
+
+// maxResponseSize bounds the documents read from the provider
+const maxResponseSize = 1 << 20
+
+// ErrUnknownKey is returned for ID tokens signed with a key the provider
+// doesn't publish
+var ErrUnknownKey = errors.New("id token signed with an unknown key")
+
+// Config describes the client registered with the identity provider
+type Config struct {
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string // empty for public clients, which rely on PKCE alone
+	RedirectURL  string
+	Scopes       []string
+}
+
+// IDToken holds the verified identity claims of an ID token
+type IDToken struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// Provider is an OpenID Connect identity provider. Its endpoints and keys
+// are discovered on first use, so the server can start while the provider
+// is unreachable. It is safe for concurrent use.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *metadata
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// metadata is the part of the discovery document the login flow needs
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// New returns a provider for cfg
+func New(cfg Config) *Provider {
+	return &Provider{
+		config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Issuer returns the provider's issuer identifier. Together with an ID
+// token's subject it identifies a user for good.
+func (p *Provider) Issuer() string {
+	return p.config.IssuerURL
+}
+
+// RandomToken returns a random URL-safe string for the state, nonce and
+// PKCE code verifier of a login
+func RandomToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// PKCEChallenge returns the S256 code challenge for a code verifier
+// (RFC 7636 section 4.2)
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider URL the browser is sent to for login.
+// The same state, nonce and verifier must be passed to Exchange afterwards.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(p.config.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", PKCEChallenge(verifier))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return md.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns
+// the verified claims of the ID token that comes back
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*IDToken, error) {
+	md, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.config.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		// client_secret_basic, with both parts form-encoded (RFC 6749 section 2.3.1)
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var response struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.fetch(req, &response)
+	if err != nil {
+		return nil, fmt.Errorf("token request: %w", err)
+	}
+	if status != http.StatusOK || response.Error != "" {
+		return nil, fmt.Errorf("token request failed with status %d: %s %s", status, response.Error, response.ErrorDescription)
+	}
+	if response.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+
+	return p.verify(ctx, md, response.IDToken, nonce)
+}
+
+// idTokenClaims are the ID token claims checked or used at login
+type idTokenClaims struct {
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Name              string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// verify checks an ID token's signature, issuer, audience, expiry and nonce
+// (OpenID Connect Core section 3.1.3.7)
+func (p *Provider) verify(ctx context.Context, md *metadata, rawIDToken, nonce string) (*IDToken, error) {
+	claims := &idTokenClaims{}
+	_, err := jwt.ParseWithClaims(rawIDToken, claims,
+		func(token *jwt.Token) (interface{}, error) {
+			kid, _ := token.Header["kid"].(string)
+			return p.key(ctx, md, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(md.Issuer),
+		jwt.WithAudience(p.config.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.config.ClientID {
+		return nil, errors.New("invalid id token: issued to another client")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid id token: no subject")
+	}
+
+	return &IDToken{
+		Issuer:            claims.Issuer,
+		Subject:           claims.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+		Name:              claims.Name,
+	}, nil
+}
+
+// discover fetches and caches the provider's discovery document. Failures
+// aren't cached, so a provider that was down is retried on the next login.
+func (p *Provider) discover(ctx context.Context) (*metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	wellKnown := strings.TrimSuffix(p.config.IssuerURL, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	md := &metadata{}
+	status, err := p.fetch(req, md)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("discovery: %s returned status %d", wellKnown, status)
+	}
+
+	// The issuer must match exactly, or ID tokens of another provider could
+	// be passed off as this one's
+	if md.Issuer != p.config.IssuerURL {
+		return nil, fmt.Errorf("discovery: issuer %q does not match OIDC_ISSUER_URL %q", md.Issuer, p.config.IssuerURL)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.JWKSURI == "" {
+		return nil, errors.New("discovery: authorization_endpoint, token_endpoint and jwks_uri are required")
+	}
+
+	p.metadata = md
+	return md, nil
+}
+
+// key returns the provider's public key with ID kid, fetching the key set
+// again when the key isn't known yet, e.g. after the provider rotated keys
+func (p *Provider) key(ctx context.Context, md *metadata, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < keyRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, md.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set jwkSet
+	status, err := p.fetch(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("fetching keys: %s returned status %d", md.JWKSURI, status)
+	}
+
+	p.keys = set.publicKeys()
+	p.keysFetched = time.Now()
+
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookup finds a cached key. Tokens without a key ID are accepted when the
+// provider publishes a single key. The caller must hold mu.
+func (p *Provider) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// fetch sends a request and decodes the JSON response into v, whatever the
+// status, so error responses can be reported
+func (p *Provider) fetch(req *http.Request, v interface{}) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("decoding %s: %w", req.URL, err)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,177 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"chatapp/oidc"
+	"chatapp/oidc/oidctest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const redirectURL = "https://chat.example.com/api/auth/oidc/callback"
+
+// newProvider starts an identity provider and returns a client of it
+func newProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+
+	idp := oidctest.NewServer("chat", "client-secret")
+	t.Cleanup(idp.Close)
+	idp.SetIdentity(oidctest.Identity{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane"})
+
+	return idp, oidc.New(oidc.Config{
+		IssuerURL:    idp.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"openid", "email", "profile"},
+	})
+}
+
+// login runs a login at the provider and exchanges its code with the given
+// verifier and nonce
+func login(t *testing.T, idp *oidctest.Server, provider *oidc.Provider, verifier, nonce string) (*oidc.IDToken, error) {
+	t.Helper()
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	callback, err := idp.Login(authURL)
+	if err != nil {
+		t.Fatalf("logging in at the provider: %v", err)
+	}
+	return provider.Exchange(context.Background(), callback.Query().Get("code"), verifier, nonce)
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp, provider := newProvider(t)
+
+	authURL, err := provider.AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", authURL, err)
+	}
+	if endpoint := parsed.Scheme + "://" + parsed.Host + parsed.Path; endpoint != idp.URL+"/authorize" {
+		t.Errorf("authorization endpoint = %s, want the discovered %s/authorize", endpoint, idp.URL)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             "chat",
+		"redirect_uri":          redirectURL,
+		"scope":                 "openid email profile",
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        oidc.PKCEChallenge("the-verifier"),
+		"code_challenge_method": "S256",
+	}
+	query := parsed.Query()
+	for name, value := range want {
+		if query.Get(name) != value {
+			t.Errorf("%s = %q, want %q", name, query.Get(name), value)
+		}
+	}
+
+	callback, err := idp.Login(authURL)
+	if err != nil {
+		t.Fatalf("logging in at the provider: %v", err)
+	}
+	if callback.Query().Get("state") != "the-state" || callback.Query().Get("code") == "" {
+		t.Errorf("callback = %s, want a code and the state", callback)
+	}
+}
+
+func TestDiscoveryRequiresMatchingIssuer(t *testing.T) {
+	idp, _ := newProvider(t)
+
+	// The same provider, but configured under another spelling of its issuer
+	provider := oidc.New(oidc.Config{IssuerURL: idp.URL + "/", ClientID: idp.ClientID, RedirectURL: redirectURL})
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("AuthCodeURL with a mismatched issuer: got %v, want an issuer mismatch", err)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp, provider := newProvider(t)
+	idp.SetIdentity(oidctest.Identity{Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane", Name: "Jane Doe"})
+
+	idToken, err := login(t, idp, provider, "verifier", "nonce")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	want := oidc.IDToken{Issuer: idp.URL, Subject: "248289761001", Email: "jane@example.com", EmailVerified: true, PreferredUsername: "jane", Name: "Jane Doe"}
+	if *idToken != want {
+		t.Errorf("ID token = %+v, want %+v", *idToken, want)
+	}
+}
+
+func TestExchangeChecksLoginBinding(t *testing.T) {
+	idp, provider := newProvider(t)
+
+	if _, err := login(t, idp, provider, "another-verifier", "nonce"); err == nil || !strings.Contains(err.Error(), "PKCE") {
+		t.Errorf("Exchange with the wrong PKCE verifier: got %v, want the provider to refuse it", err)
+	}
+	if _, err := login(t, idp, provider, "verifier", "another-nonce"); err == nil {
+		t.Error("Exchange with the wrong nonce succeeded")
+	}
+}
+
+func TestExchangeVerifiesSignature(t *testing.T) {
+	idp, provider := newProvider(t)
+
+	idp.Forge(true)
+	if _, err := login(t, idp, provider, "verifier", "nonce"); err == nil {
+		t.Error("Exchange of an ID token with a forged signature succeeded")
+	}
+}
+
+func TestExchangeLimitsKeyRefetches(t *testing.T) {
+	idp, provider := newProvider(t)
+
+	if _, err := login(t, idp, provider, "verifier", "nonce"); err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	// Keys are fetched again at most once a minute, so tokens naming unknown
+	// keys can't make the server hammer the provider
+	idp.RotateKey()
+	if _, err := login(t, idp, provider, "verifier", "nonce"); !errors.Is(err, oidc.ErrUnknownKey) {
+		t.Errorf("Exchange right after a key rotation: got %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestExchangeVerifiesClaims(t *testing.T) {
+	tests := map[string]func(claims jwt.MapClaims){
+		"issuer":   func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example.com" },
+		"audience": func(claims jwt.MapClaims) { claims["aud"] = "another-client" },
+		"authorized party": func(claims jwt.MapClaims) {
+			claims["aud"] = []string{"chat", "another-client"}
+			claims["azp"] = "another-client"
+		},
+		"expiry":           func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"missing expiry":   func(claims jwt.MapClaims) { delete(claims, "exp") },
+		"issued in future": func(claims jwt.MapClaims) { claims["iat"] = time.Now().Add(time.Hour).Unix() },
+		"missing nonce":    func(claims jwt.MapClaims) { delete(claims, "nonce") },
+		"missing subject":  func(claims jwt.MapClaims) { delete(claims, "sub") },
+	}
+	for name, tamper := range tests {
+		t.Run(name, func(t *testing.T) {
+			idp, provider := newProvider(t)
+			idp.Tamper(tamper)
+
+			if _, err := login(t, idp, provider, "verifier", "nonce"); err == nil {
+				t.Error("Exchange accepted the ID token")
+			}
+		})
+	}
+}
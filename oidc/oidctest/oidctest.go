@@ -0,0 +1,285 @@
+// Package oidctest provides an OpenID Connect identity provider for tests.
+// It serves discovery, authorization, token and key set endpoints, checks
+// the client credentials, redirect URI and PKCE verifier like a real
+// provider, and signs ID tokens for a configurable identity.
+package oidctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Identity is the account that signs in at the provider
+type Identity struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+	Name              string
+}
+
+// Server is a running identity provider. Its URL is the issuer.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+
+	mu       sync.Mutex
+	identity Identity
+	tamper   func(claims jwt.MapClaims)
+	forge    bool
+	key      *ecdsa.PrivateKey
+	keyID    string
+	keys     int
+	codes    map[string]authorization
+}
+
+// authorization is a pending authorization code
+type authorization struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+	identity    Identity
+}
+
+// NewServer starts a provider for the client with the given credentials.
+// The caller closes it when done.
+func NewServer(clientID, clientSecret string) *Server {
+	s := &Server{ClientID: clientID, ClientSecret: clientSecret, codes: make(map[string]authorization)}
+	s.RotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /authorize", s.authorize)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("GET /jwks", s.jwks)
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// SetIdentity chooses the account of the following logins
+func (s *Server) SetIdentity(identity Identity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.identity = identity
+}
+
+// Tamper edits the claims of every ID token issued from now on, e.g. to
+// test that a wrong audience is refused. nil stops tampering.
+func (s *Server) Tamper(fn func(claims jwt.MapClaims)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tamper = fn
+}
+
+// Forge makes the provider sign ID tokens with a key it doesn't publish,
+// under the published key's ID
+func (s *Server) Forge(forge bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.forge = forge
+}
+
+// RotateKey replaces the signing key with a new one under a new key ID
+func (s *Server) RotateKey() {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys++
+	s.key = key
+	s.keyID = fmt.Sprintf("key-%d", s.keys)
+}
+
+// Login plays the browser at the provider: it follows authURL, as returned
+// by the client, and returns the URL the provider redirects back to
+func (s *Server) Login(authURL string) (*url.URL, error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("authorization refused with status %d", resp.StatusCode)
+	}
+	return resp.Location()
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + "/authorize",
+		"token_endpoint":                        s.URL + "/token",
+		"jwks_uri":                              s.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// authorize signs the configured identity in at once and redirects back
+// with a code
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	switch {
+	case query.Get("client_id") != s.ClientID:
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	case err != nil || !redirectURI.IsAbs():
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	case query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "":
+		http.Error(w, "authorization code flow with S256 PKCE required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = authorization{
+		redirectURI: redirectURI.String(),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+		identity:    s.identity,
+	}
+	s.mu.Unlock()
+
+	callback := redirectURI.Query()
+	callback.Set("code", code)
+	callback.Set("state", query.Get("state"))
+	redirectURI.RawQuery = callback.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems a code for an ID token
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, _ := r.BasicAuth()
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != s.ClientID || clientSecret != s.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	// Codes work once, whether or not the exchange succeeds
+	s.mu.Lock()
+	code, ok := s.codes[r.PostFormValue("code")]
+	delete(s.codes, r.PostFormValue("code"))
+	s.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code" || !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case r.PostFormValue("redirect_uri") != code.redirectURI:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri mismatch"})
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	idToken, err := s.sign(code)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+// sign issues the ID token of an authorization
+func (s *Server) sign(code authorization) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":                s.URL,
+		"sub":                code.identity.Subject,
+		"aud":                s.ClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              code.nonce,
+		"email":              code.identity.Email,
+		"email_verified":     code.identity.EmailVerified,
+		"preferred_username": code.identity.PreferredUsername,
+		"name":               code.identity.Name,
+	}
+	if s.tamper != nil {
+		s.tamper(claims)
+	}
+
+	key := s.key
+	if s.forge {
+		forged, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		key = forged
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = s.keyID
+	return token.SignedString(key)
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	public := s.key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"kid": s.keyID,
+			"use": "sig",
+			"alg": "ES256",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// randomString returns a random URL-safe code
+func randomString() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(errors.New("oidctest: no randomness: " + err.Error()))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
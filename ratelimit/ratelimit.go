@@ -0,0 +1,122 @@
+// Package ratelimit implements token bucket rate limits for requests and
+// WebSocket frames
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket holding up to burst tokens that refills at burst
+// tokens per period. A nil Bucket allows everything. It is not safe for
+// concurrent use.
+type Bucket struct {
+	burst    float64
+	interval time.Duration // time to refill one token
+	tokens   float64
+	last     time.Time
+}
+
+// NewBucket returns a full bucket allowing burst takes per period, or nil
+// when burst is not positive
+func NewBucket(burst int, per time.Duration) *Bucket {
+	if burst <= 0 || per <= 0 {
+		return nil
+	}
+	return &Bucket{
+		burst:    float64(burst),
+		interval: per / time.Duration(burst),
+		tokens:   float64(burst),
+	}
+}
+
+// Take removes a token at now. When the bucket is empty it returns false and
+// how long until the next token is available.
+func (b *Bucket) Take(now time.Time) (bool, time.Duration) {
+	if b == nil {
+		return true, 0
+	}
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) * float64(b.interval))
+}
+
+// refill adds the tokens earned since the last take
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += float64(now.Sub(b.last)) / float64(b.interval)
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// full reports whether the bucket will have refilled completely by now
+func (b *Bucket) full(now time.Time) bool {
+	return b.tokens+float64(now.Sub(b.last))/float64(b.interval) >= b.burst
+}
+
+// Limiter keeps a Bucket per key, such as a client IP or a username. A nil
+// Limiter allows everything. It is safe for concurrent use.
+type Limiter struct {
+	burst int
+	per   time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*Bucket
+	lastSweep time.Time
+}
+
+// New returns a limiter allowing burst requests per period for each key, or
+// nil when burst is not positive
+func New(burst int, per time.Duration) *Limiter {
+	if burst <= 0 || per <= 0 {
+		return nil
+	}
+	return &Limiter{
+		burst:   burst,
+		per:     per,
+		buckets: make(map[string]*Bucket),
+	}
+}
+
+// Allow takes a token from key's bucket. When it is empty Allow returns
+// false and how long until the key may try again.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = NewBucket(l.burst, l.per)
+		l.buckets[key] = bucket
+	}
+	return bucket.Take(now)
+}
+
+// sweep forgets buckets that have refilled completely, at most once per
+// period, so idle keys don't accumulate
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.per {
+		return
+	}
+	l.lastSweep = now
+
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
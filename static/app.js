@@ -2,10 +2,17 @@ class ChatApp {
     constructor() {
         this.ws = null;
         this.username = '';
+        this.userId = '';
         this.token = '';
         this.reconnectAttempts = 0;
         this.maxReconnectAttempts = 5;
         this.reconnectInterval = 3000;
+        this.roomId = 1;
+        this.oldestMessageId = null;
+        this.newestMessageId = null;
+        this.hasMoreHistory = true;
+        this.loadingHistory = false;
+        this.passwordLogin = true;
         
         this.initializeElements();
         this.setupEventListeners();
@@ -31,6 +38,8 @@ class ChatApp {
             showLogin: document.getElementById('showLogin'),
             authTitle: document.getElementById('authTitle'),
             authError: document.getElementById('authError'),
+            ssoLogin: document.getElementById('ssoLogin'),
+            ssoBtn: document.getElementById('ssoBtn'),
             usernameDisplay: document.getElementById('username-display'),
             logoutBtn: document.getElementById('logout-btn'),
             userCount: document.getElementById('userCount')
@@ -49,6 +58,9 @@ class ChatApp {
 
         this.elements.loginBtn.addEventListener('click', () => this.login());
         this.elements.registerBtn.addEventListener('click', () => this.register());
+        this.elements.ssoBtn.addEventListener('click', () => {
+            window.location.href = '/api/auth/oidc/login';
+        });
         
         this.elements.showRegister.addEventListener('click', (e) => {
             e.preventDefault();
@@ -62,6 +74,12 @@ class ChatApp {
 
         this.elements.logoutBtn.addEventListener('click', () => this.logout());
 
+        this.elements.messages.addEventListener('scroll', () => {
+            if (this.elements.messages.scrollTop < 50) {
+                this.loadOlderMessages();
+            }
+        });
+
         this.elements.loginPassword.addEventListener('keypress', (e) => {
             if (e.key === 'Enter') {
                 e.preventDefault();
@@ -86,21 +104,77 @@ class ChatApp {
     }
 
     checkAuth() {
+        this.loadAuthMethods();
+        if (this.handleSSORedirect()) {
+            return;
+        }
+
         const token = localStorage.getItem('token');
         const username = localStorage.getItem('username');
         
         if (token && username) {
             this.token = token;
             this.username = username;
+            this.userId = localStorage.getItem('userId') || '';
             this.elements.usernameDisplay.textContent = username;
             this.elements.logoutBtn.style.display = 'inline-block';
             this.hideAuthModal();
             this.connect();
+            this.loadNotifications();
         } else {
             this.showAuthModal();
         }
     }
 
+    // Shows the ways of signing in the server offers
+    async loadAuthMethods() {
+        try {
+            const response = await fetch('/api/auth/methods');
+            if (!response.ok) {
+                return;
+            }
+            const methods = await response.json();
+            this.passwordLogin = methods.password;
+            this.elements.ssoLogin.style.display = methods.oidc ? 'block' : 'none';
+            if (!this.passwordLogin) {
+                this.elements.loginForm.style.display = 'none';
+                this.elements.registerForm.style.display = 'none';
+            }
+        } catch (error) {
+            console.error('Failed to load sign-in methods:', error);
+        }
+    }
+
+    // Picks up the result of a single sign-on login, which the server hands
+    // over in the URL fragment. Returns true when there was one.
+    handleSSORedirect() {
+        const params = new URLSearchParams(window.location.hash.slice(1));
+        if (!params.has('token') && !params.has('mfa_token') && !params.has('sso_error')) {
+            return false;
+        }
+        // Keep the tokens out of the history and the address bar
+        history.replaceState(null, '', window.location.pathname + window.location.search);
+
+        if (params.has('token')) {
+            this.handleAuthSuccess({
+                token: params.get('token'),
+                expires_at: params.get('expires_at'),
+                refresh_token: params.get('refresh_token'),
+                username: params.get('username'),
+                user_id: params.get('user_id')
+            });
+            return true;
+        }
+
+        this.showAuthModal();
+        if (params.has('mfa_token')) {
+            this.loginMFA(params.get('mfa_token')).catch((error) => this.showError(error.message));
+        } else {
+            this.showError(params.get('sso_error'));
+        }
+        return true;
+    }
+
     showAuthModal() {
         this.elements.authModal.classList.add('show');
         this.showLoginForm();
@@ -111,7 +185,7 @@ class ChatApp {
     }
 
     showLoginForm() {
-        this.elements.loginForm.style.display = 'block';
+        this.elements.loginForm.style.display = this.passwordLogin ? 'block' : 'none';
         this.elements.registerForm.style.display = 'none';
         this.elements.authTitle.textContent = 'Login';
         this.elements.authError.textContent = '';
@@ -150,12 +224,40 @@ class ChatApp {
             }
 
             const data = await response.json();
+            if (data.mfa_required) {
+                await this.loginMFA(data.mfa_token);
+                return;
+            }
             this.handleAuthSuccess(data);
         } catch (error) {
             this.showError(error.message);
         }
     }
 
+    // Second login step for accounts with two-factor authentication
+    async loginMFA(mfaToken) {
+        const code = prompt('Enter the code from your authenticator app, or a recovery code');
+        if (!code) {
+            throw new Error('Login cancelled');
+        }
+
+        const response = await fetch('/api/login/mfa', {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ mfa_token: mfaToken, code: code.trim() })
+        });
+
+        if (!response.ok) {
+            const error = await response.text();
+            throw new Error(error || 'Login failed');
+        }
+
+        const data = await response.json();
+        this.handleAuthSuccess(data);
+    }
+
     async register() {
         const username = this.elements.registerUsername.value.trim();
         const email = this.elements.registerEmail.value.trim();
@@ -193,29 +295,117 @@ class ChatApp {
     }
 
     handleAuthSuccess(data) {
-        this.token = data.token;
+        this.storeTokens(data);
         this.username = data.username;
-        
-        localStorage.setItem('token', data.token);
+        this.userId = data.user_id;
         localStorage.setItem('username', data.username);
+        localStorage.setItem('userId', data.user_id);
         
         this.elements.usernameDisplay.textContent = data.username;
         this.elements.logoutBtn.style.display = 'inline-block';
         this.hideAuthModal();
         this.connect();
+        this.loadNotifications();
+    }
+
+    storeTokens(data) {
+        this.token = data.token;
+        localStorage.setItem('token', data.token);
+        localStorage.setItem('refreshToken', data.refresh_token);
+        localStorage.setItem('tokenExpiresAt', String(new Date(data.expires_at).getTime()));
+    }
+
+    tokenExpiresSoon() {
+        const expiresAt = Number(localStorage.getItem('tokenExpiresAt'));
+        return !expiresAt || Date.now() > expiresAt - 30000;
+    }
+
+    async refreshAccessToken() {
+        const refreshToken = localStorage.getItem('refreshToken');
+        if (!refreshToken) {
+            return false;
+        }
+
+        try {
+            const response = await fetch('/api/token/refresh', {
+                method: 'POST',
+                headers: {
+                    'Content-Type': 'application/json'
+                },
+                body: JSON.stringify({ refresh_token: refreshToken })
+            });
+
+            if (!response.ok) {
+                return false;
+            }
+
+            this.storeTokens(await response.json());
+            return true;
+        } catch (error) {
+            console.error('Error refreshing token:', error);
+            return false;
+        }
+    }
+
+    async ensureFreshToken() {
+        if (!this.tokenExpiresSoon()) {
+            return true;
+        }
+        return this.refreshAccessToken();
+    }
+
+    async authFetch(url, options = {}) {
+        await this.ensureFreshToken();
+
+        const withAuth = () => fetch(url, {
+            ...options,
+            headers: { ...(options.headers || {}), 'Authorization': `Bearer ${this.token}` }
+        });
+
+        let response = await withAuth();
+        if (response.status === 401 && await this.refreshAccessToken()) {
+            response = await withAuth();
+        }
+        return response;
     }
 
-    logout() {
+    async logout() {
+        const refreshToken = localStorage.getItem('refreshToken');
+        if (this.token || refreshToken) {
+            try {
+                await fetch('/api/logout', {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json',
+                        'Authorization': `Bearer ${this.token}`
+                    },
+                    body: JSON.stringify({ refresh_token: refreshToken || '' })
+                });
+            } catch (error) {
+                console.error('Error logging out:', error);
+            }
+        }
+        this.clearSession();
+    }
+
+    clearSession() {
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
+        localStorage.removeItem('tokenExpiresAt');
         localStorage.removeItem('username');
+        localStorage.removeItem('userId');
         
         this.disconnect();
         this.token = '';
         this.username = '';
+        this.userId = '';
         
         this.elements.usernameDisplay.textContent = '';
         this.elements.logoutBtn.style.display = 'none';
         this.elements.messages.innerHTML = '';
+        this.oldestMessageId = null;
+        this.newestMessageId = null;
+        this.hasMoreHistory = true;
         
         this.showAuthModal();
     }
@@ -224,18 +414,25 @@ class ChatApp {
         this.elements.authError.textContent = message;
     }
 
-    connect() {
+    async connect() {
         if (this.ws && this.ws.readyState === WebSocket.OPEN) {
             return;
         }
 
         this.showConnectionStatus('connecting', 'Connecting...');
+
+        if (!await this.ensureFreshToken()) {
+            this.clearSession();
+            return;
+        }
         
         const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-        const wsUrl = `${protocol}//${window.location.host}/ws?token=${encodeURIComponent(this.token)}`;
+        // After a reconnect only the messages missed since the newest one are replayed
+        const since = this.newestMessageId ? `&since=${this.newestMessageId}` : '';
+        const wsUrl = `${protocol}//${window.location.host}/ws?token=${encodeURIComponent(this.token)}${since}`;
         
         try {
-            this.ws = new WebSocket(wsUrl);
+            this.ws = new WebSocket(wsUrl, 'chat.v1');
             this.setupWebSocketEvents();
         } catch (error) {
             console.error('WebSocket connection error:', error);
@@ -254,13 +451,16 @@ class ChatApp {
             setTimeout(() => this.hideConnectionStatus(), 2000);
         };
 
+        // Every frame is one chat.v1 envelope: an event, or the ack or
+        // error answering one of our requests
         this.ws.onmessage = (event) => {
             try {
-                const messages = event.data.split('\n').filter(msg => msg.trim());
-                messages.forEach(msgStr => {
-                    const message = JSON.parse(msgStr);
-                    this.displayMessage(message);
-                });
+                const envelope = JSON.parse(event.data);
+                if (envelope.op === 'event') {
+                    this.displayMessage(envelope.payload);
+                } else if (envelope.op === 'error') {
+                    this.displayMessage({ type: 'system', content: envelope.payload.message });
+                }
             } catch (error) {
                 console.error('Error parsing message:', error);
             }
@@ -272,7 +472,32 @@ class ChatApp {
             this.elements.messageInput.disabled = true;
             this.elements.sendButton.disabled = true;
             
-            if (!event.wasClean) {
+            // 1008 (policy violation) means the session was revoked
+            if (event.code === 1008) {
+                this.clearSession();
+                return;
+            }
+
+            // 4003 means the user left or was removed from the room
+            if (event.code === 4003) {
+                this.showConnectionStatus('disconnected', 'Removed from room');
+                return;
+            }
+
+            // 4004 means the room was deleted
+            if (event.code === 4004) {
+                this.showConnectionStatus('disconnected', 'Room deleted');
+                return;
+            }
+
+            // 4029 means messages were sent too fast for too long
+            if (event.code === 4029) {
+                this.showConnectionStatus('disconnected', 'Disconnected for sending too fast');
+                return;
+            }
+
+            // 1012 (service restart) is sent during a graceful server shutdown
+            if (!event.wasClean || event.code === 1012) {
                 this.attemptReconnect();
             }
         };
@@ -304,6 +529,12 @@ class ChatApp {
         }, this.reconnectInterval);
     }
 
+    // request sends a chat.v1 request envelope with a fresh request ID
+    request(op, payload) {
+        this.requestId = (this.requestId || 0) + 1;
+        this.ws.send(JSON.stringify({ v: 1, op, id: String(this.requestId), payload }));
+    }
+
     disconnect() {
         if (this.ws) {
             this.ws.close();
@@ -323,14 +554,8 @@ class ChatApp {
             return;
         }
 
-        const message = {
-            type: 'text',
-            content: content,
-            username: this.username
-        };
-
         try {
-            this.ws.send(JSON.stringify(message));
+            this.request('text', { room_id: this.roomId, content: content });
             this.elements.messageInput.value = '';
             this.elements.messageInput.focus();
         } catch (error) {
@@ -340,17 +565,381 @@ class ChatApp {
     }
 
     displayMessage(message) {
+        // The connection can be subscribed to several rooms; only this one is shown
+        if (message.room_id && message.room_id !== this.roomId) {
+            return;
+        }
+        if (message.type === 'subscribed') {
+            return;
+        }
+        if (message.type === 'notification') {
+            this.showNotification(message.notification);
+            return;
+        }
+        if (message.type === 'history_gap') {
+            this.reloadHistory();
+            return;
+        }
+        if (message.type === 'text' && message.id) {
+            // A message can arrive both live and in a replay
+            if (this.findMessageElement(message.id)) {
+                return;
+            }
+            this.trackNewestMessage(message);
+        }
+        if (message.type === 'unsubscribed') {
+            this.showConnectionStatus('disconnected', message.content === 'room deleted' ? 'Room deleted' : 'Removed from room');
+            this.elements.messageInput.disabled = true;
+            this.elements.sendButton.disabled = true;
+            return;
+        }
+        if (message.type === 'message_edited') {
+            this.applyEdit(message);
+            return;
+        }
+        if (message.type === 'message_deleted') {
+            this.applyDelete(message);
+            return;
+        }
+        if (message.type === 'message_reactions') {
+            this.applyReactions(message);
+            return;
+        }
+        if (message.type === 'thread_updated') {
+            this.applyThreadSummary(message);
+            return;
+        }
+        if (message.type === 'room_updated') {
+            this.applyRoomUpdate(message.room);
+            return;
+        }
+        if (message.type === 'message_pinned' || message.type === 'message_unpinned') {
+            this.applyPin(message);
+            return;
+        }
+        if (message.type === 'text' && message.parent_message_id) {
+            this.appendReply(message);
+            return;
+        }
+
+        const messageDiv = this.createMessageElement(message);
+        this.trackOldestMessage(message);
+
+        this.elements.messages.appendChild(messageDiv);
+        this.scrollToBottom();
+        
+        this.updateUserCount(message);
+    }
+
+    async loadNotifications() {
+        try {
+            const response = await this.authFetch('/api/notifications?unread=true');
+            if (!response.ok) {
+                return;
+            }
+            const notifications = await response.json();
+            notifications.reverse().forEach(notification => this.showNotification(notification));
+        } catch (error) {
+            console.error('Error loading notifications:', error);
+        }
+    }
+
+    showNotification(notification) {
+        this.displayMessage({ type: 'system', content: notification.content, timestamp: notification.created_at });
+        this.authFetch(`/api/notifications/${notification.id}/read`, { method: 'POST' })
+            .catch(error => console.error('Error marking notification read:', error));
+    }
+
+    trackNewestMessage(message) {
+        if (!this.newestMessageId || message.id > this.newestMessageId) {
+            this.newestMessageId = message.id;
+        }
+    }
+
+    trackOldestMessage(message) {
+        if (message.type === 'text' && message.id && (!this.oldestMessageId || message.id < this.oldestMessageId)) {
+            this.oldestMessageId = message.id;
+        }
+    }
+
+    editMessage(messageId) {
+        const messageDiv = this.findMessageElement(messageId);
+        const current = messageDiv ? messageDiv.querySelector('.message-content').textContent : '';
+        const content = prompt('Edit message', current);
+
+        if (content === null || !content.trim() || content === current) {
+            return;
+        }
+
+        if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+            alert('Not connected to chat server');
+            return;
+        }
+
+        this.request('edit', { id: messageId, content: content.trim() });
+    }
+
+    applyEdit(message) {
+        const messageDiv = this.findMessageElement(message.id);
+        if (!messageDiv) {
+            return;
+        }
+
+        messageDiv.querySelector('.message-content').textContent = message.content;
+        messageDiv.querySelector('.edited').hidden = false;
+    }
+
+    deleteMessage(messageId) {
+        if (!confirm('Delete this message?')) {
+            return;
+        }
+
+        if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+            alert('Not connected to chat server');
+            return;
+        }
+
+        this.request('delete', { id: messageId });
+    }
+
+    applyDelete(message) {
+        const messageDiv = this.findMessageElement(message.id);
+        // A resuming client can be sent a deletion it already applied
+        if (!messageDiv || messageDiv.classList.contains('deleted')) {
+            return;
+        }
+
+        messageDiv.classList.add('deleted');
+        messageDiv.querySelector('.message-content').textContent = 'This message was deleted';
+        messageDiv.querySelector('.message-meta').remove();
+        messageDiv.querySelector('.reactions').remove();
+    }
+
+    applyRoomUpdate(room) {
+        // Archived rooms are read-only
+        this.elements.messageInput.disabled = room.archived;
+        this.elements.sendButton.disabled = room.archived;
+
+        const notice = room.archived ? `${room.name} was archived` : `${room.name} was updated`;
+        const messageDiv = this.createMessageElement({ type: 'system', content: room.topic ? `${notice} · ${room.topic}` : notice, timestamp: new Date() });
+        this.elements.messages.appendChild(messageDiv);
+        this.scrollToBottom();
+    }
+
+    applyPin(message) {
+        const messageDiv = this.findMessageElement(message.id);
+        const marker = messageDiv && messageDiv.querySelector('.pinned');
+        if (marker) {
+            marker.hidden = message.type !== 'message_pinned';
+        }
+    }
+
+    promptReaction(messageId) {
+        const emoji = prompt('React with an emoji');
+        if (emoji && emoji.trim()) {
+            this.sendReaction(messageId, emoji.trim(), true);
+        }
+    }
+
+    sendReaction(messageId, emoji, add) {
+        if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+            alert('Not connected to chat server');
+            return;
+        }
+
+        this.request(add ? 'react' : 'unreact', { id: messageId, emoji });
+    }
+
+    applyReactions(message) {
+        const messageDiv = this.findMessageElement(message.id);
+        if (messageDiv) {
+            this.renderReactions(messageDiv, message.id, message.reactions);
+        }
+    }
+
+    renderReactions(messageDiv, messageId, reactions) {
+        const container = messageDiv.querySelector('.reactions');
+        if (!container) {
+            return;
+        }
+
+        container.innerHTML = '';
+        (reactions || []).forEach(reaction => {
+            const mine = reaction.user_ids.includes(this.userId);
+            const chip = document.createElement('button');
+            chip.className = mine ? 'reaction mine' : 'reaction';
+            chip.textContent = `${reaction.emoji} ${reaction.count}`;
+            chip.addEventListener('click', () => this.sendReaction(messageId, reaction.emoji, !mine));
+            container.appendChild(chip);
+        });
+    }
+
+    replyToMessage(messageId) {
+        const content = prompt('Reply in thread');
+        if (content === null || !content.trim()) {
+            return;
+        }
+
+        if (!this.ws || this.ws.readyState !== WebSocket.OPEN) {
+            alert('Not connected to chat server');
+            return;
+        }
+
+        this.request('text', { room_id: this.roomId, content: content.trim(), parent_message_id: messageId });
+    }
+
+    async toggleThread(messageId) {
+        const messageDiv = this.findMessageElement(messageId);
+        if (!messageDiv) {
+            return;
+        }
+
+        const container = messageDiv.querySelector('.thread');
+        if (!container.hidden) {
+            container.hidden = true;
+            return;
+        }
+
+        try {
+            const response = await this.authFetch(`/api/messages/${messageId}/thread?limit=50`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            const thread = await response.json();
+            container.innerHTML = '';
+            thread.replies.forEach(reply => container.appendChild(this.createMessageElement(reply)));
+            container.hidden = false;
+        } catch (error) {
+            console.error('Error loading thread:', error);
+        }
+    }
+
+    appendReply(message) {
+        const parentDiv = this.findMessageElement(message.parent_message_id);
+        const container = parentDiv && parentDiv.querySelector('.thread');
+        if (container && !container.hidden) {
+            container.appendChild(this.createMessageElement(message));
+        }
+    }
+
+    applyThreadSummary(message) {
+        const messageDiv = this.findMessageElement(message.id);
+        if (!messageDiv) {
+            return;
+        }
+
+        const summary = messageDiv.querySelector('.thread-summary');
+        summary.hidden = !message.reply_count;
+        summary.textContent = this.threadSummaryText(message);
+    }
+
+    threadSummaryText(message) {
+        if (!message.reply_count) {
+            return '';
+        }
+        const replies = message.reply_count === 1 ? '1 reply' : `${message.reply_count} replies`;
+        return `${replies} · last ${this.formatTimestamp(message.last_reply_at)}`;
+    }
+
+    findMessageElement(messageId) {
+        return this.elements.messages.querySelector(`[data-message-id="${messageId}"]`);
+    }
+
+    // reloadHistory replaces the shown messages with the latest page, for
+    // when too many were missed while disconnected to be replayed
+    async reloadHistory() {
+        try {
+            const response = await this.authFetch(`/api/rooms/${this.roomId}/messages?limit=50`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            const page = await response.json();
+            this.elements.messages.innerHTML = '';
+            this.oldestMessageId = null;
+            this.hasMoreHistory = page.has_more;
+            page.messages.forEach(message => {
+                this.elements.messages.appendChild(this.createMessageElement(message));
+                this.trackOldestMessage(message);
+                this.trackNewestMessage(message);
+            });
+            this.scrollToBottom();
+        } catch (error) {
+            console.error('Error reloading history:', error);
+        }
+    }
+
+    async loadOlderMessages() {
+        if (this.loadingHistory || !this.hasMoreHistory || !this.oldestMessageId) {
+            return;
+        }
+
+        this.loadingHistory = true;
+        try {
+            const response = await this.authFetch(`/api/rooms/${this.roomId}/messages?before=${this.oldestMessageId}&limit=50`);
+            if (!response.ok) {
+                throw new Error(await response.text());
+            }
+
+            const page = await response.json();
+            this.hasMoreHistory = page.has_more;
+
+            // Prepend while keeping the visible messages where they are
+            const container = this.elements.messages;
+            const previousHeight = container.scrollHeight;
+            const fragment = document.createDocumentFragment();
+            page.messages.forEach(message => {
+                fragment.appendChild(this.createMessageElement(message));
+                this.trackOldestMessage(message);
+            });
+            container.insertBefore(fragment, container.firstChild);
+            container.scrollTop += container.scrollHeight - previousHeight;
+        } catch (error) {
+            console.error('Error loading older messages:', error);
+        } finally {
+            this.loadingHistory = false;
+        }
+    }
+
+    createMessageElement(message) {
         const messageDiv = document.createElement('div');
         messageDiv.className = `message ${message.type}`;
         
         if (message.type === 'text') {
+            const own = message.user_id === this.userId;
+            messageDiv.dataset.messageId = message.id;
             messageDiv.innerHTML = `
                 <div class="message-header">
                     <span class="username">${this.escapeHtml(message.username)}</span>
                     <span class="timestamp">${this.formatTimestamp(message.timestamp)}</span>
                 </div>
                 <div class="message-content">${this.escapeHtml(message.content)}</div>
+                <div class="message-meta">
+                    <span class="pinned"${message.pinned_at ? '' : ' hidden'}>📌 pinned</span>
+                    <span class="edited"${message.edited_at ? '' : ' hidden'}>(edited)</span>
+                    ${own ? '<button class="message-action edit-btn">Edit</button>' : ''}
+                    ${own ? '<button class="message-action delete-btn">Delete</button>' : ''}
+                    <button class="message-action react-btn">React</button>
+                    ${message.parent_message_id ? '' : '<button class="message-action reply-btn">Reply</button>'}
+                </div>
+                <div class="reactions"></div>
+                ${message.parent_message_id ? '' : `
+                <button class="message-action thread-summary"${message.reply_count ? '' : ' hidden'}>${this.threadSummaryText(message)}</button>
+                <div class="thread" hidden></div>`}
             `;
+
+            messageDiv.querySelector('.react-btn').addEventListener('click', () => this.promptReaction(message.id));
+            if (!message.parent_message_id) {
+                messageDiv.querySelector('.reply-btn').addEventListener('click', () => this.replyToMessage(message.id));
+                messageDiv.querySelector('.thread-summary').addEventListener('click', () => this.toggleThread(message.id));
+            }
+            this.renderReactions(messageDiv, message.id, message.reactions);
+
+            if (own) {
+                messageDiv.querySelector('.edit-btn').addEventListener('click', () => this.editMessage(message.id));
+                messageDiv.querySelector('.delete-btn').addEventListener('click', () => this.deleteMessage(message.id));
+            }
         } else {
             messageDiv.innerHTML = `
                 <div class="message-content">${this.escapeHtml(message.content)}</div>
@@ -358,10 +947,7 @@ class ChatApp {
             `;
         }
 
-        this.elements.messages.appendChild(messageDiv);
-        this.scrollToBottom();
-        
-        this.updateUserCount(message);
+        return messageDiv;
     }
 
     updateUserCount(message) {
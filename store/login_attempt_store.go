@@ -0,0 +1,85 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"chatapp/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrLoginAttemptNotFound = errors.New("no failed logins recorded")
+
+// GormLoginAttemptStore tracks failed logins in the database
+type GormLoginAttemptStore struct {
+	db *gorm.DB
+}
+
+// NewGormLoginAttemptStore creates a new database-backed login attempt store
+func NewGormLoginAttemptStore(db *gorm.DB) *GormLoginAttemptStore {
+	return &GormLoginAttemptStore{db: db}
+}
+
+// GetLoginAttempt retrieves the failed logins recorded for a key
+func (s *GormLoginAttemptStore) GetLoginAttempt(key string) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	result := s.db.Where("attempt_key = ?", key).First(&attempt)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrLoginAttemptNotFound
+		}
+		return nil, result.Error
+	}
+
+	return &attempt, nil
+}
+
+// RecordLoginFailure counts a failed login for a key. Failures before since
+// are forgotten, so the count starts over after a quiet period.
+func (s *GormLoginAttemptStore) RecordLoginFailure(key string, since time.Time) (*models.LoginAttempt, error) {
+	var attempt models.LoginAttempt
+	now := time.Now()
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// Make sure the row exists, then count the failure in one statement
+		// so concurrent failures are all counted
+		err := tx.Clauses(clause.OnConflict{DoNothing: true}).
+			Create(&models.LoginAttempt{Key: key, LastFailedAt: now}).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Exec("UPDATE login_attempts SET failures = CASE WHEN last_failed_at < ? THEN 1 ELSE failures + 1 END, last_failed_at = ? WHERE attempt_key = ?",
+			since, now, key).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("attempt_key = ?", key).First(&attempt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// LockLogin refuses logins for a key until the given time
+func (s *GormLoginAttemptStore) LockLogin(key string, until time.Time) error {
+	return s.db.Model(&models.LoginAttempt{}).
+		Where("attempt_key = ?", key).
+		Update("locked_until", until).Error
+}
+
+// ClearLoginAttempts forgets a key's failed logins and lifts its lock
+func (s *GormLoginAttemptStore) ClearLoginAttempts(key string) error {
+	return s.db.Where("attempt_key = ?", key).Delete(&models.LoginAttempt{}).Error
+}
+
+// PurgeLoginAttempts removes keys whose last failure and lock both ended before the given time
+func (s *GormLoginAttemptStore) PurgeLoginAttempts(before time.Time) error {
+	return s.db.Where("last_failed_at < ? AND (locked_until IS NULL OR locked_until < ?)", before, before).
+		Delete(&models.LoginAttempt{}).Error
+}
@@ -0,0 +1,1322 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"chatapp/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MemoryUserStore keeps users in memory. It is intended for tests and
+// throwaway development servers; everything is lost on restart.
+type MemoryUserStore struct {
+	mu            sync.RWMutex
+	users         map[string]*models.User // username -> user
+	recoveryCodes []models.RecoveryCode
+	identities    map[[2]string]string // issuer, subject -> user ID
+}
+
+// NewMemoryUserStore creates a new in-memory user store
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:      make(map[string]*models.User),
+		identities: make(map[[2]string]string),
+	}
+}
+
+// CreateUser creates a new user
+func (s *MemoryUserStore) CreateUser(username, email, passwordHash string) (*models.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.users[username]; exists {
+		return nil, ErrUserExists
+	}
+	for _, user := range s.users {
+		if user.Email == email {
+			return nil, ErrEmailExists
+		}
+	}
+
+	user := &models.User{
+		ID:           uuid.New().String(),
+		Username:     username,
+		Email:        email,
+		PasswordHash: passwordHash,
+		CreatedAt:    time.Now(),
+	}
+
+	s.users[username] = user
+	return user, nil
+}
+
+// GetUser retrieves a user by username
+func (s *MemoryUserStore) GetUser(username string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, exists := s.users[username]
+	if !exists {
+		return nil, ErrUserNotFound
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+// GetUserByID retrieves a user by ID
+func (s *MemoryUserStore) GetUserByID(userID string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if user := s.userByID(userID); user != nil {
+		copied := *user
+		return &copied, nil
+	}
+
+	return nil, ErrUserNotFound
+}
+
+// userByID finds a user by ID. The caller must hold mu.
+func (s *MemoryUserStore) userByID(userID string) *models.User {
+	for _, user := range s.users {
+		if user.ID == userID {
+			return user
+		}
+	}
+	return nil
+}
+
+// SetTOTPSecret starts TOTP enrollment with a new secret. Two-factor
+// authentication stays off until EnableTOTP.
+func (s *MemoryUserStore) SetTOTPSecret(userID, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	user.TOTPSecret = secret
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication with the enrolled secret and
+// replaces the user's recovery codes
+func (s *MemoryUserStore) EnableTOTP(userID string, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	now := time.Now()
+	user.TOTPEnabledAt = &now
+
+	s.removeRecoveryCodes(userID)
+	for _, hash := range recoveryCodeHashes {
+		s.recoveryCodes = append(s.recoveryCodes, models.RecoveryCode{UserID: userID, CodeHash: hash, CreatedAt: now})
+	}
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication and drops the secret and
+// recovery codes
+func (s *MemoryUserStore) DisableTOTP(userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	user.TOTPSecret = ""
+	user.TOTPEnabledAt = nil
+	user.TOTPLastStep = 0
+
+	s.removeRecoveryCodes(userID)
+	return nil
+}
+
+// removeRecoveryCodes drops a user's recovery codes. The caller must hold mu.
+func (s *MemoryUserStore) removeRecoveryCodes(userID string) {
+	kept := s.recoveryCodes[:0]
+	for _, code := range s.recoveryCodes {
+		if code.UserID != userID {
+			kept = append(kept, code)
+		}
+	}
+	s.recoveryCodes = kept
+}
+
+// UseTOTPStep records that the code of a time step was used. Only one
+// caller can use a step, and never an earlier one: ErrCodeUsed is returned
+// for replays.
+func (s *MemoryUserStore) UseTOTPStep(userID string, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user := s.userByID(userID)
+	if user == nil {
+		return ErrUserNotFound
+	}
+	if user.TOTPLastStep >= step {
+		return ErrCodeUsed
+	}
+	user.TOTPLastStep = step
+	return nil
+}
+
+// UseRecoveryCode spends one of the user's recovery codes. ErrInvalidCode is
+// returned for unknown or already used codes.
+func (s *MemoryUserStore) UseRecoveryCode(userID, codeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.recoveryCodes {
+		code := &s.recoveryCodes[i]
+		if code.UserID == userID && code.CodeHash == codeHash && code.UsedAt == nil {
+			now := time.Now()
+			code.UsedAt = &now
+			return nil
+		}
+	}
+	return ErrInvalidCode
+}
+
+// GetUserByEmail retrieves a user by email address
+func (s *MemoryUserStore) GetUserByEmail(email string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			copied := *user
+			return &copied, nil
+		}
+	}
+
+	return nil, ErrUserNotFound
+}
+
+// GetUserByIdentity retrieves the user linked to a single sign-on account
+func (s *MemoryUserStore) GetUserByIdentity(issuer, subject string) (*models.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userID, linked := s.identities[[2]string{issuer, subject}]
+	if !linked {
+		return nil, ErrUserNotFound
+	}
+	if user := s.userByID(userID); user != nil {
+		copied := *user
+		return &copied, nil
+	}
+
+	return nil, ErrUserNotFound
+}
+
+// LinkIdentity links a single sign-on account to a user. ErrIdentityLinked
+// is returned when the account is already linked, to this user or another.
+func (s *MemoryUserStore) LinkIdentity(userID, issuer, subject string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := [2]string{issuer, subject}
+	if _, linked := s.identities[key]; linked {
+		return ErrIdentityLinked
+	}
+	s.identities[key] = userID
+	return nil
+}
+
+// MemoryRoomStore keeps rooms in memory
+type MemoryRoomStore struct {
+	roomSubscriptions
+	roomsMu     sync.RWMutex
+	rooms       map[uint]*models.Room
+	members     []models.RoomMember
+	invitations []models.RoomInvitation
+	bans        []models.RoomBan
+	nextID      uint
+}
+
+// NewMemoryRoomStore creates a new in-memory room store
+func NewMemoryRoomStore() *MemoryRoomStore {
+	return &MemoryRoomStore{
+		roomSubscriptions: newRoomSubscriptions(),
+		rooms:             make(map[uint]*models.Room),
+		nextID:            1,
+	}
+}
+
+// CreateRoom creates a new room. When creatorID is set the creator is
+// recorded and becomes the room's first member and its owner.
+func (s *MemoryRoomStore) CreateRoom(name string, visibility models.RoomVisibility, creatorID string) (*models.Room, error) {
+	s.roomsMu.Lock()
+	for _, room := range s.rooms {
+		if room.Name == name {
+			s.roomsMu.Unlock()
+			return nil, ErrRoomExists
+		}
+	}
+
+	now := time.Now()
+	room := &models.Room{
+		ID:         s.nextID,
+		Name:       name,
+		Type:       models.ChannelRoom,
+		Visibility: visibility,
+		CreatedBy:  creatorID,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	s.rooms[room.ID] = room
+	s.nextID++
+	if creatorID != "" {
+		s.members = append(s.members, models.RoomMember{RoomID: room.ID, UserID: creatorID, Role: models.OwnerRole, CreatedAt: room.CreatedAt})
+	}
+	s.roomsMu.Unlock()
+
+	s.ensureRoom(room.ID)
+	copied := *room
+	return &copied, nil
+}
+
+// GetRoom retrieves a room by ID
+func (s *MemoryRoomStore) GetRoom(roomID uint) (*models.Room, error) {
+	s.roomsMu.RLock()
+	room, exists := s.rooms[roomID]
+	s.roomsMu.RUnlock()
+	if !exists {
+		return nil, ErrRoomNotFound
+	}
+
+	s.ensureRoom(roomID)
+	copied := *room
+	return &copied, nil
+}
+
+// GetAllRooms retrieves all public rooms ordered by ID
+func (s *MemoryRoomStore) GetAllRooms() ([]models.Room, error) {
+	s.roomsMu.RLock()
+	rooms := make([]models.Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		if room.Type == models.ChannelRoom && room.Visibility == models.PublicRoom {
+			rooms = append(rooms, *room)
+		}
+	}
+	s.roomsMu.RUnlock()
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms, nil
+}
+
+// UpdateRoom saves a room's name, topic, description and archived flag
+func (s *MemoryRoomStore) UpdateRoom(room *models.Room) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	existing, exists := s.rooms[room.ID]
+	if !exists {
+		return ErrRoomNotFound
+	}
+	for _, other := range s.rooms {
+		if other.ID != room.ID && other.Name == room.Name {
+			return ErrRoomExists
+		}
+	}
+
+	room.UpdatedAt = time.Now()
+	existing.Name = room.Name
+	existing.Topic = room.Topic
+	existing.Description = room.Description
+	existing.Archived = room.Archived
+	existing.UpdatedAt = room.UpdatedAt
+	return nil
+}
+
+// DeleteRoom deletes a room along with its memberships, invitations and
+// bans. The room's messages are removed by MessageStore.DeleteRoomMessages.
+func (s *MemoryRoomStore) DeleteRoom(roomID uint) error {
+	s.roomsMu.Lock()
+	if _, exists := s.rooms[roomID]; !exists {
+		s.roomsMu.Unlock()
+		return ErrRoomNotFound
+	}
+	delete(s.rooms, roomID)
+
+	members := s.members[:0]
+	for _, member := range s.members {
+		if member.RoomID != roomID {
+			members = append(members, member)
+		}
+	}
+	s.members = members
+
+	invitations := s.invitations[:0]
+	for _, invitation := range s.invitations {
+		if invitation.RoomID != roomID {
+			invitations = append(invitations, invitation)
+		}
+	}
+	s.invitations = invitations
+
+	bans := s.bans[:0]
+	for _, ban := range s.bans {
+		if ban.RoomID != roomID {
+			bans = append(bans, ban)
+		}
+	}
+	s.bans = bans
+	s.roomsMu.Unlock()
+
+	s.forgetRoom(roomID)
+	return nil
+}
+
+// CreateDirectRoom returns the direct message room between two users,
+// creating it with both users as members the first time
+func (s *MemoryRoomStore) CreateDirectRoom(userID, otherUserID string) (*models.Room, error) {
+	name := directRoomName(userID, otherUserID)
+
+	s.roomsMu.Lock()
+	var room *models.Room
+	for _, existing := range s.rooms {
+		if existing.Name == name {
+			room = existing
+			break
+		}
+	}
+	if room == nil {
+		now := time.Now()
+		room = &models.Room{ID: s.nextID, Name: name, Type: models.DirectRoom, Visibility: models.PrivateRoom, CreatedBy: userID, CreatedAt: now, UpdatedAt: now}
+		s.rooms[room.ID] = room
+		s.nextID++
+		s.members = append(s.members,
+			models.RoomMember{RoomID: room.ID, UserID: userID, Role: models.MemberRole, CreatedAt: now},
+			models.RoomMember{RoomID: room.ID, UserID: otherUserID, Role: models.MemberRole, CreatedAt: now})
+	}
+	copied := *room
+	s.roomsMu.Unlock()
+
+	s.ensureRoom(copied.ID)
+	return &copied, nil
+}
+
+// GetUserRooms retrieves the rooms of the given type a user is a member of
+func (s *MemoryRoomStore) GetUserRooms(userID string, roomType models.RoomType) ([]models.Room, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	rooms := make([]models.Room, 0)
+	for _, member := range s.members {
+		if room := s.rooms[member.RoomID]; member.UserID == userID && room.Type == roomType {
+			rooms = append(rooms, *room)
+		}
+	}
+
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].ID < rooms[j].ID })
+	return rooms, nil
+}
+
+// GetRoomMembers retrieves the members of a room
+func (s *MemoryRoomStore) GetRoomMembers(roomID uint) ([]models.RoomMember, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	var members []models.RoomMember
+	for _, member := range s.members {
+		if member.RoomID == roomID {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+// IsRoomMember reports whether a user is a member of a room
+func (s *MemoryRoomStore) IsRoomMember(roomID uint, userID string) (bool, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	return s.memberIndex(roomID, userID) >= 0, nil
+}
+
+// AddRoomMember makes a user a member of a room
+func (s *MemoryRoomStore) AddRoomMember(roomID uint, userID string) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	if s.memberIndex(roomID, userID) >= 0 {
+		return ErrAlreadyRoomMember
+	}
+	s.members = append(s.members, models.RoomMember{RoomID: roomID, UserID: userID, Role: models.MemberRole, CreatedAt: time.Now()})
+	return nil
+}
+
+// RemoveRoomMember removes a user from a room
+func (s *MemoryRoomStore) RemoveRoomMember(roomID uint, userID string) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	index := s.memberIndex(roomID, userID)
+	if index < 0 {
+		return ErrNotRoomMember
+	}
+	s.members = append(s.members[:index], s.members[index+1:]...)
+	return nil
+}
+
+// memberIndex returns the slice index of a membership, or -1. Callers hold roomsMu.
+func (s *MemoryRoomStore) memberIndex(roomID uint, userID string) int {
+	for i, member := range s.members {
+		if member.RoomID == roomID && member.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// CreateInvitation invites a user to a room. Inviting someone who declined
+// an earlier invitation reopens it.
+func (s *MemoryRoomStore) CreateInvitation(roomID uint, userID, invitedBy string) (*models.RoomInvitation, error) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	invitation := models.RoomInvitation{
+		RoomID:    roomID,
+		UserID:    userID,
+		InvitedBy: invitedBy,
+		Status:    models.InvitationPending,
+		CreatedAt: time.Now(),
+	}
+	for i := range s.invitations {
+		if s.invitations[i].RoomID == roomID && s.invitations[i].UserID == userID {
+			invitation.ID = s.invitations[i].ID
+			s.invitations[i] = invitation
+			return &invitation, nil
+		}
+	}
+
+	invitation.ID = uint(len(s.invitations) + 1)
+	s.invitations = append(s.invitations, invitation)
+	return &invitation, nil
+}
+
+// GetInvitation retrieves an invitation by ID
+func (s *MemoryRoomStore) GetInvitation(invitationID uint) (*models.RoomInvitation, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	for _, invitation := range s.invitations {
+		if invitation.ID == invitationID {
+			return &invitation, nil
+		}
+	}
+	return nil, ErrInvitationNotFound
+}
+
+// GetPendingInvitations retrieves the invitations a user hasn't answered yet
+func (s *MemoryRoomStore) GetPendingInvitations(userID string) ([]models.RoomInvitation, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	var invitations []models.RoomInvitation
+	for _, invitation := range s.invitations {
+		if invitation.UserID == userID && invitation.Status == models.InvitationPending {
+			invitations = append(invitations, invitation)
+		}
+	}
+	return invitations, nil
+}
+
+// RespondToInvitation accepts or declines a pending invitation. Accepting
+// makes the invited user a member of the room.
+func (s *MemoryRoomStore) RespondToInvitation(invitationID uint, accept bool) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	for i := range s.invitations {
+		invitation := &s.invitations[i]
+		if invitation.ID != invitationID || invitation.Status != models.InvitationPending {
+			continue
+		}
+
+		now := time.Now()
+		invitation.RespondedAt = &now
+		invitation.Status = models.InvitationDeclined
+		if accept {
+			invitation.Status = models.InvitationAccepted
+			if s.memberIndex(invitation.RoomID, invitation.UserID) < 0 {
+				s.members = append(s.members, models.RoomMember{RoomID: invitation.RoomID, UserID: invitation.UserID, Role: models.MemberRole, CreatedAt: now})
+			}
+		}
+		return nil
+	}
+	return ErrInvitationNotFound
+}
+
+// GetRoomRole retrieves a member's role in a room
+func (s *MemoryRoomStore) GetRoomRole(roomID uint, userID string) (models.RoomRole, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	index := s.memberIndex(roomID, userID)
+	if index < 0 {
+		return "", ErrNotRoomMember
+	}
+	return s.members[index].Role, nil
+}
+
+// SetRoomRole changes a member's role in a room
+func (s *MemoryRoomStore) SetRoomRole(roomID uint, userID string, role models.RoomRole) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	index := s.memberIndex(roomID, userID)
+	if index < 0 {
+		return ErrNotRoomMember
+	}
+	s.members[index].Role = role
+	return nil
+}
+
+// BanUser bans a user from a room, ending their membership and declining
+// any pending invitation
+func (s *MemoryRoomStore) BanUser(roomID uint, userID, bannedBy, reason string) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	if s.banIndex(roomID, userID) >= 0 {
+		return ErrAlreadyBanned
+	}
+
+	now := time.Now()
+	s.bans = append(s.bans, models.RoomBan{
+		RoomID:    roomID,
+		UserID:    userID,
+		BannedBy:  bannedBy,
+		Reason:    reason,
+		CreatedAt: now,
+	})
+	if index := s.memberIndex(roomID, userID); index >= 0 {
+		s.members = append(s.members[:index], s.members[index+1:]...)
+	}
+	for i := range s.invitations {
+		invitation := &s.invitations[i]
+		if invitation.RoomID == roomID && invitation.UserID == userID && invitation.Status == models.InvitationPending {
+			invitation.Status = models.InvitationDeclined
+			invitation.RespondedAt = &now
+		}
+	}
+	return nil
+}
+
+// UnbanUser lifts a user's ban from a room
+func (s *MemoryRoomStore) UnbanUser(roomID uint, userID string) error {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	index := s.banIndex(roomID, userID)
+	if index < 0 {
+		return ErrNotBanned
+	}
+	s.bans = append(s.bans[:index], s.bans[index+1:]...)
+	return nil
+}
+
+// IsBanned reports whether a user is banned from a room
+func (s *MemoryRoomStore) IsBanned(roomID uint, userID string) (bool, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	return s.banIndex(roomID, userID) >= 0, nil
+}
+
+// GetBans retrieves the users banned from a room
+func (s *MemoryRoomStore) GetBans(roomID uint) ([]models.RoomBan, error) {
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+
+	var bans []models.RoomBan
+	for _, ban := range s.bans {
+		if ban.RoomID == roomID {
+			bans = append(bans, ban)
+		}
+	}
+	return bans, nil
+}
+
+// banIndex returns the slice index of a ban, or -1. Callers hold roomsMu.
+func (s *MemoryRoomStore) banIndex(roomID uint, userID string) int {
+	for i, ban := range s.bans {
+		if ban.RoomID == roomID && ban.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// MemoryMessageStore keeps messages in memory
+type MemoryMessageStore struct {
+	mu        sync.RWMutex
+	messages  []models.Message
+	revisions []models.MessageRevision
+	reactions []models.Reaction
+	nextID    uint
+}
+
+// NewMemoryMessageStore creates a new in-memory message store
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{nextID: 1}
+}
+
+// Save stores a message, assigning it an ID
+func (s *MemoryMessageStore) Save(message *models.Message) error {
+	// Only persist text messages, not typing indicators or ephemeral messages
+	if message.Type != models.TextMessage {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	message.ID = s.nextID
+	s.nextID++
+	if message.Timestamp.IsZero() {
+		message.Timestamp = time.Now()
+	}
+	s.messages = append(s.messages, *message)
+
+	// A reply also bumps the reply summary on its parent
+	if message.ParentMessageID != nil {
+		if index := s.indexOf(*message.ParentMessageID); index >= 0 {
+			lastReplyAt := message.Timestamp
+			s.messages[index].ReplyCount++
+			s.messages[index].LastReplyAt = &lastReplyAt
+			s.messages[index].ChangedAt = &lastReplyAt
+		}
+	}
+	return nil
+}
+
+// GetByID retrieves a stored message
+func (s *MemoryMessageStore) GetByID(messageID uint) (*models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if index := s.indexOf(messageID); index >= 0 {
+		message := s.messages[index]
+		return &message, nil
+	}
+	return nil, ErrMessageNotFound
+}
+
+// Edit replaces a message's content, keeping the previous content as a revision
+func (s *MemoryMessageStore) Edit(messageID uint, content string) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexOf(messageID)
+	if index < 0 {
+		return nil, ErrMessageNotFound
+	}
+
+	now := time.Now()
+	message := &s.messages[index]
+	s.revisions = append(s.revisions, models.MessageRevision{
+		ID:        uint(len(s.revisions) + 1),
+		MessageID: messageID,
+		Content:   message.Content,
+		CreatedAt: now,
+	})
+	message.Content = content
+	message.EditedAt = &now
+	message.ChangedAt = &now
+
+	edited := *message
+	return &edited, nil
+}
+
+// GetRevisions returns a message's previous contents, oldest first
+func (s *MemoryMessageStore) GetRevisions(messageID uint) ([]models.MessageRevision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var revisions []models.MessageRevision
+	for _, revision := range s.revisions {
+		if revision.MessageID == messageID {
+			revisions = append(revisions, revision)
+		}
+	}
+	return revisions, nil
+}
+
+// Delete soft-deletes a message
+func (s *MemoryMessageStore) Delete(messageID uint) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexOf(messageID)
+	if index < 0 {
+		return nil, ErrMessageNotFound
+	}
+
+	now := time.Now()
+	message := &s.messages[index]
+	message.DeletedAt = gorm.DeletedAt{Time: now, Valid: true}
+	message.ChangedAt = &now
+	deleted := *message
+
+	if message.ParentMessageID != nil {
+		if parent := s.indexOf(*message.ParentMessageID); parent >= 0 && s.messages[parent].ReplyCount > 0 {
+			s.messages[parent].ReplyCount--
+			s.messages[parent].ChangedAt = &now
+		}
+	}
+	return &deleted, nil
+}
+
+// PurgeDeleted permanently removes messages soft-deleted before the given time
+func (s *MemoryMessageStore) PurgeDeleted(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := func(message models.Message) bool {
+		return message.DeletedAt.Valid && message.DeletedAt.Time.Before(before)
+	}
+
+	// Thread parents stay while a reply remains, so it never points at a
+	// missing parent
+	parents := make(map[uint]bool)
+	for _, message := range s.messages {
+		if message.ParentMessageID != nil && !expired(message) {
+			parents[*message.ParentMessageID] = true
+		}
+	}
+
+	purgedIDs := make(map[uint]bool)
+	kept := s.messages[:0]
+	for _, message := range s.messages {
+		if expired(message) && !parents[message.ID] {
+			purgedIDs[message.ID] = true
+			continue
+		}
+		kept = append(kept, message)
+	}
+	s.messages = kept
+
+	revisions := s.revisions[:0]
+	for _, revision := range s.revisions {
+		if !purgedIDs[revision.MessageID] {
+			revisions = append(revisions, revision)
+		}
+	}
+	s.revisions = revisions
+
+	reactions := s.reactions[:0]
+	for _, reaction := range s.reactions {
+		if !purgedIDs[reaction.MessageID] {
+			reactions = append(reactions, reaction)
+		}
+	}
+	s.reactions = reactions
+
+	return int64(len(purgedIDs)), nil
+}
+
+// DeleteRoomMessages permanently removes every message of a room, deleted
+// or not, along with their revisions and reactions
+func (s *MemoryMessageStore) DeleteRoomMessages(roomID uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removedIDs := make(map[uint]bool)
+	kept := s.messages[:0]
+	for _, message := range s.messages {
+		if message.RoomID == roomID {
+			removedIDs[message.ID] = true
+			continue
+		}
+		kept = append(kept, message)
+	}
+	s.messages = kept
+
+	revisions := s.revisions[:0]
+	for _, revision := range s.revisions {
+		if !removedIDs[revision.MessageID] {
+			revisions = append(revisions, revision)
+		}
+	}
+	s.revisions = revisions
+
+	reactions := s.reactions[:0]
+	for _, reaction := range s.reactions {
+		if !removedIDs[reaction.MessageID] {
+			reactions = append(reactions, reaction)
+		}
+	}
+	s.reactions = reactions
+
+	return nil
+}
+
+// AddReaction records a user's reaction; reacting twice with the same emoji is a no-op
+func (s *MemoryMessageStore) AddReaction(messageID uint, userID, emoji string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, reaction := range s.reactions {
+		if reaction.MessageID == messageID && reaction.UserID == userID && reaction.Emoji == emoji {
+			return nil
+		}
+	}
+	now := time.Now()
+	s.reactions = append(s.reactions, models.Reaction{
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji:     emoji,
+		CreatedAt: now,
+	})
+	s.touch(messageID, now)
+	return nil
+}
+
+// RemoveReaction removes a user's reaction, if present
+func (s *MemoryMessageStore) RemoveReaction(messageID uint, userID, emoji string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, reaction := range s.reactions {
+		if reaction.MessageID == messageID && reaction.UserID == userID && reaction.Emoji == emoji {
+			s.reactions = append(s.reactions[:i], s.reactions[i+1:]...)
+			s.touch(messageID, time.Now())
+			return nil
+		}
+	}
+	return nil
+}
+
+// touch records that a message changed, deleted or not. Callers hold mu.
+func (s *MemoryMessageStore) touch(messageID uint, at time.Time) {
+	for i := range s.messages {
+		if s.messages[i].ID == messageID {
+			s.messages[i].ChangedAt = &at
+			return
+		}
+	}
+}
+
+// GetReactions returns a message's reactions aggregated by emoji
+func (s *MemoryMessageStore) GetReactions(messageID uint) ([]models.ReactionCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return countReactions(s.reactions)[messageID], nil
+}
+
+// Pin marks a message as pinned to its room
+func (s *MemoryMessageStore) Pin(messageID uint, pinnedBy string) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexOf(messageID)
+	if index < 0 {
+		return nil, ErrMessageNotFound
+	}
+
+	now := time.Now()
+	message := &s.messages[index]
+	message.PinnedAt = &now
+	message.PinnedBy = pinnedBy
+	message.ChangedAt = &now
+
+	pinned := *message
+	return &pinned, nil
+}
+
+// Unpin removes a message from its room's pins
+func (s *MemoryMessageStore) Unpin(messageID uint) (*models.Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index := s.indexOf(messageID)
+	if index < 0 {
+		return nil, ErrMessageNotFound
+	}
+
+	now := time.Now()
+	message := &s.messages[index]
+	message.PinnedAt = nil
+	message.PinnedBy = ""
+	message.ChangedAt = &now
+
+	unpinned := *message
+	return &unpinned, nil
+}
+
+// GetPinned retrieves a room's pinned messages, most recently pinned first
+func (s *MemoryMessageStore) GetPinned(roomID uint) ([]models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := make([]models.Message, 0)
+	for _, message := range s.messages {
+		if message.RoomID == roomID && message.PinnedAt != nil && !message.DeletedAt.Valid {
+			messages = append(messages, message)
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].PinnedAt.After(*messages[j].PinnedAt) })
+	s.attachReactions(messages)
+	return messages, nil
+}
+
+// indexOf returns the slice index of a message that hasn't been deleted,
+// or -1. Callers hold mu.
+func (s *MemoryMessageStore) indexOf(messageID uint) int {
+	for i := range s.messages {
+		if s.messages[i].ID == messageID && !s.messages[i].DeletedAt.Valid {
+			return i
+		}
+	}
+	return -1
+}
+
+// GetByRoom retrieves a page of a room's top-level messages, and replies with
+// WithReplies, in chronological order
+func (s *MemoryMessageStore) GetByRoom(roomID uint, query MessageQuery) ([]models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.page(query, func(message models.Message) bool {
+		return message.RoomID == roomID && (message.ParentMessageID == nil || query.WithReplies)
+	}), nil
+}
+
+// GetThread retrieves a page of the replies to a message
+func (s *MemoryMessageStore) GetThread(parentID uint, query MessageQuery) ([]models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.page(query, func(message models.Message) bool {
+		return message.ParentMessageID != nil && *message.ParentMessageID == parentID
+	}), nil
+}
+
+// GetChangedSince retrieves up to limit of a room's messages, up to and
+// including messageID and deleted ones too, that changed after messageID was
+// sent, in chronological order
+func (s *MemoryMessageStore) GetChangedSince(roomID, messageID uint, limit int) ([]models.Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var since *models.Message
+	for i := range s.messages {
+		if s.messages[i].ID == messageID && s.messages[i].RoomID == roomID {
+			since = &s.messages[i]
+			break
+		}
+	}
+	if since == nil {
+		return nil, ErrMessageNotFound
+	}
+
+	messages := make([]models.Message, 0)
+	for i := 0; i < len(s.messages) && len(messages) < limit; i++ {
+		message := s.messages[i]
+		if message.RoomID == roomID && message.ID <= messageID &&
+			message.ChangedAt != nil && !message.ChangedAt.Before(since.Timestamp) {
+			messages = append(messages, message)
+		}
+	}
+	s.attachReactions(messages)
+	return messages, nil
+}
+
+// page returns the messages selected by include and the query's cursors and
+// limit, in chronological order. Callers hold mu.
+func (s *MemoryMessageStore) page(query MessageQuery, include func(models.Message) bool) []models.Message {
+	matches := func(message models.Message) bool {
+		return include(message) && !message.DeletedAt.Valid &&
+			(query.BeforeID == 0 || message.ID < query.BeforeID) &&
+			(query.AfterID == 0 || message.ID > query.AfterID)
+	}
+
+	messages := make([]models.Message, 0, query.Limit)
+	if query.AfterID > 0 {
+		for i := 0; i < len(s.messages) && len(messages) < query.Limit; i++ {
+			if matches(s.messages[i]) {
+				messages = append(messages, s.messages[i])
+			}
+		}
+		s.attachReactions(messages)
+		return messages
+	}
+
+	for i := len(s.messages) - 1; i >= 0 && len(messages) < query.Limit; i-- {
+		if matches(s.messages[i]) {
+			messages = append(messages, s.messages[i])
+		}
+	}
+	reverseMessages(messages)
+	s.attachReactions(messages)
+	return messages
+}
+
+// attachReactions fills in the reactions of a page of messages. Callers hold mu.
+func (s *MemoryMessageStore) attachReactions(messages []models.Message) {
+	counts := countReactions(s.reactions)
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+	}
+}
+
+// MemoryTokenStore keeps refresh tokens and revoked sessions in memory
+type MemoryTokenStore struct {
+	mu       sync.Mutex
+	tokens   map[string]*models.RefreshToken // token hash -> token
+	sessions map[string]time.Time            // revoked session ID -> expiry
+}
+
+// NewMemoryTokenStore creates a new in-memory token store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		tokens:   make(map[string]*models.RefreshToken),
+		sessions: make(map[string]time.Time),
+	}
+}
+
+// CreateRefreshToken stores a newly issued refresh token
+func (s *MemoryTokenStore) CreateRefreshToken(token *models.RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token.CreatedAt.IsZero() {
+		token.CreatedAt = time.Now()
+	}
+	copied := *token
+	s.tokens[token.TokenHash] = &copied
+	return nil
+}
+
+// GetRefreshToken retrieves a refresh token by the hash of its value
+func (s *MemoryTokenStore) GetRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, exists := s.tokens[tokenHash]
+	if !exists {
+		return nil, ErrTokenNotFound
+	}
+	copied := *token
+	return &copied, nil
+}
+
+// RevokeRefreshToken marks a refresh token as used
+func (s *MemoryTokenStore) RevokeRefreshToken(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if token.ID == id {
+			if token.RevokedAt != nil {
+				return ErrTokenRevoked
+			}
+			now := time.Now()
+			token.RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// RevokeSession revokes every refresh token of a session and its access tokens
+func (s *MemoryTokenStore) RevokeSession(sessionID string, accessExpiry time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, token := range s.tokens {
+		if token.SessionID == sessionID && token.RevokedAt == nil {
+			token.RevokedAt = &now
+		}
+	}
+	s.sessions[sessionID] = accessExpiry
+	return nil
+}
+
+// IsSessionRevoked reports whether access tokens of a session are revoked
+func (s *MemoryTokenStore) IsSessionRevoked(sessionID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, exists := s.sessions[sessionID]
+	return exists && expiry.After(time.Now()), nil
+}
+
+// PurgeExpired removes refresh tokens and revoked sessions that expired before now
+func (s *MemoryTokenStore) PurgeExpired(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hash, token := range s.tokens {
+		if token.ExpiresAt.Before(now) {
+			delete(s.tokens, hash)
+		}
+	}
+	for sessionID, expiry := range s.sessions {
+		if expiry.Before(now) {
+			delete(s.sessions, sessionID)
+		}
+	}
+	return nil
+}
+
+// MemoryLoginAttemptStore keeps failed login counts in memory
+type MemoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]*models.LoginAttempt // key -> attempt
+}
+
+// NewMemoryLoginAttemptStore creates a new in-memory login attempt store
+func NewMemoryLoginAttemptStore() *MemoryLoginAttemptStore {
+	return &MemoryLoginAttemptStore{
+		attempts: make(map[string]*models.LoginAttempt),
+	}
+}
+
+// GetLoginAttempt retrieves the failed logins recorded for a key
+func (s *MemoryLoginAttemptStore) GetLoginAttempt(key string) (*models.LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt, exists := s.attempts[key]
+	if !exists {
+		return nil, ErrLoginAttemptNotFound
+	}
+	copied := *attempt
+	return &copied, nil
+}
+
+// RecordLoginFailure counts a failed login for a key. Failures before since
+// are forgotten, so the count starts over after a quiet period.
+func (s *MemoryLoginAttemptStore) RecordLoginFailure(key string, since time.Time) (*models.LoginAttempt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt, exists := s.attempts[key]
+	if !exists {
+		attempt = &models.LoginAttempt{Key: key}
+		s.attempts[key] = attempt
+	}
+	if attempt.LastFailedAt.Before(since) {
+		attempt.Failures = 0
+	}
+	attempt.Failures++
+	attempt.LastFailedAt = time.Now()
+
+	copied := *attempt
+	return &copied, nil
+}
+
+// LockLogin refuses logins for a key until the given time
+func (s *MemoryLoginAttemptStore) LockLogin(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempt, exists := s.attempts[key]; exists {
+		attempt.LockedUntil = &until
+	}
+	return nil
+}
+
+// ClearLoginAttempts forgets a key's failed logins and lifts its lock
+func (s *MemoryLoginAttemptStore) ClearLoginAttempts(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+// PurgeLoginAttempts removes keys whose last failure and lock both ended before the given time
+func (s *MemoryLoginAttemptStore) PurgeLoginAttempts(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, attempt := range s.attempts {
+		if attempt.LastFailedAt.Before(before) && (attempt.LockedUntil == nil || attempt.LockedUntil.Before(before)) {
+			delete(s.attempts, key)
+		}
+	}
+	return nil
+}
+
+// MemoryNotificationStore keeps in-app notifications in memory
+type MemoryNotificationStore struct {
+	mu            sync.Mutex
+	notifications []models.Notification
+	nextID        uint
+}
+
+// NewMemoryNotificationStore creates a new in-memory notification store
+func NewMemoryNotificationStore() *MemoryNotificationStore {
+	return &MemoryNotificationStore{nextID: 1}
+}
+
+// CreateNotification stores a new notification
+func (s *MemoryNotificationStore) CreateNotification(notification *models.Notification) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notification.ID = s.nextID
+	s.nextID++
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	s.notifications = append(s.notifications, *notification)
+	return nil
+}
+
+// GetNotifications returns up to limit of a user's notifications, newest first
+func (s *MemoryNotificationStore) GetNotifications(userID string, unreadOnly bool, limit int) ([]models.Notification, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notifications := make([]models.Notification, 0)
+	for i := len(s.notifications) - 1; i >= 0 && len(notifications) < limit; i-- {
+		notification := s.notifications[i]
+		if notification.UserID != userID || (unreadOnly && notification.ReadAt != nil) {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, nil
+}
+
+// MarkNotificationRead marks one of a user's notifications as read. Marking
+// it again does nothing.
+func (s *MemoryNotificationStore) MarkNotificationRead(notificationID uint, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.notifications {
+		notification := &s.notifications[i]
+		if notification.ID != notificationID || notification.UserID != userID {
+			continue
+		}
+		if notification.ReadAt == nil {
+			now := time.Now()
+			notification.ReadAt = &now
+		}
+		return nil
+	}
+	return ErrNotificationNotFound
+}
@@ -1,45 +1,414 @@
 package store
 
 import (
-	"chatapp/database"
+	"errors"
+	"time"
+
 	"chatapp/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-// MessageStore manages message persistence
-type MessageStore struct{}
+var ErrMessageNotFound = errors.New("message not found")
+
+// GormMessageStore manages message persistence in the database
+type GormMessageStore struct {
+	db *gorm.DB
+}
 
-// NewMessageStore creates a new message store
-func NewMessageStore() *MessageStore {
-	return &MessageStore{}
+// NewGormMessageStore creates a new database-backed message store
+func NewGormMessageStore(db *gorm.DB) *GormMessageStore {
+	return &GormMessageStore{db: db}
 }
 
 // Save persists a message to the database
-func (s *MessageStore) Save(message *models.Message) error {
+func (s *GormMessageStore) Save(message *models.Message) error {
 	// Only persist text messages, not typing indicators or ephemeral messages
 	if message.Type != models.TextMessage {
 		return nil
 	}
 
-	result := database.DB.Create(message)
-	return result.Error
+	// A reply also bumps the reply summary on its parent
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		if message.ParentMessageID == nil {
+			return nil
+		}
+		return tx.Model(&models.Message{}).Where("id = ?", *message.ParentMessageID).Updates(map[string]interface{}{
+			"reply_count":   gorm.Expr("reply_count + 1"),
+			"last_reply_at": message.Timestamp,
+			"changed_at":    message.Timestamp,
+		}).Error
+	})
+}
+
+// GetByID retrieves a persisted message
+func (s *GormMessageStore) GetByID(messageID uint) (*models.Message, error) {
+	var message models.Message
+	result := s.db.First(&message, messageID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, result.Error
+	}
+
+	return &message, nil
+}
+
+// Edit replaces a message's content, keeping the previous content as a revision
+func (s *GormMessageStore) Edit(messageID uint, content string) (*models.Message, error) {
+	var message models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&message, messageID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrMessageNotFound
+			}
+			return err
+		}
+
+		now := time.Now()
+		revision := models.MessageRevision{MessageID: message.ID, Content: message.Content, CreatedAt: now}
+		if err := tx.Create(&revision).Error; err != nil {
+			return err
+		}
+
+		message.Content = content
+		message.EditedAt = &now
+		message.ChangedAt = &now
+		return tx.Model(&message).Updates(map[string]interface{}{
+			"content":    content,
+			"edited_at":  now,
+			"changed_at": now,
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// GetRevisions returns a message's previous contents, oldest first
+func (s *GormMessageStore) GetRevisions(messageID uint) ([]models.MessageRevision, error) {
+	var revisions []models.MessageRevision
+	result := s.db.Where("message_id = ?", messageID).Order("id ASC").Find(&revisions)
+	return revisions, result.Error
+}
+
+// Delete soft-deletes a message. It disappears from history but stays in
+// the database until PurgeDeleted removes it.
+func (s *GormMessageStore) Delete(messageID uint) (*models.Message, error) {
+	var message models.Message
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&message, messageID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrMessageNotFound
+			}
+			return err
+		}
+
+		// Of concurrent deletes only the one that sets deleted_at goes on,
+		// so a reply is taken off its parent's count once
+		result := tx.Delete(&message)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected != 1 {
+			return ErrMessageNotFound
+		}
+
+		now := time.Now()
+		if err := touchMessage(tx, message.ID, now); err != nil {
+			return err
+		}
+		if message.ParentMessageID == nil {
+			return nil
+		}
+		return tx.Model(&models.Message{}).Where("id = ? AND reply_count > 0", *message.ParentMessageID).
+			Updates(map[string]interface{}{
+				"reply_count": gorm.Expr("reply_count - 1"),
+				"changed_at":  now,
+			}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// purgeableMessages selects messages deleted before a time. Thread parents
+// are kept while a reply remains that isn't purged with them, so the reply
+// never points at a missing parent.
+const purgeableMessages = `deleted_at < ? AND NOT EXISTS (
+	SELECT 1 FROM messages replies WHERE replies.parent_message_id = messages.id
+	AND (replies.deleted_at IS NULL OR replies.deleted_at >= ?))`
+
+// PurgeDeleted permanently removes messages soft-deleted before the given
+// time, along with their revisions. It returns the number of messages removed.
+func (s *GormMessageStore) PurgeDeleted(before time.Time) (int64, error) {
+	var purged int64
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		expired := tx.Unscoped().Model(&models.Message{}).Select("id").Where(purgeableMessages, before, before)
+		if err := tx.Where("message_id IN (?)", expired).Delete(&models.MessageRevision{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (?)", expired).Delete(&models.Reaction{}).Error; err != nil {
+			return err
+		}
+
+		result := tx.Unscoped().Where(purgeableMessages, before, before).Delete(&models.Message{})
+		purged = result.RowsAffected
+		return result.Error
+	})
+	return purged, err
+}
+
+// DeleteRoomMessages permanently removes every message of a room, deleted
+// or not, along with their revisions and reactions
+func (s *GormMessageStore) DeleteRoomMessages(roomID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		roomMessages := tx.Unscoped().Model(&models.Message{}).Select("id").Where("room_id = ?", roomID)
+		if err := tx.Where("message_id IN (?)", roomMessages).Delete(&models.MessageRevision{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (?)", roomMessages).Delete(&models.Reaction{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("room_id = ?", roomID).Delete(&models.Message{}).Error
+	})
+}
+
+// AddReaction records a user's reaction; reacting twice with the same emoji is a no-op
+func (s *GormMessageStore) AddReaction(messageID uint, userID, emoji string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		reaction := models.Reaction{MessageID: messageID, UserID: userID, Emoji: emoji}
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&reaction).Error; err != nil {
+			return err
+		}
+		return touchMessage(tx, messageID, time.Now())
+	})
+}
+
+// RemoveReaction removes a user's reaction, if present
+func (s *GormMessageStore) RemoveReaction(messageID uint, userID, emoji string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).
+			Delete(&models.Reaction{}).Error
+		if err != nil {
+			return err
+		}
+		return touchMessage(tx, messageID, time.Now())
+	})
+}
+
+// touchMessage records that a message changed, deleted or not
+func touchMessage(tx *gorm.DB, messageID uint, at time.Time) error {
+	return tx.Unscoped().Model(&models.Message{}).Where("id = ?", messageID).Update("changed_at", at).Error
+}
+
+// GetReactions returns a message's reactions aggregated by emoji
+func (s *GormMessageStore) GetReactions(messageID uint) ([]models.ReactionCount, error) {
+	var reactions []models.Reaction
+	result := s.db.Where("message_id = ?", messageID).Order("created_at ASC").Find(&reactions)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	return countReactions(reactions)[messageID], nil
+}
+
+// Pin marks a message as pinned to its room
+func (s *GormMessageStore) Pin(messageID uint, pinnedBy string) (*models.Message, error) {
+	message, err := s.GetByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	message.PinnedAt = &now
+	message.PinnedBy = pinnedBy
+	message.ChangedAt = &now
+	err = s.db.Model(message).Updates(map[string]interface{}{
+		"pinned_at":  now,
+		"pinned_by":  pinnedBy,
+		"changed_at": now,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
 }
 
-// GetByRoom retrieves messages for a specific room with a limit
-func (s *MessageStore) GetByRoom(roomID uint, limit int) ([]models.Message, error) {
+// Unpin removes a message from its room's pins
+func (s *GormMessageStore) Unpin(messageID uint) (*models.Message, error) {
+	message, err := s.GetByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	message.PinnedAt = nil
+	message.PinnedBy = ""
+	message.ChangedAt = &now
+	err = s.db.Model(message).Updates(map[string]interface{}{
+		"pinned_at":  nil,
+		"pinned_by":  "",
+		"changed_at": now,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// GetPinned retrieves a room's pinned messages, most recently pinned first
+func (s *GormMessageStore) GetPinned(roomID uint) ([]models.Message, error) {
 	var messages []models.Message
-	result := database.DB.Where("room_id = ? AND type = ?", roomID, models.TextMessage).
-		Order("timestamp DESC").
+	result := s.db.Where("room_id = ? AND pinned_at IS NOT NULL", roomID).
+		Order("pinned_at DESC").
+		Find(&messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if err := s.attachReactions(messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// attachReactions loads the reactions of a page of messages in one query
+func (s *GormMessageStore) attachReactions(messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(messages))
+	for i, message := range messages {
+		ids[i] = message.ID
+	}
+
+	var reactions []models.Reaction
+	result := s.db.Where("message_id IN ?", ids).Order("created_at ASC").Find(&reactions)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	counts := countReactions(reactions)
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+	}
+	return nil
+}
+
+// countReactions groups reactions by message and then by emoji, keeping
+// emojis in the order they were first used
+func countReactions(reactions []models.Reaction) map[uint][]models.ReactionCount {
+	counts := make(map[uint][]models.ReactionCount)
+	for _, reaction := range reactions {
+		emojis := counts[reaction.MessageID]
+		found := false
+		for i := range emojis {
+			if emojis[i].Emoji == reaction.Emoji {
+				emojis[i].Count++
+				emojis[i].UserIDs = append(emojis[i].UserIDs, reaction.UserID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			emojis = append(emojis, models.ReactionCount{Emoji: reaction.Emoji, Count: 1, UserIDs: []string{reaction.UserID}})
+		}
+		counts[reaction.MessageID] = emojis
+	}
+	return counts
+}
+
+// GetByRoom retrieves a page of a room's top-level messages; thread replies
+// are only returned by GetThread, or here with WithReplies
+func (s *GormMessageStore) GetByRoom(roomID uint, query MessageQuery) ([]models.Message, error) {
+	db := s.db.Where("room_id = ? AND type = ?", roomID, models.TextMessage)
+	if !query.WithReplies {
+		db = db.Where("parent_message_id IS NULL")
+	}
+	return s.page(db, query)
+}
+
+// GetThread retrieves a page of the replies to a message
+func (s *GormMessageStore) GetThread(parentID uint, query MessageQuery) ([]models.Message, error) {
+	db := s.db.Where("parent_message_id = ?", parentID)
+	return s.page(db, query)
+}
+
+// GetChangedSince retrieves up to limit of a room's messages, up to and
+// including messageID and deleted ones too, that changed after messageID was
+// sent, in chronological order with their reactions
+func (s *GormMessageStore) GetChangedSince(roomID, messageID uint, limit int) ([]models.Message, error) {
+	var since models.Message
+	if err := s.db.Unscoped().Where("room_id = ?", roomID).First(&since, messageID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+
+	var messages []models.Message
+	result := s.db.Unscoped().
+		Where("room_id = ? AND id <= ? AND changed_at >= ?", roomID, messageID, since.Timestamp).
+		Order("id ASC").
 		Limit(limit).
 		Find(&messages)
-	
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
-	// Reverse to get chronological order
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	if err := s.attachReactions(messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// page applies a MessageQuery's cursors and limit to db and returns the
+// matching messages in chronological order with their reactions
+func (s *GormMessageStore) page(db *gorm.DB, query MessageQuery) ([]models.Message, error) {
+	var messages []models.Message
+	if query.BeforeID > 0 {
+		db = db.Where("id < ?", query.BeforeID)
+	}
+	if query.AfterID > 0 {
+		db = db.Where("id > ?", query.AfterID)
 	}
 
+	// Order by ID rather than timestamp: IDs are assigned in insert order on
+	// every supported database and "timestamp" is a keyword in some dialects.
+	ascending := query.AfterID > 0
+	if ascending {
+		db = db.Order("id ASC")
+	} else {
+		db = db.Order("id DESC")
+	}
+
+	result := db.Limit(query.Limit).Find(&messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	if !ascending {
+		reverseMessages(messages)
+	}
+	if err := s.attachReactions(messages); err != nil {
+		return nil, err
+	}
 	return messages, nil
 }
+
+// reverseMessages flips newest-first query results into chronological order
+func reverseMessages(messages []models.Message) {
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+}
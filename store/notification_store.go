@@ -0,0 +1,59 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"chatapp/models"
+
+	"gorm.io/gorm"
+)
+
+var ErrNotificationNotFound = errors.New("notification not found")
+
+// GormNotificationStore manages in-app notifications in the database
+type GormNotificationStore struct {
+	db *gorm.DB
+}
+
+// NewGormNotificationStore creates a new database-backed notification store
+func NewGormNotificationStore(db *gorm.DB) *GormNotificationStore {
+	return &GormNotificationStore{db: db}
+}
+
+// CreateNotification stores a new notification
+func (s *GormNotificationStore) CreateNotification(notification *models.Notification) error {
+	return s.db.Create(notification).Error
+}
+
+// GetNotifications returns up to limit of a user's notifications, newest first
+func (s *GormNotificationStore) GetNotifications(userID string, unreadOnly bool, limit int) ([]models.Notification, error) {
+	query := s.db.Where("user_id = ?", userID)
+	if unreadOnly {
+		query = query.Where("read_at IS NULL")
+	}
+
+	notifications := make([]models.Notification, 0)
+	if err := query.Order("id DESC").Limit(limit).Find(&notifications).Error; err != nil {
+		return nil, err
+	}
+	return notifications, nil
+}
+
+// MarkNotificationRead marks one of a user's notifications as read. Marking
+// it again does nothing.
+func (s *GormNotificationStore) MarkNotificationRead(notificationID uint, userID string) error {
+	var notification models.Notification
+	result := s.db.Where("id = ? AND user_id = ?", notificationID, userID).First(&notification)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return ErrNotificationNotFound
+		}
+		return result.Error
+	}
+
+	if notification.ReadAt != nil {
+		return nil
+	}
+	return s.db.Model(&notification).Update("read_at", time.Now()).Error
+}
@@ -2,116 +2,385 @@ package store
 
 import (
 	"errors"
-	"sync"
+	"time"
 
-	"chatapp/database"
 	"chatapp/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
-	ErrRoomNotFound = errors.New("room not found")
-	ErrRoomExists   = errors.New("room already exists")
+	ErrRoomNotFound       = errors.New("room not found")
+	ErrRoomExists         = errors.New("room already exists")
+	ErrNotRoomMember      = errors.New("not a member of this room")
+	ErrAlreadyRoomMember  = errors.New("already a member of this room")
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrAlreadyBanned      = errors.New("user is already banned from this room")
+	ErrNotBanned          = errors.New("user is not banned from this room")
 )
 
-// RoomStore manages chat rooms and their subscriptions
-type RoomStore struct {
-	mu sync.RWMutex
-	// roomID -> map of clients
-	rooms map[uint]map[string]bool
+// GormRoomStore manages chat rooms in the database and their subscriptions
+type GormRoomStore struct {
+	roomSubscriptions
+	db *gorm.DB
 }
 
-// NewRoomStore creates a new room store
-func NewRoomStore() *RoomStore {
-	return &RoomStore{
-		rooms: make(map[uint]map[string]bool),
+// NewGormRoomStore creates a new database-backed room store
+func NewGormRoomStore(db *gorm.DB) *GormRoomStore {
+	return &GormRoomStore{
+		roomSubscriptions: newRoomSubscriptions(),
+		db:                db,
 	}
 }
 
-// CreateRoom creates a new room
-func (s *RoomStore) CreateRoom(name string) (*models.Room, error) {
+// CreateRoom creates a new room. When creatorID is set the creator is
+// recorded and becomes the room's first member and its owner.
+func (s *GormRoomStore) CreateRoom(name string, visibility models.RoomVisibility, creatorID string) (*models.Room, error) {
 	room := &models.Room{
-		Name: name,
+		Name:       name,
+		Type:       models.ChannelRoom,
+		Visibility: visibility,
+		CreatedBy:  creatorID,
 	}
 
-	result := database.DB.Create(room)
-	if result.Error != nil {
-		return nil, ErrRoomExists
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(room).Error; err != nil {
+			if errors.Is(err, gorm.ErrDuplicatedKey) {
+				return ErrRoomExists
+			}
+			return err
+		}
+		if creatorID == "" {
+			return nil
+		}
+		return tx.Create(&models.RoomMember{RoomID: room.ID, UserID: creatorID, Role: models.OwnerRole}).Error
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	s.mu.Lock()
-	s.rooms[room.ID] = make(map[string]bool)
-	s.mu.Unlock()
-
+	s.ensureRoom(room.ID)
 	return room, nil
 }
 
 // GetRoom retrieves a room by ID
-func (s *RoomStore) GetRoom(roomID uint) (*models.Room, error) {
+func (s *GormRoomStore) GetRoom(roomID uint) (*models.Room, error) {
 	var room models.Room
-	result := database.DB.First(&room, roomID)
+	result := s.db.First(&room, roomID)
 	if result.Error != nil {
 		return nil, ErrRoomNotFound
 	}
 
-	s.mu.Lock()
-	if _, exists := s.rooms[roomID]; !exists {
-		s.rooms[roomID] = make(map[string]bool)
-	}
-	s.mu.Unlock()
-
+	s.ensureRoom(roomID)
 	return &room, nil
 }
 
-// GetAllRooms retrieves all rooms
-func (s *RoomStore) GetAllRooms() ([]models.Room, error) {
+// GetAllRooms retrieves all public rooms; private and direct message rooms are left out
+func (s *GormRoomStore) GetAllRooms() ([]models.Room, error) {
 	var rooms []models.Room
-	result := database.DB.Find(&rooms)
+	result := s.db.Where("type = ? AND visibility = ?", models.ChannelRoom, models.PublicRoom).Find(&rooms)
 	if result.Error != nil {
 		return nil, result.Error
 	}
 
-	s.mu.Lock()
 	for _, room := range rooms {
-		if _, exists := s.rooms[room.ID]; !exists {
-			s.rooms[room.ID] = make(map[string]bool)
-		}
+		s.ensureRoom(room.ID)
 	}
-	s.mu.Unlock()
 
 	return rooms, nil
 }
 
-// AddClientToRoom adds a client to a room
-func (s *RoomStore) AddClientToRoom(roomID uint, clientID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// UpdateRoom saves a room's name, topic, description and archived flag
+func (s *GormRoomStore) UpdateRoom(room *models.Room) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var taken int64
+		err := tx.Model(&models.Room{}).Where("name = ? AND id <> ?", room.Name, room.ID).Count(&taken).Error
+		if err != nil {
+			return err
+		}
+		if taken > 0 {
+			return ErrRoomExists
+		}
+
+		room.UpdatedAt = time.Now()
+		result := tx.Model(&models.Room{ID: room.ID}).
+			Select("name", "topic", "description", "archived", "updated_at").
+			Updates(room)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRoomNotFound
+		}
+		return nil
+	})
+}
+
+// DeleteRoom deletes a room along with its memberships, invitations and
+// bans. The room's messages are removed by MessageStore.DeleteRoomMessages.
+func (s *GormRoomStore) DeleteRoom(roomID uint) error {
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("room_id = ?", roomID).Delete(&models.RoomMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("room_id = ?", roomID).Delete(&models.RoomInvitation{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("room_id = ?", roomID).Delete(&models.RoomBan{}).Error; err != nil {
+			return err
+		}
+
+		result := tx.Delete(&models.Room{}, roomID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrRoomNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.forgetRoom(roomID)
+	return nil
+}
+
+// CreateDirectRoom returns the direct message room between two users,
+// creating it with both users as members the first time
+func (s *GormRoomStore) CreateDirectRoom(userID, otherUserID string) (*models.Room, error) {
+	name := directRoomName(userID, otherUserID)
+
+	var room models.Room
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("name = ?", name).Limit(1).Find(&room)
+		if result.Error != nil || result.RowsAffected > 0 {
+			return result.Error
+		}
+
+		room = models.Room{Name: name, Type: models.DirectRoom, Visibility: models.PrivateRoom, CreatedBy: userID}
+		if err := tx.Create(&room).Error; err != nil {
+			return err
+		}
+		return tx.Create([]models.RoomMember{
+			{RoomID: room.ID, UserID: userID, Role: models.MemberRole},
+			{RoomID: room.ID, UserID: otherUserID, Role: models.MemberRole},
+		}).Error
+	})
+	if err != nil {
+		// Lost a race with the other participant creating the same room
+		if lookup := s.db.Where("name = ?", name).First(&room); lookup.Error != nil {
+			return nil, err
+		}
+	}
+
+	s.ensureRoom(room.ID)
+	return &room, nil
+}
+
+// GetUserRooms retrieves the rooms of the given type a user is a member of
+func (s *GormRoomStore) GetUserRooms(userID string, roomType models.RoomType) ([]models.Room, error) {
+	var rooms []models.Room
+	result := s.db.Joins("JOIN room_members ON room_members.room_id = rooms.id").
+		Where("rooms.type = ? AND room_members.user_id = ?", roomType, userID).
+		Order("rooms.id").
+		Find(&rooms)
+	return rooms, result.Error
+}
+
+// GetRoomMembers retrieves the members of a room
+func (s *GormRoomStore) GetRoomMembers(roomID uint) ([]models.RoomMember, error) {
+	var members []models.RoomMember
+	result := s.db.Where("room_id = ?", roomID).Order("created_at").Find(&members)
+	return members, result.Error
+}
+
+// IsRoomMember reports whether a user is a member of a room
+func (s *GormRoomStore) IsRoomMember(roomID uint, userID string) (bool, error) {
+	var count int64
+	result := s.db.Model(&models.RoomMember{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count)
+	return count > 0, result.Error
+}
+
+// AddRoomMember makes a user a member of a room
+func (s *GormRoomStore) AddRoomMember(roomID uint, userID string) error {
+	member := models.RoomMember{RoomID: roomID, UserID: userID, Role: models.MemberRole}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&member)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrAlreadyRoomMember
+	}
+	return nil
+}
+
+// RemoveRoomMember removes a user from a room
+func (s *GormRoomStore) RemoveRoomMember(roomID uint, userID string) error {
+	result := s.db.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomMember{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotRoomMember
+	}
+	return nil
+}
+
+// CreateInvitation invites a user to a room. Inviting someone who declined
+// an earlier invitation reopens it.
+func (s *GormRoomStore) CreateInvitation(roomID uint, userID, invitedBy string) (*models.RoomInvitation, error) {
+	var invitation models.RoomInvitation
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("room_id = ? AND user_id = ?", roomID, userID).Limit(1).Find(&invitation)
+		if result.Error != nil {
+			return result.Error
+		}
+
+		invitation.RoomID = roomID
+		invitation.UserID = userID
+		invitation.InvitedBy = invitedBy
+		invitation.Status = models.InvitationPending
+		invitation.CreatedAt = time.Now()
+		invitation.RespondedAt = nil
+		return tx.Save(&invitation).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &invitation, nil
+}
 
-	if _, exists := s.rooms[roomID]; !exists {
-		s.rooms[roomID] = make(map[string]bool)
+// GetInvitation retrieves an invitation by ID
+func (s *GormRoomStore) GetInvitation(invitationID uint) (*models.RoomInvitation, error) {
+	var invitation models.RoomInvitation
+	result := s.db.First(&invitation, invitationID)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrInvitationNotFound
+		}
+		return nil, result.Error
 	}
-	s.rooms[roomID][clientID] = true
+
+	return &invitation, nil
+}
+
+// GetPendingInvitations retrieves the invitations a user hasn't answered yet
+func (s *GormRoomStore) GetPendingInvitations(userID string) ([]models.RoomInvitation, error) {
+	var invitations []models.RoomInvitation
+	result := s.db.Where("user_id = ? AND status = ?", userID, models.InvitationPending).
+		Order("id").
+		Find(&invitations)
+	return invitations, result.Error
+}
+
+// RespondToInvitation accepts or declines a pending invitation. Accepting
+// makes the invited user a member of the room.
+func (s *GormRoomStore) RespondToInvitation(invitationID uint, accept bool) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var invitation models.RoomInvitation
+		result := tx.Where("id = ? AND status = ?", invitationID, models.InvitationPending).Limit(1).Find(&invitation)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvitationNotFound
+		}
+
+		status := models.InvitationDeclined
+		if accept {
+			status = models.InvitationAccepted
+		}
+		err := tx.Model(&invitation).Updates(map[string]interface{}{
+			"status":       status,
+			"responded_at": time.Now(),
+		}).Error
+		if err != nil || !accept {
+			return err
+		}
+
+		member := models.RoomMember{RoomID: invitation.RoomID, UserID: invitation.UserID, Role: models.MemberRole}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&member).Error
+	})
 }
 
-// RemoveClientFromRoom removes a client from a room
-func (s *RoomStore) RemoveClientFromRoom(roomID uint, clientID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// GetRoomRole retrieves a member's role in a room
+func (s *GormRoomStore) GetRoomRole(roomID uint, userID string) (models.RoomRole, error) {
+	var member models.RoomMember
+	result := s.db.Where("room_id = ? AND user_id = ?", roomID, userID).Limit(1).Find(&member)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", ErrNotRoomMember
+	}
+	return member.Role, nil
+}
 
-	if clients, exists := s.rooms[roomID]; exists {
-		delete(clients, clientID)
+// SetRoomRole changes a member's role in a room
+func (s *GormRoomStore) SetRoomRole(roomID uint, userID string, role models.RoomRole) error {
+	result := s.db.Model(&models.RoomMember{}).
+		Where("room_id = ? AND user_id = ?", roomID, userID).
+		Update("role", role)
+	if result.Error != nil {
+		return result.Error
 	}
+	if result.RowsAffected == 0 {
+		return ErrNotRoomMember
+	}
+	return nil
 }
 
-// GetRoomClients returns all client IDs in a room
-func (s *RoomStore) GetRoomClients(roomID uint) []string {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// BanUser bans a user from a room, ending their membership and declining
+// any pending invitation
+func (s *GormRoomStore) BanUser(roomID uint, userID, bannedBy, reason string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		ban := models.RoomBan{RoomID: roomID, UserID: userID, BannedBy: bannedBy, Reason: reason}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ban)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyBanned
+		}
 
-	clients := make([]string, 0)
-	if roomClients, exists := s.rooms[roomID]; exists {
-		for clientID := range roomClients {
-			clients = append(clients, clientID)
+		if err := tx.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomMember{}).Error; err != nil {
+			return err
 		}
+		return tx.Model(&models.RoomInvitation{}).
+			Where("room_id = ? AND user_id = ? AND status = ?", roomID, userID, models.InvitationPending).
+			Updates(map[string]interface{}{
+				"status":       models.InvitationDeclined,
+				"responded_at": time.Now(),
+			}).Error
+	})
+}
+
+// UnbanUser lifts a user's ban from a room
+func (s *GormRoomStore) UnbanUser(roomID uint, userID string) error {
+	result := s.db.Where("room_id = ? AND user_id = ?", roomID, userID).Delete(&models.RoomBan{})
+	if result.Error != nil {
+		return result.Error
 	}
-	return clients
+	if result.RowsAffected == 0 {
+		return ErrNotBanned
+	}
+	return nil
+}
+
+// IsBanned reports whether a user is banned from a room
+func (s *GormRoomStore) IsBanned(roomID uint, userID string) (bool, error) {
+	var count int64
+	result := s.db.Model(&models.RoomBan{}).Where("room_id = ? AND user_id = ?", roomID, userID).Count(&count)
+	return count > 0, result.Error
+}
+
+// GetBans retrieves the users banned from a room
+func (s *GormRoomStore) GetBans(roomID uint) ([]models.RoomBan, error) {
+	var bans []models.RoomBan
+	result := s.db.Where("room_id = ?", roomID).Order("created_at").Find(&bans)
+	return bans, result.Error
 }
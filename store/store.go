@@ -0,0 +1,199 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"chatapp/models"
+)
+
+// UserStore persists registered users
+type UserStore interface {
+	CreateUser(username, email, passwordHash string) (*models.User, error)
+	GetUser(username string) (*models.User, error)
+	GetUserByID(userID string) (*models.User, error)
+
+	// Two-factor authentication
+	SetTOTPSecret(userID, secret string) error
+	EnableTOTP(userID string, recoveryCodeHashes []string) error
+	DisableTOTP(userID string) error
+	UseTOTPStep(userID string, step int64) error
+	UseRecoveryCode(userID, codeHash string) error
+
+	// Single sign-on
+	GetUserByEmail(email string) (*models.User, error)
+	GetUserByIdentity(issuer, subject string) (*models.User, error)
+	LinkIdentity(userID, issuer, subject string) error
+}
+
+// RoomStore persists chat rooms and tracks which clients are subscribed to them
+type RoomStore interface {
+	CreateRoom(name string, visibility models.RoomVisibility, creatorID string) (*models.Room, error)
+	GetRoom(roomID uint) (*models.Room, error)
+	GetAllRooms() ([]models.Room, error)
+	UpdateRoom(room *models.Room) error
+	DeleteRoom(roomID uint) error
+	CreateDirectRoom(userID, otherUserID string) (*models.Room, error)
+	GetUserRooms(userID string, roomType models.RoomType) ([]models.Room, error)
+
+	// Membership and invitations
+	AddRoomMember(roomID uint, userID string) error
+	RemoveRoomMember(roomID uint, userID string) error
+	GetRoomMembers(roomID uint) ([]models.RoomMember, error)
+	IsRoomMember(roomID uint, userID string) (bool, error)
+	CreateInvitation(roomID uint, userID, invitedBy string) (*models.RoomInvitation, error)
+	GetInvitation(invitationID uint) (*models.RoomInvitation, error)
+	GetPendingInvitations(userID string) ([]models.RoomInvitation, error)
+	RespondToInvitation(invitationID uint, accept bool) error
+
+	// Roles and bans
+	GetRoomRole(roomID uint, userID string) (models.RoomRole, error)
+	SetRoomRole(roomID uint, userID string, role models.RoomRole) error
+	BanUser(roomID uint, userID, bannedBy, reason string) error
+	UnbanUser(roomID uint, userID string) error
+	IsBanned(roomID uint, userID string) (bool, error)
+	GetBans(roomID uint) ([]models.RoomBan, error)
+
+	// Connected clients
+	AddClientToRoom(roomID uint, clientID string)
+	RemoveClientFromRoom(roomID uint, clientID string)
+	GetRoomClients(roomID uint) []string
+}
+
+// MessageStore persists chat messages
+type MessageStore interface {
+	Save(message *models.Message) error
+	GetByID(messageID uint) (*models.Message, error)
+	GetByRoom(roomID uint, query MessageQuery) ([]models.Message, error)
+	GetThread(parentID uint, query MessageQuery) ([]models.Message, error)
+	GetChangedSince(roomID, messageID uint, limit int) ([]models.Message, error)
+	Edit(messageID uint, content string) (*models.Message, error)
+	GetRevisions(messageID uint) ([]models.MessageRevision, error)
+	Delete(messageID uint) (*models.Message, error)
+	PurgeDeleted(before time.Time) (int64, error)
+	AddReaction(messageID uint, userID, emoji string) error
+	RemoveReaction(messageID uint, userID, emoji string) error
+	GetReactions(messageID uint) ([]models.ReactionCount, error)
+	Pin(messageID uint, pinnedBy string) (*models.Message, error)
+	Unpin(messageID uint) (*models.Message, error)
+	GetPinned(roomID uint) ([]models.Message, error)
+	DeleteRoomMessages(roomID uint) error
+}
+
+// MessageQuery selects a page of a room's history by message ID cursors.
+// With AfterID set the page starts right after that message; otherwise it
+// ends right before BeforeID (or at the newest message when BeforeID is 0).
+// Results are always in chronological order. Room history holds top-level
+// messages only unless WithReplies is set.
+type MessageQuery struct {
+	BeforeID    uint
+	AfterID     uint
+	Limit       int
+	WithReplies bool
+}
+
+// TokenStore persists refresh tokens and revoked sessions
+type TokenStore interface {
+	CreateRefreshToken(token *models.RefreshToken) error
+	GetRefreshToken(tokenHash string) (*models.RefreshToken, error)
+	RevokeRefreshToken(id string) error
+	RevokeSession(sessionID string, accessExpiry time.Time) error
+	IsSessionRevoked(sessionID string) (bool, error)
+	PurgeExpired(now time.Time) error
+}
+
+// LoginAttemptStore tracks failed logins per username and per client IP
+type LoginAttemptStore interface {
+	GetLoginAttempt(key string) (*models.LoginAttempt, error)
+	RecordLoginFailure(key string, since time.Time) (*models.LoginAttempt, error)
+	LockLogin(key string, until time.Time) error
+	ClearLoginAttempts(key string) error
+	PurgeLoginAttempts(before time.Time) error
+}
+
+// NotificationStore persists in-app notifications
+type NotificationStore interface {
+	CreateNotification(notification *models.Notification) error
+	GetNotifications(userID string, unreadOnly bool, limit int) ([]models.Notification, error)
+	MarkNotificationRead(notificationID uint, userID string) error
+}
+
+// DirectRoomPrefix starts the generated names of direct message rooms
+const DirectRoomPrefix = "dm:"
+
+// directRoomName is the unique name of the direct message room between two
+// users. The name doesn't depend on who started the conversation, so the
+// rooms table's unique name constraint also guarantees one room per pair.
+func directRoomName(userID, otherUserID string) string {
+	if otherUserID < userID {
+		userID, otherUserID = otherUserID, userID
+	}
+	return DirectRoomPrefix + userID + ":" + otherUserID
+}
+
+// roomSubscriptions tracks connected clients per room. Subscriptions are
+// never persisted, so every RoomStore implementation shares this bookkeeping.
+type roomSubscriptions struct {
+	mu sync.RWMutex
+	// roomID -> map of clients
+	rooms map[uint]map[string]bool
+}
+
+func newRoomSubscriptions() roomSubscriptions {
+	return roomSubscriptions{
+		rooms: make(map[uint]map[string]bool),
+	}
+}
+
+// ensureRoom makes sure a subscription set exists for the room
+func (s *roomSubscriptions) ensureRoom(roomID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.rooms[roomID]; !exists {
+		s.rooms[roomID] = make(map[string]bool)
+	}
+}
+
+// forgetRoom drops the subscription set of a deleted room
+func (s *roomSubscriptions) forgetRoom(roomID uint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.rooms, roomID)
+}
+
+// AddClientToRoom adds a client to a room
+func (s *roomSubscriptions) AddClientToRoom(roomID uint, clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.rooms[roomID]; !exists {
+		s.rooms[roomID] = make(map[string]bool)
+	}
+	s.rooms[roomID][clientID] = true
+}
+
+// RemoveClientFromRoom removes a client from a room
+func (s *roomSubscriptions) RemoveClientFromRoom(roomID uint, clientID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if clients, exists := s.rooms[roomID]; exists {
+		delete(clients, clientID)
+	}
+}
+
+// GetRoomClients returns all client IDs in a room
+func (s *roomSubscriptions) GetRoomClients(roomID uint) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clients := make([]string, 0)
+	if roomClients, exists := s.rooms[roomID]; exists {
+		for clientID := range roomClients {
+			clients = append(clients, clientID)
+		}
+	}
+	return clients
+}
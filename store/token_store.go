@@ -0,0 +1,95 @@
+package store
+
+import (
+	"errors"
+	"time"
+
+	"chatapp/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrTokenNotFound = errors.New("refresh token not found")
+	ErrTokenRevoked  = errors.New("refresh token already used or revoked")
+)
+
+// GormTokenStore manages refresh tokens and revoked sessions in the database
+type GormTokenStore struct {
+	db *gorm.DB
+}
+
+// NewGormTokenStore creates a new database-backed token store
+func NewGormTokenStore(db *gorm.DB) *GormTokenStore {
+	return &GormTokenStore{db: db}
+}
+
+// CreateRefreshToken stores a newly issued refresh token
+func (s *GormTokenStore) CreateRefreshToken(token *models.RefreshToken) error {
+	return s.db.Create(token).Error
+}
+
+// GetRefreshToken retrieves a refresh token by the hash of its value
+func (s *GormTokenStore) GetRefreshToken(tokenHash string) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+	result := s.db.Where("token_hash = ?", tokenHash).First(&token)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrTokenNotFound
+		}
+		return nil, result.Error
+	}
+
+	return &token, nil
+}
+
+// RevokeRefreshToken marks a refresh token as used. Only one caller can win:
+// if the token was already revoked ErrTokenRevoked is returned.
+func (s *GormTokenStore) RevokeRefreshToken(id string) error {
+	result := s.db.Model(&models.RefreshToken{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// RevokeSession revokes every refresh token of a session and rejects its
+// access tokens until accessExpiry, after which none can still be valid.
+func (s *GormTokenStore) RevokeSession(sessionID string, accessExpiry time.Time) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.RefreshToken{}).
+			Where("session_id = ? AND revoked_at IS NULL", sessionID).
+			Update("revoked_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "session_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"expires_at"}),
+		}).Create(&models.RevokedSession{SessionID: sessionID, ExpiresAt: accessExpiry}).Error
+	})
+}
+
+// IsSessionRevoked reports whether access tokens of a session are revoked
+func (s *GormTokenStore) IsSessionRevoked(sessionID string) (bool, error) {
+	var count int64
+	err := s.db.Model(&models.RevokedSession{}).
+		Where("session_id = ? AND expires_at > ?", sessionID, time.Now()).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// PurgeExpired removes refresh tokens and revoked sessions that expired before now
+func (s *GormTokenStore) PurgeExpired(now time.Time) error {
+	if err := s.db.Where("expires_at < ?", now).Delete(&models.RefreshToken{}).Error; err != nil {
+		return err
+	}
+	return s.db.Where("expires_at < ?", now).Delete(&models.RevokedSession{}).Error
+}
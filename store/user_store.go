@@ -2,42 +2,52 @@ package store
 
 import (
 	"errors"
-	"sync"
 	"time"
 
 	"chatapp/models"
 
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
 	ErrUserExists      = errors.New("username already exists")
+	ErrEmailExists     = errors.New("email already registered")
 	ErrUserNotFound    = errors.New("user not found")
 	ErrInvalidPassword = errors.New("invalid password")
+	ErrCodeUsed        = errors.New("code already used")
+	ErrInvalidCode     = errors.New("invalid recovery code")
+	ErrIdentityLinked  = errors.New("identity already linked")
 )
 
-// UserStore manages user data (in-memory for now)
-type UserStore struct {
-	mu    sync.RWMutex
-	users map[string]*models.User // username -> user
+// GormUserStore manages user persistence in the database
+type GormUserStore struct {
+	db *gorm.DB
 }
 
-// NewUserStore creates a new user store
-func NewUserStore() *UserStore {
-	return &UserStore{
-		users: make(map[string]*models.User),
-	}
+// NewGormUserStore creates a new database-backed user store
+func NewGormUserStore(db *gorm.DB) *GormUserStore {
+	return &GormUserStore{db: db}
 }
 
 // CreateUser creates a new user
-func (s *UserStore) CreateUser(username, email, passwordHash string) (*models.User, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.users[username]; exists {
+func (s *GormUserStore) CreateUser(username, email, passwordHash string) (*models.User, error) {
+	var count int64
+	if err := s.db.Model(&models.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
 		return nil, ErrUserExists
 	}
 
+	if err := s.db.Model(&models.User{}).Where("email = ?", email).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, ErrEmailExists
+	}
+
 	user := &models.User{
 		ID:           uuid.New().String(),
 		Username:     username,
@@ -46,33 +56,176 @@ func (s *UserStore) CreateUser(username, email, passwordHash string) (*models.Us
 		CreatedAt:    time.Now(),
 	}
 
-	s.users[username] = user
+	// The unique indexes still guard against a concurrent registration
+	// slipping in between the checks above and the insert. Any other error
+	// is a database failure, not a conflict.
+	if err := s.db.Create(user).Error; err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, s.conflict(username)
+		}
+		return nil, err
+	}
+
 	return user, nil
 }
 
-// GetUser retrieves a user by username
-func (s *UserStore) GetUser(username string) (*models.User, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+// conflict tells which unique column a concurrent registration took first
+func (s *GormUserStore) conflict(username string) error {
+	var count int64
+	if err := s.db.Model(&models.User{}).Where("username = ?", username).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrUserExists
+	}
+	return ErrEmailExists
+}
 
-	user, exists := s.users[username]
-	if !exists {
-		return nil, ErrUserNotFound
+// GetUser retrieves a user by username
+func (s *GormUserStore) GetUser(username string) (*models.User, error) {
+	var user models.User
+	result := s.db.Where("username = ?", username).First(&user)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, result.Error
 	}
 
-	return user, nil
+	return &user, nil
 }
 
 // GetUserByID retrieves a user by ID
-func (s *UserStore) GetUserByID(userID string) (*models.User, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *GormUserStore) GetUserByID(userID string) (*models.User, error) {
+	var user models.User
+	result := s.db.Where("id = ?", userID).First(&user)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, result.Error
+	}
+
+	return &user, nil
+}
+
+// SetTOTPSecret starts TOTP enrollment with a new secret. Two-factor
+// authentication stays off until EnableTOTP.
+func (s *GormUserStore) SetTOTPSecret(userID, secret string) error {
+	return s.db.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"totp_secret":     secret,
+		"totp_enabled_at": nil,
+		"totp_last_step":  0,
+	}).Error
+}
+
+// EnableTOTP turns on two-factor authentication with the enrolled secret and
+// replaces the user's recovery codes
+func (s *GormUserStore) EnableTOTP(userID string, recoveryCodeHashes []string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", userID).Update("totp_enabled_at", time.Now()).Error
+		if err != nil {
+			return err
+		}
 
-	for _, user := range s.users {
-		if user.ID == userID {
-			return user, nil
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
 		}
+		codes := make([]models.RecoveryCode, len(recoveryCodeHashes))
+		for i, hash := range recoveryCodeHashes {
+			codes[i] = models.RecoveryCode{UserID: userID, CodeHash: hash}
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// DisableTOTP turns off two-factor authentication and drops the secret and
+// recovery codes
+func (s *GormUserStore) DisableTOTP(userID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_secret":     "",
+			"totp_enabled_at": nil,
+			"totp_last_step":  0,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+}
+
+// UseTOTPStep records that the code of a time step was used. Only one
+// caller can use a step, and never an earlier one: ErrCodeUsed is returned
+// for replays.
+func (s *GormUserStore) UseTOTPStep(userID string, step int64) error {
+	result := s.db.Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).
+		Update("totp_last_step", step)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrCodeUsed
+	}
+	return nil
+}
+
+// UseRecoveryCode spends one of the user's recovery codes. ErrInvalidCode is
+// returned for unknown or already used codes.
+func (s *GormUserStore) UseRecoveryCode(userID, codeHash string) error {
+	result := s.db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// GetUserByEmail retrieves a user by email address
+func (s *GormUserStore) GetUserByEmail(email string) (*models.User, error) {
+	var user models.User
+	result := s.db.Where("email = ?", email).First(&user)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, result.Error
+	}
+
+	return &user, nil
+}
+
+// GetUserByIdentity retrieves the user linked to a single sign-on account
+func (s *GormUserStore) GetUserByIdentity(issuer, subject string) (*models.User, error) {
+	var user models.User
+	result := s.db.Joins("JOIN user_identities ON user_identities.user_id = users.id").
+		Where("user_identities.issuer = ? AND user_identities.subject = ?", issuer, subject).
+		First(&user)
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, result.Error
 	}
 
-	return nil, ErrUserNotFound
+	return &user, nil
+}
+
+// LinkIdentity links a single sign-on account to a user. ErrIdentityLinked
+// is returned when the account is already linked, to this user or another.
+func (s *GormUserStore) LinkIdentity(userID, issuer, subject string) error {
+	identity := &models.UserIdentity{UserID: userID, Issuer: issuer, Subject: subject}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(identity)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrIdentityLinked
+	}
+	return nil
 }